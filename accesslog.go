@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+
+	combinedTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// CombinedLog writes access entries in the combined log format understood by
+// Apache and Nginx log analyzers:
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+type CombinedLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewCombinedLog(out io.Writer) *CombinedLog {
+	return &CombinedLog{out: out}
+}
+
+// Log writes the entry of a completed request, size being the body bytes
+// only. User is the proxy user authenticating the request, if any.
+func (l *CombinedLog) Log(r *http.Request, user string, status, size int, start time.Time) {
+	line := combinedLine(r, user, status, size, start)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+func combinedLine(r *http.Request, user string, status, size int, start time.Time) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if user == "" && r.URL.User != nil {
+		user = r.URL.User.Username()
+	}
+	if status == 0 {
+		// nothing written means an implicit 200
+		status = http.StatusOK
+	}
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.Itoa(size)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		orDash(client),
+		escapeLogField(orDash(user)),
+		start.Format(combinedTimeLayout),
+		escapeLogField(r.Method), escapeLogField(r.RequestURI), escapeLogField(r.Proto),
+		status,
+		bytes,
+		escapeLogField(orDash(r.Referer())),
+		escapeLogField(orDash(r.UserAgent())),
+	)
+}
+
+// LogFilter matches the requests left out of the access log, by path of the
+// local endpoints such as "/readyz" or by rule such as "monitor.example.com"
+type LogFilter struct {
+	paths map[string]bool
+	hosts *Blocklist
+}
+
+func NewLogFilter(entries []string) *LogFilter {
+	f := &LogFilter{paths: make(map[string]bool)}
+	var hosts []string
+	for _, e := range entries {
+		if strings.HasPrefix(e, "/") {
+			f.paths[e] = true
+		} else {
+			hosts = append(hosts, e)
+		}
+	}
+	if len(hosts) > 0 {
+		f.hosts = NewBlocklist("no-log", SourceEnv, hosts)
+	}
+	return f
+}
+
+// Skip reports whether r must not be logged, only proxied requests being
+// matched against the rules
+func (f *LogFilter) Skip(r *http.Request) bool {
+	if f == nil {
+		return false
+	}
+	if r.URL.Host == "" {
+		return f.paths[r.URL.Path]
+	}
+	return f.hosts != nil && f.hosts.Match(RequestTarget(r)) != nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeLogField escapes quotes, backslashes and control characters the way
+// Apache does, so that a field can never break out of its quotes
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCombinedLine(t *testing.T) {
+	start := time.Date(2024, 3, 4, 9, 5, 7, 0, time.FixedZone("", 3600))
+	request := func(raw string) *http.Request {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "192.0.2.7:51234"
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		r      *http.Request
+		user   string
+		status int
+		size   int
+	}{
+		{"proxied", request("GET http://news.test/a?b=c HTTP/1.1\r\nHost: news.test\r\nReferer: http://docs.test/\r\nUser-Agent: curl/8.0\r\n\r\n"), "", 200, 512},
+		{"user", request("GET http://news.test/ HTTP/1.1\r\nHost: news.test\r\n\r\n"), "alice", 403, 0},
+		{"implicit status", request("GET /readyz HTTP/1.0\r\n\r\n"), "", 0, 6},
+		{"tunnel", request("CONNECT news.test:443 HTTP/1.1\r\nHost: news.test:443\r\n\r\n"), "", 200, 0},
+		{"escaped", request("GET http://news.test/ HTTP/1.1\r\nHost: news.test\r\n\r\n"), "al\"ice", 200, 1},
+	}
+	// what a client could send in a header which is not valid on the wire
+	tests[len(tests)-1].r.Header.Set("User-Agent", "evil\" \\ \x01")
+	var got strings.Builder
+	for _, tt := range tests {
+		got.WriteString(combinedLine(tt.r, tt.user, tt.status, tt.size, start))
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "combined.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("got\n%s\nwant\n%s", got.String(), want)
+	}
+}
+
+func TestCombinedAccessLog(t *testing.T) {
+	t.Setenv("PROXY_USERS", "alice:secret")
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/page", testutil.Route{Body: "0123456789"})
+	cfg := testConfig(t, upstream)
+	cfg.AccessLogFormat = AccessLogCombined
+	cfg.AccessLogFile = filepath.Join(t.TempDir(), "access.log")
+	proxy, _ := startProxy(t, cfg)
+
+	get(t, proxy.ClientAs(url.UserPassword("alice", "secret")), "http://news.test/page")
+	get(t, proxy.Client, "http://news.test/page")
+
+	// the entries are written once the responses are sent
+	var lines []string
+	for deadline := time.Now().Add(5 * time.Second); len(lines) < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		data, err := os.ReadFile(cfg.AccessLogFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = strings.SplitAfter(string(data), "\n")
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got lines %q, want 2", lines)
+	}
+	// the clients do not share a connection, so either line may come first
+	if strings.Contains(lines[1], " alice ") {
+		lines[0], lines[1] = lines[1], lines[0]
+	}
+	if want := `127.0.0.1 - alice [`; !strings.HasPrefix(lines[0], want) || !strings.Contains(lines[0], `] "GET http://news.test/page HTTP/1.1" 200 10 "-" "Go-http-client/1.1"`) {
+		t.Errorf("got %q, want the request of alice with its status and size", lines[0])
+	}
+	if want := `127.0.0.1 - - [`; !strings.HasPrefix(lines[1], want) || !strings.Contains(lines[1], `" 407 `) {
+		t.Errorf("got %q, want the 407 of the unauthenticated request", lines[1])
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	f := NewLogFilter([]string{"/readyz", "monitor.test"})
+	tests := map[string]bool{
+		"/readyz":                     true,
+		"/readyz/sub":                 false,
+		"/admin/stats":                false,
+		"http://monitor.test/health":  true,
+		"http://a.monitor.test/":      true,
+		"http://news.test/readyz":     false,
+		"http://news.test/monitoring": false,
+	}
+	for target, want := range tests {
+		r, _ := http.NewRequest(http.MethodGet, target, nil)
+		if got := f.Skip(r); got != want {
+			t.Errorf("%s: got %t, want %t", target, got, want)
+		}
+	}
+	var none *LogFilter
+	if none.Skip(&http.Request{URL: &url.URL{Path: "/readyz"}}) {
+		t.Error("a nil filter skips requests")
+	}
+}
+
+func TestNoLogPaths(t *testing.T) {
+	t.Setenv("NO_LOG_PATHS", "/readyz")
+	proxy, _ := startProxy(t, testConfig(t, nil))
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	// one connection for both, so the first request is done logging by the time of the second
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: adminTransport{transport}}
+	for _, path := range []string{"/readyz", "/admin/stats"} {
+		if resp, _ := get(t, client, proxy.URL+path); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d, want 200", path, resp.StatusCode)
+		}
+	}
+	entries := logs.Wait(t, "request completed", 1)
+	if len(entries) != 1 || entries[0].Data["uri"] != "/admin/stats" {
+		t.Errorf("got %d entries, want only the one for /admin/stats", len(entries))
+	}
+}
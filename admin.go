@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/report"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminRoutes are the endpoints managing the proxy, which all require the
+// admin token but /readyz and /api/status
+func AdminRoutes(s *Server) Routes {
+	cfg, rules, stats, health, flags := s.cfg, s.rules, s.stats, s.health, s.flags
+	now := cfg.clock()
+	mux := http.NewServeMux()
+	dashboard := dashboardHandler()
+	mux.Handle("/dashboard", dashboard)
+	mux.Handle("/dashboard/", dashboard)
+	mux.Handle("/admin/maintenance", maintenanceHandler(health, now))
+	mux.Handle("/admin/flags", flagsHandler(flags))
+	mux.Handle("/admin/reload", reloadHandler(s.Reload))
+	mux.Handle("/admin/config", configHandler(cfg, flags))
+	mux.Handle("/admin/connections", connectionsHandler(stats.Streams))
+	mux.Handle("/admin/exemptions", exemptionsHandler(s.exemptions))
+	if s.faults != nil {
+		mux.Handle("/admin/faults", faultsHandler(s.faults))
+	}
+	mux.HandleFunc("/admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		health.Drain()
+		adminLog.Info("draining, readyz now reports not ready")
+		writeJSON(w, http.StatusOK, map[string]bool{"ready": health.Ready()})
+	})
+	mux.HandleFunc("/admin/rules", func(w http.ResponseWriter, r *http.Request) {
+		var unusedFor time.Duration
+		if v := r.URL.Query().Get("unused_for"); v != "" {
+			var err error
+			if unusedFor, err = parseDays(v); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, ruleReport(rules.Load().All(), unusedFor, now()))
+	})
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		report := map[string]interface{}{
+			"tarpit":    s.tarpit.Stats(),
+			"blocked":   stats.Blocked.Load(),
+			"bypassed":  stats.Bypassed.Load(),
+			"upstream":  stats.Upstream.Stats(),
+			"streams":   stats.Streams.Len(),
+			"truncated": stats.Truncated.Load(),
+			"latency":   stats.Latency.Report(),
+			"shed":      stats.Shed.Load(),
+			"shedding":  health.Shedding(),
+		}
+		if stats.Conns != nil {
+			report["connections"] = stats.Conns.Stats()
+		}
+		if stats.Budget.Enabled() {
+			report["site_budget"] = stats.Budget.State()
+		}
+		if stats.Cooldown.Enabled() {
+			report["cooldown"] = stats.Cooldown.Stats()
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+	mux.HandleFunc("/admin/report/weekly", func(w http.ResponseWriter, r *http.Request) {
+		from, to := report.LastWeek(now())
+		var err error
+		if v := r.URL.Query().Get("from"); v != "" {
+			if from, err = time.ParseInLocation(report.DateLayout, v, time.Local); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		if v := r.URL.Query().Get("to"); v != "" {
+			if to, err = time.ParseInLocation(report.DateLayout, v, time.Local); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		weekly := report.Build(stats.Daily.Days(), from, to)
+		if preferredType(r, "text/html", "application/json") == "text/html" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := report.RenderHTML(w, weekly); err != nil {
+				adminLog.WithField("event", "render report").Warn(err)
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, weekly)
+	})
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stats.Usage.Report())
+	})
+	mux.HandleFunc("/score", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stats.Score.Report())
+	})
+	mux.HandleFunc("/score/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats.Score.Reset()
+		adminLog.Info("score reset")
+		writeJSON(w, http.StatusOK, stats.Score.Report())
+	})
+	return Routes{
+		"/readyz":          readyzHandler(health),
+		"/api/status":      statusHandler(cfg, rules, stats, health, flags),
+		"/dashboard/login": loginHandler(cfg),
+		"/":                requireAdmin(cfg, mux),
+	}
+}
+
+// adminCookie holds ADMIN_TOKEN for the browsers logged in to the dashboard
+const adminCookie = "procrastiproxy_admin"
+
+// isAdmin reports whether r carries ADMIN_TOKEN as a bearer token or, to read
+// only, in the cookie of the dashboard login. Without ADMIN_TOKEN, the
+// requests of the listeners serving the admin role without the proxy one,
+// such as a unix socket, are the admin ones: anyone who may use the proxy
+// would be an admin.
+func isAdmin(cfg *Config, r *http.Request) bool {
+	if cfg.AdminToken == "" {
+		return !servesRole(r, RoleProxy)
+	}
+	token := bearerToken(r)
+	// browsers send the cookie by themselves, so it changes nothing
+	if token == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if c, err := r.Cookie(adminCookie); err == nil {
+			token = c.Value
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// requireAdmin lets through the admin requests, see isAdmin. The dashboard
+// answers the others with its login page.
+func requireAdmin(cfg *Config, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isAdmin(cfg, r):
+			h.ServeHTTP(w, r)
+		case cfg.AdminToken == "":
+			adminLog.WithField("uri", r.RequestURI).Warn("admin request refused, ADMIN_TOKEN is required on the listeners serving the proxy")
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "the admin endpoints served along with the proxy require ADMIN_TOKEN"})
+		case r.URL.Path == "/dashboard":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			serveLogin(w, http.StatusUnauthorized, "")
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+		}
+	})
+}
+
+// bearerToken returns the bearer token of the Authorization header of r
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+type ruleStats struct {
+	ID      string     `json:"id"`
+	Pattern string     `json:"pattern"`
+	Action  string     `json:"action"`
+	Source  string     `json:"source"`
+	Hits    int64      `json:"hits"`
+	LastHit *time.Time `json:"last_hit"`
+}
+
+// ruleReport lists the rules, keeping only those without a hit in the last
+// unusedFor before now when it is set
+func ruleReport(rules []*Rule, unusedFor time.Duration, now time.Time) []ruleStats {
+	report := []ruleStats{}
+	for _, rule := range rules {
+		lastHit := rule.LastHit()
+		if unusedFor > 0 && !lastHit.IsZero() && now.Sub(lastHit) < unusedFor {
+			continue
+		}
+		stats := ruleStats{
+			ID:      rule.ID,
+			Pattern: rule.Pattern,
+			Action:  rule.Action,
+			Source:  rule.Source,
+			Hits:    rule.Hits(),
+		}
+		if !lastHit.IsZero() {
+			stats.LastHit = &lastHit
+		}
+		report = append(report, stats)
+	}
+	return report
+}
+
+// parseDays parses a duration, also accepting a number of days such as "30d"
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithField("event", "write json").Warn(err)
+	}
+}
+
+// RouteRequests sends absolute-form proxy requests to proxy and everything else to local
+func RouteRequests(proxy, local http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "" {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		local.ServeHTTP(w, r)
+	})
+}
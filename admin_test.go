@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRuleReportUnusedFor(t *testing.T) {
+	now := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	recent := NewRule(ActionBlock, SourceEnv, "recent.test")
+	recent.Hit(now.Add(-29 * 24 * time.Hour))
+	old := NewRule(ActionBlock, SourceEnv, "old.test")
+	old.restore(3, now.Add(-40*24*time.Hour))
+	never := NewRule(ActionBlock, SourceEnv, "never.test")
+	rules := []*Rule{recent, old, never}
+
+	if got := ruleReport(rules, 0, now); len(got) != 3 {
+		t.Errorf("got %d rules without a filter, want 3", len(got))
+	}
+	got := ruleReport(rules, 30*24*time.Hour, now)
+	if len(got) != 2 || got[0].Pattern != "old.test" || got[0].Hits != 3 || got[1].Pattern != "never.test" || got[1].LastHit != nil {
+		t.Errorf("got %+v, want old.test and never.test", got)
+	}
+}
+
+func TestParseDays(t *testing.T) {
+	tests := map[string]time.Duration{"30d": 30 * 24 * time.Hour, "0d": 0, "36h": 36 * time.Hour}
+	for s, want := range tests {
+		if got, err := parseDays(s); err != nil || got != want {
+			t.Errorf("%q: got %s, %v, want %s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"-1d", "xd", "30"} {
+		if _, err := parseDays(s); err == nil {
+			t.Errorf("%q: got no error", s)
+		}
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.EnableFaults = true
+	proxy, s := startProxy(t, cfg)
+	endpoints := []struct{ method, path string }{
+		{http.MethodPost, "/admin/maintenance"},
+		{http.MethodPost, "/admin/flags"},
+		{http.MethodPost, "/admin/reload"},
+		{http.MethodPut, "/admin/faults"},
+		{http.MethodPost, "/admin/drain"},
+		{http.MethodDelete, "/admin/connections?id=1"},
+		{http.MethodPost, "/score/reset"},
+		{http.MethodGet, "/admin/stats"},
+		{http.MethodGet, "/dashboard"},
+	}
+	for _, e := range endpoints {
+		for _, token := range []string{"", "Bearer wrong", "Basic " + testAdminToken} {
+			req, _ := http.NewRequest(e.method, proxy.URL+e.path, nil)
+			if token != "" {
+				req.Header.Set("Authorization", token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s with %q: got %d, want 401", e.method, e.path, token, resp.StatusCode)
+			}
+		}
+	}
+	if !s.health.Ready() {
+		t.Error("an unauthenticated request drained the server")
+	}
+	// the probes need no token
+	if resp, _ := get(t, http.DefaultClient, proxy.URL+"/readyz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d for /readyz, want 200", resp.StatusCode)
+	}
+	if resp, _ := get(t, admin, proxy.URL+"/admin/stats"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d with the token, want 200", resp.StatusCode)
+	}
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.AdminToken = ""
+	h := requireAdmin(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		roles []string
+		want  int
+	}{
+		{[]string{RoleProxy, RoleAdmin}, http.StatusForbidden},
+		{[]string{RoleAdmin}, http.StatusOK},
+		// the listeners not bound by Listen serve the proxy as well
+		{nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+		if tt.roles != nil {
+			r = r.WithContext(context.WithValue(r.Context(), listenerRolesKey{}, tt.roles))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("roles %v: got %d, want %d", tt.roles, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rule actions
+const (
+	ActionAllow   = "allow"
+	ActionBlock   = "block"
+	ActionBypass  = "bypass"
+	ActionTarpit  = "tarpit"
+	ActionUpgrade = "upgrade"
+)
+
+// where rules and configuration values come from
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceAdmin   = "admin"
+)
+
+type (
+	// Rule is a single blocklist entry along with its hit statistics.
+	// A pattern such as "http://example.com" only matches that scheme,
+	// "example.com/shorts" only that path and below. Patterns starting with
+	// ~ are regular expressions matched against host, path and query, e.g.
+	// "~youtube\.com/watch\?v=". Patterns starting with ! are exceptions,
+	// allowing what broader rules of the same list would match.
+	Rule struct {
+		ID      string
+		Pattern string
+		Action  string
+		Source  string
+		Scheme  string // empty when the rule matches any scheme
+		Domain  string // empty for regular expressions
+		Path    string // empty when the rule matches any path
+		Regexp  *regexp.Regexp
+
+		hits    atomic.Int64
+		lastHit atomic.Int64 // unix nanoseconds, zero until the first hit
+	}
+
+	// Target is what rules are matched against. Path and RawQuery are empty
+	// for CONNECT requests, whose path is hidden in the tunnel, so that only
+	// host rules apply to them.
+	Target struct {
+		Scheme   string
+		Host     string
+		Path     string
+		RawQuery string
+	}
+
+	// Blocklist matches hosts against a list of domains
+	Blocklist struct {
+		action string
+
+		mu    sync.RWMutex
+		rules []*Rule
+	}
+)
+
+// NewRule creates a rule whose ID is derived from its action and pattern,
+// so it stays the same across restarts and reloads. Invalid patterns, which
+// CheckPattern reports, yield rules that never match.
+func NewRule(action, source, pattern string) *Rule {
+	pattern = strings.TrimSpace(pattern)
+	if strings.HasPrefix(pattern, "!") {
+		action, pattern = ActionAllow, strings.TrimSpace(pattern[1:])
+	}
+	rule := &Rule{Action: action, Source: source}
+	if strings.HasPrefix(pattern, "~") {
+		rule.Pattern = pattern
+		rule.Regexp, _ = regexp.Compile(pattern[1:])
+	} else {
+		scheme, rest, ok := strings.Cut(pattern, "://")
+		if !ok {
+			scheme, rest = "", pattern
+		}
+		host, rulePath, _ := strings.Cut(rest, "/")
+		rule.Scheme = strings.ToLower(scheme)
+		rule.Domain = normalizeHost(host)
+		// host names are case insensitive, paths are not
+		if rulePath = strings.Trim(rulePath, "/"); rulePath != "" {
+			rule.Path = path.Clean("/" + rulePath)
+		}
+		rule.Pattern = rule.Domain + rule.Path
+		if rule.Scheme != "" {
+			rule.Pattern = rule.Scheme + "://" + rule.Pattern
+		}
+	}
+	sum := sha256.Sum256([]byte(action + " " + rule.Pattern))
+	rule.ID = hex.EncodeToString(sum[:6])
+	return rule
+}
+
+// CheckPattern reports why pattern cannot be used as a rule
+func CheckPattern(pattern string) error {
+	pattern = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(pattern), "!"))
+	if strings.HasPrefix(pattern, "~") {
+		if _, err := regexp.Compile(pattern[1:]); err != nil {
+			return fmt.Errorf("rule %q: %w", pattern, err)
+		}
+		return nil
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("rule %q: missing domain", pattern)
+	}
+	return nil
+}
+
+// checkPatterns returns the error of the first invalid pattern
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if err := CheckPattern(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestTarget returns the target of a proxied request
+func RequestTarget(r *http.Request) Target {
+	if r.Method == http.MethodConnect {
+		return Target{Scheme: requestScheme(r), Host: normalizeHost(r.URL.Hostname())}
+	}
+	t := URLTarget(r.URL)
+	t.Scheme = requestScheme(r)
+	return t
+}
+
+// URLTarget returns the target of u, its path cleaned so that "/a/../b" and
+// "//b" cannot bypass a rule for "/b"
+func URLTarget(u *url.URL) Target {
+	t := Target{Scheme: u.Scheme, Host: normalizeHost(u.Hostname()), RawQuery: u.RawQuery}
+	t.Path = "/"
+	if u.Path != "" {
+		t.Path = path.Clean("/" + u.Path)
+	}
+	return t
+}
+
+// String returns host, path and query, which regular expressions are matched against
+func (t Target) String() string {
+	s := t.Host + t.Path
+	if t.RawQuery != "" {
+		s += "?" + t.RawQuery
+	}
+	return s
+}
+
+// normalizeHost lowercases host and strips the brackets of IPv6 literals, so
+// that rules and requests compare equal. IP addresses are written in their
+// canonical form, so that "0:0::1" cannot bypass a rule for "::1".
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.Trim(host, "."))
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// matches reports whether the rule applies to t
+func (r *Rule) matches(t Target) bool {
+	if r.Scheme != "" && r.Scheme != t.Scheme {
+		return false
+	}
+	if r.Domain == "" {
+		return r.Regexp != nil && r.Regexp.MatchString(t.String())
+	}
+	if t.Host != r.Domain && !strings.HasSuffix(t.Host, "."+r.Domain) {
+		return false
+	}
+	return r.Path == "" || t.Path == r.Path || strings.HasPrefix(t.Path, r.Path+"/")
+}
+
+// specificity ranks rules matching the same target, the longest pattern being the most specific
+func (r *Rule) specificity() int {
+	if r.Domain == "" {
+		return len(r.Pattern) - 1
+	}
+	return len(r.Domain) + len(r.Path)
+}
+
+// overrides reports whether r wins over other when both match the same target
+func (r *Rule) overrides(other *Rule) bool {
+	if r.specificity() != other.specificity() {
+		return r.specificity() > other.specificity()
+	}
+	if (r.Action == ActionAllow) != (other.Action == ActionAllow) {
+		return r.Action == ActionAllow
+	}
+	return r.Scheme != "" && other.Scheme == ""
+}
+
+// Hit records a match of the rule at the given time
+func (r *Rule) Hit(at time.Time) {
+	r.hits.Add(1)
+	r.lastHit.Store(at.UnixNano())
+}
+
+// restore sets the statistics saved by a previous run
+func (r *Rule) restore(hits int64, lastHit time.Time) {
+	r.hits.Store(hits)
+	if !lastHit.IsZero() {
+		r.lastHit.Store(lastHit.UnixNano())
+	}
+}
+
+func (r *Rule) Hits() int64 {
+	return r.hits.Load()
+}
+
+// LastHit returns when the rule last matched, or the zero time if it never did
+func (r *Rule) LastHit() time.Time {
+	ns := r.lastHit.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func NewBlocklist(action, source string, domains []string) *Blocklist {
+	b := &Blocklist{action: action}
+	for _, d := range domains {
+		b.rules = append(b.rules, NewRule(action, source, d))
+	}
+	return b
+}
+
+// Replace swaps the rules coming from source for the given domains, keeping
+// the statistics of rules which did not change
+func (b *Blocklist) Replace(source string, domains []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := make(map[string]*Rule)
+	var rules []*Rule
+	for _, r := range b.rules {
+		if r.Source == source {
+			previous[r.ID] = r
+		} else {
+			rules = append(rules, r)
+		}
+	}
+	for _, d := range domains {
+		r := NewRule(b.action, source, d)
+		if prev, ok := previous[r.ID]; ok {
+			r = prev
+		}
+		rules = append(rules, r)
+	}
+	b.rules = rules
+}
+
+// inherit takes over the rules of prev which did not change, along with
+// their statistics, while b is not shared yet
+func (b *Blocklist) inherit(prev *Blocklist) {
+	if prev == nil {
+		return
+	}
+	previous := make(map[string]*Rule)
+	for _, r := range prev.Rules() {
+		previous[r.Source+" "+r.ID] = r
+	}
+	for i, r := range b.rules {
+		if prev, ok := previous[r.Source+" "+r.ID]; ok {
+			b.rules[i] = prev
+		}
+	}
+}
+
+// Match returns the rule matching t, or nil. The longest match wins, an
+// exception wins over a rule of the same length, then a rule for this
+// specific scheme wins over a scheme-less one. An exception winning yields
+// nil.
+func (b *Blocklist) Match(t Target) *Rule {
+	rule, _ := b.Lookup(t)
+	return rule
+}
+
+// Lookup returns the rule matching t like Match does, along with the
+// exception which won instead, if any. Neither counts as a hit of the rule,
+// as dry runs look rules up too.
+func (b *Blocklist) Lookup(t Target) (rule, exception *Rule) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var match *Rule
+	for _, r := range b.rules {
+		if r.matches(t) && (match == nil || r.overrides(match)) {
+			match = r
+		}
+	}
+	if match != nil && match.Action == ActionAllow {
+		return nil, match
+	}
+	return match, nil
+}
+
+// LookupURL looks rawURL up like Lookup, ignoring unparsable values
+func (b *Blocklist) LookupURL(rawURL string) (rule, exception *Rule) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, nil
+	}
+	return b.Lookup(URLTarget(u))
+}
+
+// Rules returns the rules of the list
+func (b *Blocklist) Rules() []*Rule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]*Rule(nil), b.rules...)
+}
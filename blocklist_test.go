@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+// proxyRequest returns the request a proxy receives for target, the host and
+// port alone for CONNECT
+func proxyRequest(t *testing.T, method, target string) *http.Request {
+	t.Helper()
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: x\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"News.Test":              "news.test",
+		"news.test.":             "news.test",
+		"[::1]":                  "::1",
+		"[0:0::1]":               "::1",
+		"2001:DB8:0:0::1":        "2001:db8::1",
+		"[2001:db8::1]":          "2001:db8::1",
+		"127.0.0.1":              "127.0.0.1",
+		"[::ffff:127.0.0.1]":     "127.0.0.1",
+		"xn--bcher-kva.example.": "xn--bcher-kva.example",
+	}
+	for host, want := range tests {
+		if got := normalizeHost(host); got != want {
+			t.Errorf("%q: got %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestIPv6Targets(t *testing.T) {
+	b := NewBlocklist(ActionBlock, SourceEnv, []string{"[::1]", "[2001:db8::1]/admin", "[2001:db8::2]/"})
+	tests := []struct {
+		method, target string
+		want           string // pattern of the matching rule, empty if none
+	}{
+		{http.MethodGet, "http://[::1]/", "::1"},
+		{http.MethodGet, "http://[0:0::1]:8080/page", "::1"},
+		{http.MethodConnect, "[::1]:443", "::1"},
+		{http.MethodGet, "http://[2001:db8::1]/admin/users", "2001:db8::1/admin"},
+		{http.MethodGet, "http://[2001:db8::1]/", ""},
+		{http.MethodConnect, "[2001:DB8::2]:443", "2001:db8::2"},
+		{http.MethodGet, "http://[::2]/", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := b.Match(RequestTarget(proxyRequest(t, tt.method, tt.target))); rule != nil {
+			got = rule.Pattern
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestBlockIPv6Literal(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"::1"}
+	proxy, _ := startProxy(t, cfg)
+
+	for url, want := range map[string]int{
+		"http://[0:0::1]:8080/": http.StatusForbidden,
+		"http://[::2]/":         http.StatusOK,
+	} {
+		if resp, _ := get(t, proxy.Client, url); resp.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", url, resp.StatusCode, want)
+		}
+	}
+	if got := upstream.Requests(); len(got) != 1 || got[0].Host != "[::2]" {
+		t.Errorf("upstream got %+v, want the request to [::2]", got)
+	}
+}
+
+func TestPathAndQueryRules(t *testing.T) {
+	b := NewBlocklist(ActionBlock, SourceEnv, []string{
+		"video.test/shorts",
+		`~video\.test/watch\?v=`,
+		"news.test",
+		"!news.test/docs/",
+		"https://mail.test/inbox",
+	})
+	tests := []struct {
+		method, target string
+		want           string // pattern of the matching rule, empty if none
+	}{
+		{http.MethodGet, "http://video.test/shorts", "video.test/shorts"},
+		{http.MethodGet, "http://video.test/shorts/abc", "video.test/shorts"},
+		{http.MethodGet, "http://www.video.test/shorts/", "video.test/shorts"},
+		{http.MethodGet, "http://video.test/shortsabc", ""},
+		{http.MethodGet, "http://video.test/Shorts", ""},
+		// the path is cleaned before matching
+		{http.MethodGet, "http://video.test/a/../shorts", "video.test/shorts"},
+		{http.MethodGet, "http://video.test//shorts", "video.test/shorts"},
+		{http.MethodGet, "http://video.test/watch?v=1", `~video\.test/watch\?v=`},
+		{http.MethodGet, "http://video.test/watch?list=1", ""},
+		{http.MethodGet, "http://news.test/docs/intro", ""},
+		{http.MethodGet, "http://news.test/docsx", "news.test"},
+		{http.MethodGet, "https://mail.test/inbox/1", "https://mail.test/inbox"},
+		{http.MethodGet, "http://mail.test/inbox/1", ""},
+		// tunnels only reveal their host, which path rules cannot match
+		{http.MethodConnect, "video.test:443", ""},
+		{http.MethodConnect, "news.test:443", "news.test"},
+		{http.MethodConnect, "mail.test:443", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := b.Match(RequestTarget(proxyRequest(t, tt.method, tt.target))); rule != nil {
+			got = rule.Pattern
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	for pattern, ok := range map[string]bool{
+		"news.test":        true,
+		"!news.test/docs":  true,
+		`~news\.test/a`:    true,
+		"http://news.test": true,
+		"~news(":           false,
+		"/shorts":          false,
+		"!":                false,
+		"":                 false,
+	} {
+		if err := CheckPattern(pattern); (err == nil) != ok {
+			t.Errorf("%q: got %v, want ok %t", pattern, err, ok)
+		}
+	}
+}
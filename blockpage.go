@@ -0,0 +1,28 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var blockedTemplate = template.Must(template.ParseFS(templatesFS, "templates/blocked.html"))
+
+type blockedPage struct {
+	Locale
+	Host          string
+	Rule          string
+	BudgetEnabled bool
+	TokensLeft    int
+	CooldownUntil string // end of the cooldown of the client, if in one
+}
+
+// serveBlocked responds to a blocked request with the block page
+func serveBlocked(w http.ResponseWriter, r *http.Request, status int, page blockedPage) {
+	markLocalResponse(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	if err := blockedTemplate.Execute(w, page); err != nil {
+		proxyLog.WithField("event", "render block page").Warn(err)
+	}
+}
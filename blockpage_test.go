@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlockStatusCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{"default", 0, http.StatusForbidden},
+		{"unavailable for legal reasons", http.StatusUnavailableForLegalReasons, http.StatusUnavailableForLegalReasons},
+		{"not found", http.StatusNotFound, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			cfg.Blocklist = []string{"news.test"}
+			if tt.status != 0 {
+				cfg.BlockStatusCode = tt.status
+			}
+			proxy, _ := startProxy(t, cfg)
+
+			resp, body := get(t, proxy.Client, "http://news.test/")
+			if resp.StatusCode != tt.want || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(body, "news.test") {
+				t.Errorf("got %d %s %q, want the block page with %d", resp.StatusCode, resp.Header.Get("Content-Type"), body, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidBlockStatusCode(t *testing.T) {
+	for _, value := range []string{"200", "302", "399", "600", "499", "abc"} {
+		t.Setenv("BLOCK_STATUS_CODE", value)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("BLOCK_STATUS_CODE=%s: got no error", value)
+		}
+	}
+}
+
+func TestBlockPageLanguage(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	for accept, want := range map[string]string{
+		"de;q=0.5, fr": "news.test est bloqué",
+		"de-AT":        "news.test ist gesperrt",
+		"es":           "news.test is blocked",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+		req.Header.Set("Accept-Language", accept)
+		resp, err := proxy.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), want) {
+			t.Errorf("%s: got %q, want %q", accept, body, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/report"
+)
+
+type (
+	// SiteBudget lets a limited number of distinct blocked domains through each day.
+	// The first visit to a blocked domain consumes a token and exempts that domain
+	// until local midnight; once tokens are spent every other blocked domain is denied.
+	//
+	// The budget only relaxes blocklist and schedule rules: maintenance and bypassed
+	// hosts are decided before it, and hosts which are not blocked never consume tokens.
+	SiteBudget struct {
+		limit int
+		now   func() time.Time
+
+		mu     sync.Mutex
+		date   string
+		exempt map[string]bool
+	}
+
+	// BudgetState is the budget of a day, as saved to the state file and shown in /admin/stats
+	BudgetState struct {
+		Date      string   `json:"date"`
+		Exempt    []string `json:"exempt"`
+		Remaining int      `json:"remaining"`
+	}
+)
+
+// NewSiteBudget creates a budget of limit domains a day, disabled when limit is zero or less
+func NewSiteBudget(limit int) *SiteBudget {
+	return &SiteBudget{
+		limit:  limit,
+		now:    time.Now,
+		exempt: make(map[string]bool),
+	}
+}
+
+func (b *SiteBudget) Enabled() bool {
+	return b.limit > 0
+}
+
+// Allow reports whether the blocked domain may be visited, consuming a token on its first visit today
+func (b *SiteBudget) Allow(domain string) bool {
+	if !b.Enabled() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	if b.exempt[domain] {
+		return true
+	}
+	if len(b.exempt) >= b.limit {
+		return false
+	}
+	b.exempt[domain] = true
+	return true
+}
+
+// Remaining returns the tokens left today
+func (b *SiteBudget) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	return b.remaining()
+}
+
+func (b *SiteBudget) State() BudgetState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	state := BudgetState{Date: b.date, Exempt: []string{}, Remaining: b.remaining()}
+	for domain := range b.exempt {
+		state.Exempt = append(state.Exempt, domain)
+	}
+	sort.Strings(state.Exempt)
+	return state
+}
+
+// Restore reloads a saved state, which is ignored unless it is from today
+func (b *SiteBudget) Restore(state BudgetState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	if state.Date != b.date {
+		return
+	}
+	for _, domain := range state.Exempt {
+		b.exempt[domain] = true
+	}
+}
+
+// rollover resets the budget at local midnight, must be called with mu held
+func (b *SiteBudget) rollover() {
+	if date := b.now().Format(report.DateLayout); date != b.date {
+		b.date = date
+		b.exempt = make(map[string]bool)
+	}
+}
+
+// remaining must be called with mu held
+func (b *SiteBudget) remaining() int {
+	if n := b.limit - len(b.exempt); n > 0 {
+		return n
+	}
+	return 0
+}
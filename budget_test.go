@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestSiteBudget(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 22, 0, 0, 0, time.Local))
+	b := NewSiteBudget(2)
+	b.now = clock.Now
+
+	for _, step := range []struct {
+		domain string
+		want   bool
+	}{
+		{"news.test", true},
+		{"news.test", true},
+		{"video.test", true},
+		{"chat.test", false},
+		{"news.test", true},
+	} {
+		if got := b.Allow(step.domain); got != step.want {
+			t.Errorf("%s: got %t, want %t", step.domain, got, step.want)
+		}
+	}
+	want := BudgetState{Date: "2024-03-04", Exempt: []string{"news.test", "video.test"}, Remaining: 0}
+	if got := b.State(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// the tokens come back at midnight, along with the domains they exempted
+	clock.Advance(2 * time.Hour)
+	if b.Remaining() != 2 {
+		t.Errorf("got %d tokens after midnight, want 2", b.Remaining())
+	}
+	if !b.Allow("chat.test") || b.Remaining() != 1 {
+		t.Errorf("chat.test not allowed with a fresh budget")
+	}
+}
+
+func TestSiteBudgetRestore(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.Local))
+	b := NewSiteBudget(3)
+	b.now = clock.Now
+	b.Restore(BudgetState{Date: "2024-03-03", Exempt: []string{"old.test"}})
+	b.Restore(BudgetState{Date: "2024-03-04", Exempt: []string{"news.test"}})
+	if got := b.State().Exempt; !reflect.DeepEqual(got, []string{"news.test"}) {
+		t.Errorf("got %v, want only the domains of today", got)
+	}
+}
+
+func TestSiteBudgetDisabled(t *testing.T) {
+	if b := NewSiteBudget(0); b.Enabled() || b.Allow("news.test") {
+		t.Error("a zero budget lets domains through")
+	}
+}
+
+func TestSiteBudgetLetsBlockedDomainsThrough(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test", "video.test"}
+	cfg.DistinctSiteBudget = 1
+	proxy, _ := startProxy(t, cfg)
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"http://www.news.test/", http.StatusOK},
+		{"http://news.test/", http.StatusOK},
+		{"http://video.test/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if resp, _ := get(t, proxy.Client, tt.url); resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.url, resp.StatusCode, tt.want)
+		}
+	}
+}
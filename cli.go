@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/report"
+)
+
+// runReport implements "procrastiproxy report", printing a report straight from the state file
+func runReport(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	defaultFrom, defaultTo := report.LastWeek(time.Now())
+	from := flags.String("from", defaultFrom.Format(report.DateLayout), "first day of the report")
+	to := flags.String("to", defaultTo.Format(report.DateLayout), "last day of the report")
+	statePath := flags.String("state", os.Getenv("STATE_FILE"), "state file to read")
+	html := flags.Bool("html", false, "render the report as HTML")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *statePath == "" {
+		fmt.Fprintln(os.Stderr, "report: no state file, set STATE_FILE or --state")
+		return 2
+	}
+
+	fromDate, err := time.ParseInLocation(report.DateLayout, *from, time.Local)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "report: invalid --from:", err)
+		return 2
+	}
+	toDate, err := time.ParseInLocation(report.DateLayout, *to, time.Local)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "report: invalid --to:", err)
+		return 2
+	}
+	state, err := readState(*statePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "report:", err)
+		return 1
+	}
+
+	r := report.Build(state.Daily, fromDate, toDate)
+	if *html {
+		err = report.RenderHTML(os.Stdout, r)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "report:", err)
+		return 1
+	}
+	return 0
+}
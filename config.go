@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/i18n"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the proxy settings, read from environment variables and the
+// config file
+type Config struct {
+	Port string `env:"PORT"`
+	// Listeners are the addresses served, defaulting to every role on Port
+	// of localhost
+	Listeners []ListenerConfig `env:"LISTENERS"`
+	// ShutdownTimeout bounds how long in-flight requests may take on shutdown
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	// DrainDelay is how long readyz reports not ready before shutting down
+	DrainDelay time.Duration `env:"DRAIN_DELAY"`
+	// Blocklist is the list of domains the proxy refuses to fetch
+	Blocklist []string `env:"BLOCKLIST"`
+	// BlocklistFile lists more blocked domains, reloaded whenever it changes
+	BlocklistFile string `env:"BLOCKLIST_FILE"`
+	// ProxyUsers are the name:password credentials required from clients when set
+	ProxyUsers []string `env:"PROXY_USERS" secret:"true"`
+	// UserBlocklistDir holds <user>.txt blocklists replacing the default one for these users
+	UserBlocklistDir string `env:"USER_BLOCKLIST_DIR"`
+	// UserBlocklists are the blocklists of the users of the config file, by user
+	UserBlocklists map[string][]string
+	// UpgradeHosts are redirected from http to https instead of being proxied
+	UpgradeHosts []string `env:"UPGRADE_HOSTS"`
+	// BlockLogSampleRate logs only one in every N blocked requests
+	BlockLogSampleRate int `env:"BLOCK_LOG_SAMPLE_RATE"`
+	// BlockStatusCode is the status of blocked responses, a 4xx or 5xx
+	BlockStatusCode int `env:"BLOCK_STATUS_CODE"`
+	// DistinctSiteBudget is the number of distinct blocked domains which may be visited each day
+	DistinctSiteBudget int `env:"DISTINCT_SITE_BUDGET"`
+	// CooldownThreshold blocks tarpitted hosts as well for CooldownDuration to
+	// clients blocked more than this many times within CooldownWindow, zero disabling it
+	CooldownThreshold int           `env:"COOLDOWN_THRESHOLD"`
+	CooldownWindow    time.Duration `env:"COOLDOWN_WINDOW"`
+	CooldownDuration  time.Duration `env:"COOLDOWN_DURATION"`
+	// ExemptionSecret signs the exemption tokens, the previous secrets still
+	// verifying them. Without a secret, the key is read from ExemptionKeyFile,
+	// created on first use, or generated at each start. ExemptionSkew is
+	// how long tokens are accepted past their expiry.
+	ExemptionSecret          string        `env:"EXEMPTION_SECRET" secret:"true"`
+	ExemptionPreviousSecrets []string      `env:"EXEMPTION_PREVIOUS_SECRETS" secret:"true"`
+	ExemptionKeyFile         string        `env:"EXEMPTION_KEY_FILE"`
+	ExemptionSkew            time.Duration `env:"EXEMPTION_SKEW"`
+	// ScheduleFile is a YAML or JSON file of named schedules blocking domains at given times
+	ScheduleFile string `env:"SCHEDULE_FILE"`
+	// DecisionOrder lists the stages deciding on requests in order, among
+	// bypass, blocklist, schedule, referer and tarpit, the ones left out being skipped
+	DecisionOrder []string `env:"DECISION_ORDER"`
+	// BypassHosts are proxied without any rule applied and without being logged
+	BypassHosts []string `env:"BYPASS_HOSTS"`
+	// StripRequestHeaders are removed from requests before forwarding them upstream
+	StripRequestHeaders []string `env:"STRIP_REQUEST_HEADERS"`
+	// TarpitHosts are slowed down by a delay that ramps up over a browsing session
+	TarpitHosts []string `env:"TARPIT_HOSTS"`
+	// TarpitMaxDelay is the delay reached after TarpitRampLength of continuous browsing
+	TarpitMaxDelay   time.Duration `env:"TARPIT_MAX_DELAY"`
+	TarpitRampLength time.Duration `env:"TARPIT_RAMP_LENGTH"`
+	// TarpitIdleGap is the inactivity after which a session starts over
+	TarpitIdleGap time.Duration `env:"TARPIT_IDLE_GAP"`
+	// StateFile persists the daily statistics across restarts when set
+	StateFile string `env:"STATE_FILE"`
+	// UsageMaxHosts bounds the number of hosts kept in the usage report
+	UsageMaxHosts int `env:"USAGE_MAX_HOSTS"`
+	// UsageFile persists the usage report across restarts when set
+	UsageFile string `env:"USAGE_FILE"`
+	// SlowRequestThreshold logs a warning for requests taking longer, zero disabling it
+	SlowRequestThreshold time.Duration `env:"SLOW_REQUEST_THRESHOLD"`
+	// NoLogPaths are paths such as /readyz and hosts left out of the access log
+	NoLogPaths []string `env:"NO_LOG_PATHS"`
+	// AccessLogFormat is json, logging requests with the application logs, or combined
+	AccessLogFormat string `env:"ACCESS_LOG_FORMAT"`
+	// AccessLogFile receives the combined access log, stdout when empty
+	AccessLogFile string `env:"ACCESS_LOG_FILE"`
+	// AllowUpstreamOverride lets clients pick the upstream origin with the
+	// X-Upstream-Override header, for test environments only
+	AllowUpstreamOverride bool `env:"ALLOW_UPSTREAM_OVERRIDE"`
+	// UpstreamCredentialsFile is a YAML or JSON file of credentials added to the requests of some upstreams
+	UpstreamCredentialsFile string `env:"UPSTREAM_CREDENTIALS_FILE"`
+	// DefaultScheme is given to proxied targets without a scheme, http or https
+	DefaultScheme string `env:"DEFAULT_SCHEME"`
+	// HTTPSOnlyUpstreams refuses to fetch plain http targets
+	HTTPSOnlyUpstreams bool `env:"HTTPS_ONLY_UPSTREAMS"`
+	// HTTPSOnlyTryUpgrade fetches plain http targets over https before refusing them
+	HTTPSOnlyTryUpgrade bool `env:"HTTPS_ONLY_TRY_UPGRADE"`
+	// MaxURLLength refuses proxied requests with longer targets, zero meaning unlimited
+	MaxURLLength int `env:"MAX_URL_LENGTH"`
+	// UpstreamTimeout bounds fetching a response from the upstream
+	UpstreamTimeout time.Duration `env:"UPSTREAM_TIMEOUT"`
+	// MemoryShedThreshold refuses proxy requests with a 503 while the memory
+	// in use exceeds this many bytes, checked every MemoryCheckInterval, zero disabling it
+	MemoryShedThreshold int           `env:"MEMORY_SHED_THRESHOLD"`
+	MemoryCheckInterval time.Duration `env:"MEMORY_CHECK_INTERVAL"`
+	// UpstreamConnMaxAge closes the upstream connections dialed longer ago
+	// once they carry no request, zero disabling it
+	UpstreamConnMaxAge time.Duration `env:"UPSTREAM_CONN_MAX_AGE"`
+	// NoKeepAliveHosts are upstreams whose connections are closed after each request
+	NoKeepAliveHosts []string `env:"NO_KEEPALIVE_HOSTS"`
+	// RelayBufferBytes of bodies of known length are read before relaying the
+	// response, so that a body found shorter is answered with a 502 instead
+	RelayBufferBytes int64 `env:"RELAY_BUFFER_BYTES"`
+	// ResponseHooks may veto upstream responses, registered by embedders
+	ResponseHooks []ResponseHook
+	// MaxStreams bounds the responses and CONNECT tunnels relayed at once,
+	// zero meaning unlimited
+	MaxStreams int `env:"MAX_STREAMS"`
+	// StreamMaxLifetime cuts responses and tunnels relayed for longer, zero
+	// disabling it
+	StreamMaxLifetime time.Duration `env:"STREAM_MAX_LIFETIME"`
+	// IPPreference is the address family dialed first: auto, ipv4 or ipv6
+	IPPreference string `env:"IP_PREFERENCE"`
+	// DialFallbackDelay is how long the auto preference waits before racing the other family
+	DialFallbackDelay time.Duration `env:"DIAL_FALLBACK_DELAY"`
+	// MaxResponseHeaderBytes, MaxResponseHeaders and MaxResponseHeaderValueBytes
+	// limit upstream response headers, zero meaning unlimited
+	MaxResponseHeaderBytes      int64 `env:"MAX_RESPONSE_HEADER_BYTES"`
+	MaxResponseHeaders          int   `env:"MAX_RESPONSE_HEADERS"`
+	MaxResponseHeaderValueBytes int   `env:"MAX_RESPONSE_HEADER_VALUE_BYTES"`
+	// Features are the initial values of the feature flags, which the admin
+	// endpoint can toggle at runtime. BLOCK_BY_REFERER also checks the Referer
+	// header against the blocklist, the others are FEATURE_<NAME> and on by default.
+	Features map[string]bool
+	// EnableFaults injects the failures of FaultsFile into proxied requests,
+	// the randomness coming from FaultsSeed or the clock when it is zero
+	EnableFaults bool   `env:"ENABLE_FAULTS"`
+	FaultsFile   string `env:"FAULTS_FILE"`
+	FaultsSeed   int64  `env:"FAULTS_SEED"`
+	// ContentSecurityPolicy and ReferrerPolicy are set on the pages served by
+	// the proxy itself, such as block pages, an empty value leaving the header out
+	ContentSecurityPolicy string `env:"CONTENT_SECURITY_POLICY"`
+	ReferrerPolicy        string `env:"REFERRER_POLICY"`
+	// ScoreWeight* weigh the components of the productivity score of /score
+	ScoreWeightBlocked float64 `env:"SCORE_WEIGHT_BLOCKED"`
+	ScoreWeightFocus   float64 `env:"SCORE_WEIGHT_FOCUS"`
+	ScoreWeightAllowed float64 `env:"SCORE_WEIGHT_ALLOWED"`
+	// TranslationsDir holds <lang>.json files of messages adding to or
+	// overriding the bundled translations of the pages served by the proxy
+	TranslationsDir string `env:"TRANSLATIONS_DIR"`
+	// DefaultLanguage is used for clients accepting none of the translations
+	DefaultLanguage string `env:"DEFAULT_LANGUAGE"`
+	// ErrorPageTemplate overrides the embedded page served on upstream failures,
+	// which can use .Lang and the .T method of Locale
+	ErrorPageTemplate string `env:"ERROR_PAGE_TEMPLATE"`
+	// LogConfig logs the effective configuration at startup
+	LogConfig bool `env:"LOG_CONFIG"`
+	// AdminToken guards the admin endpoints, given as a bearer token. It is
+	// required to serve them on a listener serving the proxy as well.
+	AdminToken string `env:"ADMIN_TOKEN" secret:"true"`
+	// PACProxy is the host:port the PAC file sends clients to, by default the
+	// host the PAC file is fetched from with the port of the proxy listener
+	PACProxy string `env:"PAC_PROXY"`
+	// StatusAPIToken guards /api/status when set, given as a bearer token
+	StatusAPIToken string `env:"STATUS_API_TOKEN" secret:"true"`
+	// StatusAPIOrigins are the origins allowed to read /api/status, * for any
+	StatusAPIOrigins []string `env:"STATUS_API_ORIGINS"`
+
+	sources map[string]string // where each field comes from, by name
+	users   Users             // parsed from ProxyUsers
+	// now is the clock of every time-dependent part, time.Now unless set by tests
+	now func() time.Time
+	// transport adjusts the upstream transport when set, e.g. for tests to
+	// dial a fake upstream whatever the host
+	transport func(*http.Transport)
+}
+
+// features are the feature flags with the variable and default of their initial value
+var features = []struct {
+	name, env string
+	def       bool
+}{
+	{FlagAccessLog, "FEATURE_ACCESS_LOG", true},
+	{FlagBlockByReferer, "BLOCK_BY_REFERER", false},
+	{FlagSiteBudget, "FEATURE_SITE_BUDGET", true},
+	{FlagTarpit, "FEATURE_TARPIT", true},
+}
+
+// LoadConfig builds a Config from the environment and CONFIG_FILE, the
+// variables overriding the values of the file
+func LoadConfig() (*Config, error) {
+	v := configVars{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, blocklists, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		v.file, v.userBlocklists = file, blocklists
+	}
+	if err := checkEnv(); err != nil {
+		return nil, err
+	}
+	cfg := &Config{
+		Port:                        v.get("PORT"),
+		ShutdownTimeout:             v.duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		DrainDelay:                  v.duration("DRAIN_DELAY", 0),
+		Blocklist:                   v.list("BLOCKLIST"),
+		BlocklistFile:               v.get("BLOCKLIST_FILE"),
+		ProxyUsers:                  v.list("PROXY_USERS"),
+		UserBlocklistDir:            v.get("USER_BLOCKLIST_DIR"),
+		UpgradeHosts:                v.list("UPGRADE_HOSTS"),
+		BlockLogSampleRate:          v.int("BLOCK_LOG_SAMPLE_RATE", 1),
+		BlockStatusCode:             v.int("BLOCK_STATUS_CODE", http.StatusForbidden),
+		DistinctSiteBudget:          v.int("DISTINCT_SITE_BUDGET", 0),
+		CooldownThreshold:           v.int("COOLDOWN_THRESHOLD", 0),
+		CooldownWindow:              v.duration("COOLDOWN_WINDOW", 10*time.Minute),
+		CooldownDuration:            v.duration("COOLDOWN_DURATION", 30*time.Minute),
+		ExemptionSecret:             v.get("EXEMPTION_SECRET"),
+		ExemptionPreviousSecrets:    v.list("EXEMPTION_PREVIOUS_SECRETS"),
+		ExemptionKeyFile:            v.get("EXEMPTION_KEY_FILE"),
+		ExemptionSkew:               v.duration("EXEMPTION_SKEW", 30*time.Second),
+		ScheduleFile:                v.get("SCHEDULE_FILE"),
+		DecisionOrder:               v.list("DECISION_ORDER"),
+		BypassHosts:                 v.list("BYPASS_HOSTS"),
+		StripRequestHeaders:         v.list("STRIP_REQUEST_HEADERS"),
+		TarpitHosts:                 v.list("TARPIT_HOSTS"),
+		TarpitMaxDelay:              v.duration("TARPIT_MAX_DELAY", 15*time.Second),
+		TarpitRampLength:            v.duration("TARPIT_RAMP_LENGTH", 20*time.Minute),
+		TarpitIdleGap:               v.duration("TARPIT_IDLE_GAP", 5*time.Minute),
+		StateFile:                   v.get("STATE_FILE"),
+		UsageMaxHosts:               v.int("USAGE_MAX_HOSTS", 1000),
+		UsageFile:                   v.get("USAGE_FILE"),
+		SlowRequestThreshold:        v.duration("SLOW_REQUEST_THRESHOLD", 0),
+		NoLogPaths:                  v.list("NO_LOG_PATHS"),
+		AccessLogFormat:             strings.ToLower(v.get("ACCESS_LOG_FORMAT")),
+		AccessLogFile:               v.get("ACCESS_LOG_FILE"),
+		AllowUpstreamOverride:       v.bool("ALLOW_UPSTREAM_OVERRIDE", false),
+		UpstreamCredentialsFile:     v.get("UPSTREAM_CREDENTIALS_FILE"),
+		DefaultScheme:               v.string("DEFAULT_SCHEME", "http"),
+		HTTPSOnlyUpstreams:          v.bool("HTTPS_ONLY_UPSTREAMS", false),
+		HTTPSOnlyTryUpgrade:         v.bool("HTTPS_ONLY_TRY_UPGRADE", false),
+		MaxURLLength:                v.int("MAX_URL_LENGTH", 8192),
+		UpstreamTimeout:             v.duration("UPSTREAM_TIMEOUT", 30*time.Second),
+		RelayBufferBytes:            int64(v.int("RELAY_BUFFER_BYTES", 64<<10)),
+		MaxStreams:                  v.int("MAX_STREAMS", 0),
+		StreamMaxLifetime:           v.duration("STREAM_MAX_LIFETIME", 0),
+		IPPreference:                strings.ToLower(v.get("IP_PREFERENCE")),
+		DialFallbackDelay:           v.duration("DIAL_FALLBACK_DELAY", 300*time.Millisecond),
+		MaxResponseHeaderBytes:      int64(v.int("MAX_RESPONSE_HEADER_BYTES", 1<<20)),
+		MaxResponseHeaders:          v.int("MAX_RESPONSE_HEADERS", 256),
+		MaxResponseHeaderValueBytes: v.int("MAX_RESPONSE_HEADER_VALUE_BYTES", 64<<10),
+		NoKeepAliveHosts:            v.list("NO_KEEPALIVE_HOSTS"),
+		MemoryShedThreshold:         v.int("MEMORY_SHED_THRESHOLD", 0),
+		MemoryCheckInterval:         v.duration("MEMORY_CHECK_INTERVAL", time.Second),
+		UpstreamConnMaxAge:          v.duration("UPSTREAM_CONN_MAX_AGE", 0),
+		EnableFaults:                v.bool("ENABLE_FAULTS", false),
+		FaultsFile:                  v.get("FAULTS_FILE"),
+		FaultsSeed:                  int64(v.int("FAULTS_SEED", 0)),
+		ContentSecurityPolicy:       v.string("CONTENT_SECURITY_POLICY", "default-src 'none'; img-src 'self'; style-src 'self'; form-action 'self'; frame-ancestors 'none'"),
+		ReferrerPolicy:              v.string("REFERRER_POLICY", "no-referrer"),
+		LogConfig:                   v.bool("LOG_CONFIG", false),
+		ScoreWeightBlocked:          v.float("SCORE_WEIGHT_BLOCKED", 1),
+		ScoreWeightFocus:            v.float("SCORE_WEIGHT_FOCUS", 1),
+		ScoreWeightAllowed:          v.float("SCORE_WEIGHT_ALLOWED", 1),
+		TranslationsDir:             v.get("TRANSLATIONS_DIR"),
+		DefaultLanguage:             v.string("DEFAULT_LANGUAGE", i18n.Fallback),
+		ErrorPageTemplate:           v.get("ERROR_PAGE_TEMPLATE"),
+		AdminToken:                  v.get("ADMIN_TOKEN"),
+		PACProxy:                    v.get("PAC_PROXY"),
+		StatusAPIToken:              v.get("STATUS_API_TOKEN"),
+		StatusAPIOrigins:            v.list("STATUS_API_ORIGINS"),
+		UserBlocklists:              v.userBlocklists,
+	}
+	cfg.Features = make(map[string]bool, len(features))
+	for _, f := range features {
+		cfg.Features[f.name] = v.bool(f.env, f.def)
+	}
+	if cfg.DecisionOrder == nil {
+		cfg.DecisionOrder = DefaultDecisionOrder
+	}
+	if _, err := NewStages(cfg.DecisionOrder); err != nil {
+		return nil, err
+	}
+	if cfg.Port == "" {
+		cfg.Port = "3000"
+	}
+	switch cfg.IPPreference {
+	case "":
+		cfg.IPPreference = IPPreferenceAuto
+	case IPPreferenceAuto, IPPreferenceIPv4, IPPreferenceIPv6:
+	default:
+		return nil, fmt.Errorf("invalid IP_PREFERENCE %q, expected auto, ipv4 or ipv6", cfg.IPPreference)
+	}
+
+	if w := cfg.scoreWeights(); w.Blocked < 0 || w.Focus < 0 || w.Allowed < 0 || w.Blocked+w.Focus+w.Allowed == 0 {
+		return nil, fmt.Errorf("invalid SCORE_WEIGHT_* %+v, expected weights of zero or more, not all zero", w)
+	}
+	if cfg.BlockStatusCode < 400 || cfg.BlockStatusCode > 599 || http.StatusText(cfg.BlockStatusCode) == "" {
+		return nil, fmt.Errorf("invalid BLOCK_STATUS_CODE %d, expected a known 4xx or 5xx status", cfg.BlockStatusCode)
+	}
+	users, err := ParseUsers(cfg.ProxyUsers)
+	if err != nil {
+		return nil, err
+	}
+	cfg.users = users
+	if cfg.UserBlocklistDir != "" && len(users) == 0 {
+		return nil, fmt.Errorf("USER_BLOCKLIST_DIR requires PROXY_USERS to identify the users")
+	}
+	for user := range cfg.UserBlocklists {
+		if _, ok := users[user]; !ok {
+			return nil, fmt.Errorf("the blocklist of user %q requires the user in PROXY_USERS", user)
+		}
+	}
+	if cfg.MemoryShedThreshold < 0 || (cfg.MemoryShedThreshold > 0 && cfg.MemoryCheckInterval <= 0) {
+		return nil, fmt.Errorf("invalid MEMORY_SHED_THRESHOLD %d or MEMORY_CHECK_INTERVAL %s, expected a positive threshold and interval", cfg.MemoryShedThreshold, cfg.MemoryCheckInterval)
+	}
+	if cfg.DefaultScheme != "http" && cfg.DefaultScheme != "https" {
+		return nil, fmt.Errorf("invalid DEFAULT_SCHEME %q, expected http or https", cfg.DefaultScheme)
+	}
+	switch cfg.AccessLogFormat {
+	case "":
+		cfg.AccessLogFormat = AccessLogJSON
+	case AccessLogJSON, AccessLogCombined:
+	default:
+		return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q, expected json or combined", cfg.AccessLogFormat)
+	}
+
+	spec := v.get("LISTENERS")
+	if spec == "" {
+		spec = strings.Join(Roles, "+") + "@localhost:" + cfg.Port
+	}
+	listeners, err := ParseListeners(spec)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Listeners = listeners
+	cfg.sources = configSources(cfg, v)
+	return cfg, nil
+}
+
+// clock returns the clock of the server
+func (cfg *Config) clock() func() time.Time {
+	if cfg.now != nil {
+		return cfg.now
+	}
+	return time.Now
+}
+
+func (cfg *Config) scoreWeights() ScoreWeights {
+	return ScoreWeights{Blocked: cfg.ScoreWeightBlocked, Focus: cfg.ScoreWeightFocus, Allowed: cfg.ScoreWeightAllowed}
+}
+
+// configVars looks the settings up in the environment, then in the config file
+type configVars struct {
+	file           map[string]string   // values of the config file, keyed by variable name
+	userBlocklists map[string][]string // of the users of the config file
+}
+
+// lookup returns the value of key and where it comes from
+func (v configVars) lookup(key string) (string, string, bool) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, SourceEnv, true
+	}
+	if value, ok := v.file[key]; ok {
+		return value, SourceFile, true
+	}
+	return "", SourceDefault, false
+}
+
+func (v configVars) get(key string) string {
+	value, _, _ := v.lookup(key)
+	return value
+}
+
+// list splits a comma-separated value, dropping empty items
+func (v configVars) list(key string) []string {
+	var items []string
+	for _, item := range strings.Split(v.get(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// string returns def only when the value is unset, so that it can be set empty
+func (v configVars) string(key, def string) string {
+	if value, _, ok := v.lookup(key); ok {
+		return value
+	}
+	return def
+}
+
+// bool parses a boolean value, falling back to def when unset or empty
+func (v configVars) bool(key string, def bool) bool {
+	b, err := strconv.ParseBool(v.get(key))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// int parses an integer value, falling back to def when unset or empty
+func (v configVars) int(key string, def int) int {
+	i, err := strconv.Atoi(v.get(key))
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// float parses a decimal value, falling back to def when unset or empty
+func (v configVars) float(key string, def float64) float64 {
+	f, err := strconv.ParseFloat(v.get(key), 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// duration parses a duration value such as "15s", falling back to def when unset or empty
+func (v configVars) duration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(v.get(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// checkEnv rejects the variables whose value is not of the type of their
+// setting, as loadConfigFile does for the config file, an empty value
+// counting as unset
+func checkEnv() error {
+	var invalid []string
+	for key, t := range configTypes() {
+		if value := os.Getenv(key); value != "" && !validValue(t, value) {
+			invalid = append(invalid, fmt.Sprintf("%s=%q", key, value))
+		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("invalid values %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// configTypes returns the type of every setting, keyed by variable name
+func configTypes() map[string]reflect.Type {
+	types := map[string]reflect.Type{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("env"); key != "" {
+			types[key] = t.Field(i).Type
+		}
+	}
+	for _, f := range features {
+		types[f.env] = reflect.TypeOf(f.def)
+	}
+	return types
+}
+
+// validValue reports whether value parses as a setting of type t
+func validValue(t reflect.Type, value string) bool {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		_, err := time.ParseDuration(value)
+		return err == nil
+	}
+	var err error
+	switch t.Kind() {
+	case reflect.Bool:
+		_, err = strconv.ParseBool(value)
+	case reflect.Int, reflect.Int64:
+		_, err = strconv.Atoi(value)
+	case reflect.Float64:
+		_, err = strconv.ParseFloat(value, 64)
+	}
+	return err == nil
+}
+
+// decodeFile reads the JSON file at path if its extension is .json, YAML
+// otherwise, into v, rejecting unknown fields
+func decodeFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(v)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file named name and points CONFIG_FILE at it
+func writeConfig(t *testing.T, name, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+const testConfigFile = `
+port: 9090
+blocklist: [news.test, video.test]
+upstream_timeout: 5s
+block_log_sample_rate: 4
+FEATURE_TARPIT: false
+`
+
+func TestLoadConfigFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": testConfigFile,
+		"config.json": `{"port": 9090, "blocklist": ["news.test", "video.test"], "upstream_timeout": "5s", "block_log_sample_rate": 4, "FEATURE_TARPIT": false}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeConfig(t, name, content)
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != "9090" || !reflect.DeepEqual(cfg.Blocklist, []string{"news.test", "video.test"}) || cfg.UpstreamTimeout != 5*time.Second || cfg.BlockLogSampleRate != 4 || cfg.Features[FlagTarpit] {
+				t.Errorf("got %+v, want the values of the file", cfg)
+			}
+			if got := cfg.source("UpstreamTimeout"); got != SourceFile {
+				t.Errorf("got UpstreamTimeout from %s, want %s", got, SourceFile)
+			}
+		})
+	}
+}
+
+const testNestedConfigFile = `
+port: 9090
+listeners:
+  - addr: :3128
+    roles: [proxy]
+  - addr: unix:/run/procrastiproxy.sock
+    roles: [admin, metrics]
+    tls: {cert: cert.pem, key: key.pem}
+rules:
+  blocklist: [news.test, video.test]
+users:
+  alice:
+    password: s3cret
+    blocklist: [chat.test]
+  bob:
+    password: hunter2
+upstream:
+  timeout: 5s
+features:
+  tarpit: false
+`
+
+func TestLoadNestedConfigFile(t *testing.T) {
+	writeConfig(t, "config.yaml", testNestedConfigFile)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ListenerConfig{
+		{Addr: ":3128", Roles: []string{RoleProxy}},
+		{Addr: "unix:/run/procrastiproxy.sock", Roles: []string{RoleAdmin, RoleMetrics}, CertFile: "cert.pem", KeyFile: "key.pem"},
+	}
+	if !reflect.DeepEqual(cfg.Listeners, want) {
+		t.Errorf("got listeners %+v, want %+v", cfg.Listeners, want)
+	}
+	if cfg.Port != "9090" || !reflect.DeepEqual(cfg.Blocklist, []string{"news.test", "video.test"}) || cfg.UpstreamTimeout != 5*time.Second || cfg.Features[FlagTarpit] {
+		t.Errorf("got %+v, want the values of the file", cfg)
+	}
+	if !reflect.DeepEqual(cfg.ProxyUsers, []string{"alice:s3cret", "bob:hunter2"}) || len(cfg.users) != 2 {
+		t.Errorf("got users %v, want alice and bob", cfg.ProxyUsers)
+	}
+	if !reflect.DeepEqual(cfg.UserBlocklists, map[string][]string{"alice": {"chat.test"}}) || cfg.source("UserBlocklists") != SourceFile {
+		t.Errorf("got user blocklists %v from %s, want the one of alice", cfg.UserBlocklists, cfg.source("UserBlocklists"))
+	}
+	for _, name := range []string{"Listeners", "UpstreamTimeout", "ProxyUsers", "Features." + FlagTarpit} {
+		if got := cfg.source(name); got != SourceFile {
+			t.Errorf("got %s from %s, want %s", name, got, SourceFile)
+		}
+	}
+	rules, err := NewRules(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := Target{Scheme: "http", Host: "chat.test", Path: "/"}
+	if rules.For("alice").Block.Match(chat) == nil || rules.For("bob").Block.Match(chat) != nil {
+		t.Error("got chat.test blocked for the wrong users, want it blocked for alice only")
+	}
+
+	// the variables override the sections too
+	t.Setenv("UPSTREAM_TIMEOUT", "7s")
+	t.Setenv("LISTENERS", "proxy@:8080")
+	if cfg, err := LoadConfig(); err != nil || cfg.UpstreamTimeout != 7*time.Second || len(cfg.Listeners) != 1 {
+		t.Errorf("got %v, %v, want the values of the environment", cfg, err)
+	}
+}
+
+func TestLoadFlatConfigListeners(t *testing.T) {
+	// the LISTENERS specification of the flat files
+	for _, content := range []string{`listeners: "proxy@:3128; admin@:8080"`, `LISTENERS: "proxy@:3128; admin@:8080"`, `{"listeners": [{"addr": ":3128", "roles": ["proxy"]}, {"addr": ":8080", "roles": ["admin"]}]}`} {
+		writeConfig(t, "config.yaml", content)
+		cfg, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", content, err)
+		}
+		if len(cfg.Listeners) != 2 || cfg.Listeners[1].Addr != ":8080" || cfg.Listeners[1].Roles[0] != RoleAdmin {
+			t.Errorf("%s: got %+v, want both listeners", content, cfg.Listeners)
+		}
+	}
+}
+
+func TestLoadConfigEnvOnly(t *testing.T) {
+	t.Setenv("BLOCKLIST", " news.test, ,video.test ")
+	t.Setenv("UPSTREAM_TIMEOUT", "5s")
+	t.Setenv("FEATURE_TARPIT", "false")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Blocklist, []string{"news.test", "video.test"}) || cfg.UpstreamTimeout != 5*time.Second || cfg.Features[FlagTarpit] {
+		t.Errorf("got %+v, want the values of the environment", cfg)
+	}
+	if cfg.BlockLogSampleRate != 1 || cfg.source("BlockLogSampleRate") != SourceDefault {
+		t.Errorf("got BlockLogSampleRate %d from %s, want the default", cfg.BlockLogSampleRate, cfg.source("BlockLogSampleRate"))
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	writeConfig(t, "config.yaml", testConfigFile)
+	t.Setenv("BLOCKLIST", "docs.test")
+	t.Setenv("FEATURE_TARPIT", "true")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Blocklist, []string{"docs.test"}) || !cfg.Features[FlagTarpit] {
+		t.Errorf("got %v and tarpit %t, want the values of the environment", cfg.Blocklist, cfg.Features[FlagTarpit])
+	}
+	if cfg.BlockLogSampleRate != 4 || cfg.source("BlockLogSampleRate") != SourceFile {
+		t.Errorf("got BlockLogSampleRate %d from %s, want 4 from the file", cfg.BlockLogSampleRate, cfg.source("BlockLogSampleRate"))
+	}
+	if cfg.UpstreamTimeout != 5*time.Second {
+		t.Errorf("got UpstreamTimeout %s, want the one of the file", cfg.UpstreamTimeout)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{
+			name: "invalid variables",
+			env:  map[string]string{"UPSTREAM_TIMEOUT": "soon", "BLOCK_LOG_SAMPLE_RATE": "many", "FEATURE_TARPIT": "maybe"},
+			want: `invalid values BLOCK_LOG_SAMPLE_RATE="many", FEATURE_TARPIT="maybe", UPSTREAM_TIMEOUT="soon"`,
+		},
+		{name: "unknown keys", file: "blocklist: [news.test]\nblocklsit: x\nzzz: 1\n", want: "unknown keys blocklsit, zzz"},
+		{name: "invalid file values", file: "upstream_timeout: soon\nblocklist: {a: b}\n", want: "invalid values blocklist: map[a:b], upstream_timeout: soon"},
+		{name: "invalid yaml", file: "blocklist: [", want: "config.yaml: yaml"},
+		{name: "unknown section key", file: "upstream:\n  timeot: 5s\n", want: "field timeot not found"},
+		{name: "unknown listener key", file: "listeners:\n  - addr: :3128\n    roles: [proxy]\n    tsl: {}\n", want: "line 4: field tsl not found"},
+		{name: "invalid section value", file: "upstream:\n  timeout: soon\n", want: "soon"},
+		{name: "given twice", file: "rules:\n  blocklist: [news.test]\nBLOCKLIST: video.test\n", want: "BLOCKLIST given twice"},
+		{name: "listener without roles", file: "listeners:\n  - addr: :3128\n", want: "invalid listener"},
+		{name: "invalid user", file: "users:\n  alice: {password: \"a,b\"}\n", want: `invalid user "alice"`},
+		{
+			name: "blocklist of an unknown user",
+			env:  map[string]string{"PROXY_USERS": "bob:hunter2"},
+			file: "users:\n  alice: {password: s3cret, blocklist: [chat.test]}\n",
+			want: `blocklist of user "alice" requires the user`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if tt.file != "" {
+				writeConfig(t, "config.yaml", tt.file)
+			}
+			if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := LoadConfig(); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the file missing", err)
+	}
+}
+
+func TestConfigFileCoversEverySetting(t *testing.T) {
+	covered := map[string]bool{"LISTENERS": true, "PROXY_USERS": true}
+	var walk func(reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if key := f.Tag.Get("env"); key != "" {
+				covered[key] = true
+			} else if f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+			}
+		}
+	}
+	walk(reflect.TypeOf(configFile{}))
+	for key := range configTypes() {
+		if !covered[key] {
+			t.Errorf("%s has no key in the sections of the config file", key)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// configFile is the layout of CONFIG_FILE, YAML or JSON, grouping the
+	// settings of Config by section. Each setting names the variable which
+	// overrides it. The variables are accepted as top-level keys as well, in
+	// any case, as in the flat files of earlier versions.
+	configFile struct {
+		Port *string `yaml:"port" env:"PORT"`
+		// Listeners are a list of listenerFile, or a LISTENERS specification
+		// as in the flat files
+		Listeners yaml.Node `yaml:"listeners"`
+		Shutdown  struct {
+			Timeout    *time.Duration `yaml:"timeout" env:"SHUTDOWN_TIMEOUT"`
+			DrainDelay *time.Duration `yaml:"drain_delay" env:"DRAIN_DELAY"`
+		} `yaml:"shutdown"`
+		Rules struct {
+			Blocklist     []string `yaml:"blocklist" env:"BLOCKLIST"`
+			BlocklistFile *string  `yaml:"blocklist_file" env:"BLOCKLIST_FILE"`
+			UpgradeHosts  []string `yaml:"upgrade_hosts" env:"UPGRADE_HOSTS"`
+			BypassHosts   []string `yaml:"bypass_hosts" env:"BYPASS_HOSTS"`
+			ScheduleFile  *string  `yaml:"schedule_file" env:"SCHEDULE_FILE"`
+			DecisionOrder []string `yaml:"decision_order" env:"DECISION_ORDER"`
+		} `yaml:"rules"`
+		// Users are the clients of the proxy by name, each with their own
+		// blocklist optionally
+		Users            map[string]userFile `yaml:"users"`
+		UserBlocklistDir *string             `yaml:"user_blocklist_dir" env:"USER_BLOCKLIST_DIR"`
+		Blocking         struct {
+			LogSampleRate *int `yaml:"log_sample_rate" env:"BLOCK_LOG_SAMPLE_RATE"`
+			StatusCode    *int `yaml:"status_code" env:"BLOCK_STATUS_CODE"`
+			SiteBudget    *int `yaml:"site_budget" env:"DISTINCT_SITE_BUDGET"`
+		} `yaml:"blocking"`
+		Cooldown struct {
+			Threshold *int           `yaml:"threshold" env:"COOLDOWN_THRESHOLD"`
+			Window    *time.Duration `yaml:"window" env:"COOLDOWN_WINDOW"`
+			Duration  *time.Duration `yaml:"duration" env:"COOLDOWN_DURATION"`
+		} `yaml:"cooldown"`
+		Exemptions struct {
+			Secret          *string        `yaml:"secret" env:"EXEMPTION_SECRET"`
+			PreviousSecrets []string       `yaml:"previous_secrets" env:"EXEMPTION_PREVIOUS_SECRETS"`
+			KeyFile         *string        `yaml:"key_file" env:"EXEMPTION_KEY_FILE"`
+			Skew            *time.Duration `yaml:"skew" env:"EXEMPTION_SKEW"`
+		} `yaml:"exemptions"`
+		Tarpit struct {
+			Hosts      []string       `yaml:"hosts" env:"TARPIT_HOSTS"`
+			MaxDelay   *time.Duration `yaml:"max_delay" env:"TARPIT_MAX_DELAY"`
+			RampLength *time.Duration `yaml:"ramp_length" env:"TARPIT_RAMP_LENGTH"`
+			IdleGap    *time.Duration `yaml:"idle_gap" env:"TARPIT_IDLE_GAP"`
+		} `yaml:"tarpit"`
+		StateFile *string `yaml:"state_file" env:"STATE_FILE"`
+		Usage     struct {
+			MaxHosts *int    `yaml:"max_hosts" env:"USAGE_MAX_HOSTS"`
+			File     *string `yaml:"file" env:"USAGE_FILE"`
+		} `yaml:"usage"`
+		AccessLog struct {
+			Format        *string        `yaml:"format" env:"ACCESS_LOG_FORMAT"`
+			File          *string        `yaml:"file" env:"ACCESS_LOG_FILE"`
+			Skip          []string       `yaml:"skip" env:"NO_LOG_PATHS"`
+			SlowThreshold *time.Duration `yaml:"slow_threshold" env:"SLOW_REQUEST_THRESHOLD"`
+		} `yaml:"access_log"`
+		Upstream struct {
+			Timeout                *time.Duration `yaml:"timeout" env:"UPSTREAM_TIMEOUT"`
+			AllowOverride          *bool          `yaml:"allow_override" env:"ALLOW_UPSTREAM_OVERRIDE"`
+			CredentialsFile        *string        `yaml:"credentials_file" env:"UPSTREAM_CREDENTIALS_FILE"`
+			DefaultScheme          *string        `yaml:"default_scheme" env:"DEFAULT_SCHEME"`
+			HTTPSOnly              *bool          `yaml:"https_only" env:"HTTPS_ONLY_UPSTREAMS"`
+			HTTPSOnlyTryUpgrade    *bool          `yaml:"https_only_try_upgrade" env:"HTTPS_ONLY_TRY_UPGRADE"`
+			StripRequestHeaders    []string       `yaml:"strip_request_headers" env:"STRIP_REQUEST_HEADERS"`
+			NoKeepAliveHosts       []string       `yaml:"no_keepalive_hosts" env:"NO_KEEPALIVE_HOSTS"`
+			ConnMaxAge             *time.Duration `yaml:"conn_max_age" env:"UPSTREAM_CONN_MAX_AGE"`
+			IPPreference           *string        `yaml:"ip_preference" env:"IP_PREFERENCE"`
+			DialFallbackDelay      *time.Duration `yaml:"dial_fallback_delay" env:"DIAL_FALLBACK_DELAY"`
+			RelayBufferBytes       *int64         `yaml:"relay_buffer_bytes" env:"RELAY_BUFFER_BYTES"`
+			MaxResponseHeaderBytes *int64         `yaml:"max_response_header_bytes" env:"MAX_RESPONSE_HEADER_BYTES"`
+			MaxResponseHeaders     *int           `yaml:"max_response_headers" env:"MAX_RESPONSE_HEADERS"`
+			MaxResponseHeaderValue *int           `yaml:"max_response_header_value_bytes" env:"MAX_RESPONSE_HEADER_VALUE_BYTES"`
+		} `yaml:"upstream"`
+		Limits struct {
+			MaxURLLength        *int           `yaml:"max_url_length" env:"MAX_URL_LENGTH"`
+			MaxStreams          *int           `yaml:"max_streams" env:"MAX_STREAMS"`
+			StreamMaxLifetime   *time.Duration `yaml:"stream_max_lifetime" env:"STREAM_MAX_LIFETIME"`
+			MemoryShedThreshold *int           `yaml:"memory_shed_threshold" env:"MEMORY_SHED_THRESHOLD"`
+			MemoryCheckInterval *time.Duration `yaml:"memory_check_interval" env:"MEMORY_CHECK_INTERVAL"`
+		} `yaml:"limits"`
+		Features struct {
+			AccessLog      *bool `yaml:"access_log" env:"FEATURE_ACCESS_LOG"`
+			BlockByReferer *bool `yaml:"block_by_referer" env:"BLOCK_BY_REFERER"`
+			SiteBudget     *bool `yaml:"site_budget" env:"FEATURE_SITE_BUDGET"`
+			Tarpit         *bool `yaml:"tarpit" env:"FEATURE_TARPIT"`
+		} `yaml:"features"`
+		Faults struct {
+			Enabled *bool   `yaml:"enabled" env:"ENABLE_FAULTS"`
+			File    *string `yaml:"file" env:"FAULTS_FILE"`
+			Seed    *int64  `yaml:"seed" env:"FAULTS_SEED"`
+		} `yaml:"faults"`
+		Pages struct {
+			ContentSecurityPolicy *string `yaml:"content_security_policy" env:"CONTENT_SECURITY_POLICY"`
+			ReferrerPolicy        *string `yaml:"referrer_policy" env:"REFERRER_POLICY"`
+			TranslationsDir       *string `yaml:"translations_dir" env:"TRANSLATIONS_DIR"`
+			DefaultLanguage       *string `yaml:"default_language" env:"DEFAULT_LANGUAGE"`
+			ErrorPageTemplate     *string `yaml:"error_page_template" env:"ERROR_PAGE_TEMPLATE"`
+		} `yaml:"pages"`
+		Score struct {
+			WeightBlocked *float64 `yaml:"weight_blocked" env:"SCORE_WEIGHT_BLOCKED"`
+			WeightFocus   *float64 `yaml:"weight_focus" env:"SCORE_WEIGHT_FOCUS"`
+			WeightAllowed *float64 `yaml:"weight_allowed" env:"SCORE_WEIGHT_ALLOWED"`
+		} `yaml:"score"`
+		LogConfig  *bool   `yaml:"log_config" env:"LOG_CONFIG"`
+		AdminToken *string `yaml:"admin_token" env:"ADMIN_TOKEN"`
+		PACProxy   *string `yaml:"pac_proxy" env:"PAC_PROXY"`
+		StatusAPI  struct {
+			Token   *string  `yaml:"token" env:"STATUS_API_TOKEN"`
+			Origins []string `yaml:"origins" env:"STATUS_API_ORIGINS"`
+		} `yaml:"status_api"`
+
+		// Vars are the other top-level keys, checked against the variables
+		Vars map[string]interface{} `yaml:",inline"`
+	}
+
+	// listenerFile is a listener of the config file, an entry of LISTENERS
+	listenerFile struct {
+		Addr  string   `yaml:"addr"`
+		Roles []string `yaml:"roles"`
+		TLS   *struct {
+			Cert string `yaml:"cert"`
+			Key  string `yaml:"key"`
+		} `yaml:"tls"`
+	}
+
+	// userFile is a user of the config file, an entry of PROXY_USERS
+	userFile struct {
+		Password string `yaml:"password"`
+		// Blocklist replaces the default one for the user when set
+		Blocklist []string `yaml:"blocklist"`
+	}
+)
+
+// loadConfigFile reads the settings of the file at path, keyed by their
+// variable name, along with the blocklists of its users. Unknown keys,
+// values of the wrong type and settings given twice are rejected.
+func loadConfigFile(path string) (map[string]string, map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var file configFile
+	// JSON being YAML, both are read alike
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string)
+	var twice []string
+	set := func(key, value string) {
+		if _, ok := values[key]; ok {
+			twice = append(twice, key)
+		}
+		values[key] = value
+	}
+	if err := flattenConfig(reflect.ValueOf(file), set); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := file.listeners(set); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	blocklists, err := file.users(set)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	types := configTypes()
+	var unknown, invalid []string
+	for key, value := range file.Vars {
+		name := strings.ToUpper(key)
+		t, ok := types[name]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		s, ok := configFileValue(value)
+		if !ok || !validValue(t, s) {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", key, value))
+			continue
+		}
+		set(name, s)
+	}
+	sort.Strings(unknown)
+	sort.Strings(invalid)
+	sort.Strings(twice)
+	switch {
+	case len(unknown) > 0:
+		return nil, nil, fmt.Errorf("%s: unknown keys %s", path, strings.Join(unknown, ", "))
+	case len(invalid) > 0:
+		return nil, nil, fmt.Errorf("%s: invalid values %s", path, strings.Join(invalid, ", "))
+	case len(twice) > 0:
+		return nil, nil, fmt.Errorf("%s: %s given twice", path, strings.Join(twice, ", "))
+	}
+	return values, blocklists, nil
+}
+
+// flattenConfig passes the settings of the sections of v given in the file
+// to set, formatted as their variable would be
+func flattenConfig(v reflect.Value, set func(key, value string)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		key := field.Tag.Get("env")
+		switch {
+		case key == "" && value.Kind() == reflect.Struct:
+			if err := flattenConfig(value, set); err != nil {
+				return err
+			}
+		case key == "":
+		case value.Kind() == reflect.Pointer && !value.IsNil():
+			set(key, fmt.Sprint(value.Elem().Interface()))
+		case value.Kind() == reflect.Slice && !value.IsNil():
+			items := value.Interface().([]string)
+			for _, item := range items {
+				if strings.Contains(item, ",") {
+					return fmt.Errorf("%s: invalid item %q, the items of lists cannot contain commas", field.Tag.Get("yaml"), item)
+				}
+			}
+			set(key, strings.Join(items, ","))
+		}
+	}
+	return nil
+}
+
+// listeners passes the listeners of the file to set, as LISTENERS
+func (file *configFile) listeners(set func(key, value string)) error {
+	node := &file.Listeners
+	switch node.Kind {
+	case 0:
+		return nil
+	case yaml.ScalarNode:
+		set("LISTENERS", node.Value)
+		return nil
+	}
+	var listeners []listenerFile
+	if err := checkFields(node, reflect.TypeOf(listeners)); err != nil {
+		return err
+	}
+	if err := node.Decode(&listeners); err != nil {
+		return err
+	}
+	entries := make([]string, len(listeners))
+	for i, l := range listeners {
+		entry := strings.Join(l.Roles, "+") + "@" + l.Addr
+		if l.TLS != nil {
+			entry += " tls=" + l.TLS.Cert + "," + l.TLS.Key
+		}
+		// the entries are parsed as LISTENERS, which they must not break
+		if len(l.Roles) == 0 || strings.ContainsAny(entry, ";\r\n") || strings.Count(entry, " ") > 1 {
+			return fmt.Errorf("listeners: invalid listener %q, expected an address and roles", entry)
+		}
+		entries[i] = entry
+	}
+	set("LISTENERS", strings.Join(entries, "; "))
+	return nil
+}
+
+// checkFields rejects the keys of the mappings of node matching no field of
+// t, as the decoder of the file does for everything but the yaml.Node fields
+func checkFields(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := checkFields(item, t); err != nil {
+				return err
+			}
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			field, ok := yamlField(t, key.Value)
+			if !ok {
+				return fmt.Errorf("line %d: field %s not found in type %s", key.Line, key.Value, t)
+			}
+			if err := checkFields(node.Content[i+1], field.Type); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlField returns the field of t decoded from key
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name == key {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// users passes the credentials of the users of the file to set, as
+// PROXY_USERS, and returns their blocklists
+func (file *configFile) users(set func(key, value string)) (map[string][]string, error) {
+	if file.Users == nil {
+		return nil, nil
+	}
+	names := make([]string, 0, len(file.Users))
+	for name := range file.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]string, len(names))
+	var blocklists map[string][]string
+	for i, name := range names {
+		user := file.Users[name]
+		if name == "" || strings.ContainsAny(name, ":,") || user.Password == "" || strings.Contains(user.Password, ",") {
+			return nil, fmt.Errorf("users: invalid user %q, expected a name without : or , and a password without ,", name)
+		}
+		entries[i] = name + ":" + user.Password
+		if user.Blocklist != nil {
+			if blocklists == nil {
+				blocklists = make(map[string][]string)
+			}
+			blocklists[name] = user.Blocklist
+		}
+	}
+	set("PROXY_USERS", strings.Join(entries, ","))
+	return blocklists, nil
+}
+
+// configFileValue formats a value of the config file as the variable would
+// be, lists being comma-separated
+func configFileValue(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool, int, int64, uint64:
+		return fmt.Sprint(value), true
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			s, ok := configFileValue(item)
+			if !ok {
+				return "", false
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), true
+	}
+	return "", false
+}
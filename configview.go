@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const redacted = "[redacted]"
+
+// ConfigSetting is an effective configuration value and where it comes from
+type ConfigSetting struct {
+	Name   string      `json:"name"`
+	Env    string      `json:"env,omitempty"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// configSources tells for every field of cfg, and every feature flag, whether
+// a variable or the config file set it, or the default was used
+func configSources(cfg *Config, vars configVars) map[string]string {
+	sources := make(map[string]string)
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		sources[field.Name] = SourceDefault
+		if value, source, ok := vars.lookup(key); ok && applied(v.Field(i), value) {
+			sources[field.Name] = source
+		}
+	}
+	if vars.userBlocklists != nil {
+		sources["UserBlocklists"] = SourceFile
+	}
+	for _, f := range features {
+		sources["Features."+f.name] = SourceDefault
+		if value, source, ok := vars.lookup(f.env); ok && validValue(reflect.TypeOf(f.def), value) {
+			sources["Features."+f.name] = source
+		}
+	}
+	return sources
+}
+
+// applied reports whether value was parsed into field rather than ignored
+func applied(field reflect.Value, value string) bool {
+	switch field.Kind() {
+	case reflect.String:
+		// an empty value only counts where it may clear the default
+		return value != "" || field.String() == ""
+	case reflect.Slice:
+		return strings.Trim(value, ", ") != ""
+	}
+	return validValue(field.Type(), value)
+}
+
+// Settings returns the effective configuration in the order of Config, with
+// the secrets redacted. The feature flags are read from flags when it is set,
+// those changed at runtime coming from the admin endpoint.
+func (cfg *Config) Settings(flags *Flags) []ConfigSetting {
+	var settings []ConfigSetting
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		var value interface{}
+		switch {
+		case field.Tag.Get("secret") == "true":
+			if !v.Field(i).IsZero() {
+				value = redacted
+			}
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			value = time.Duration(v.Field(i).Int()).String()
+		default:
+			value = v.Field(i).Interface()
+		}
+		settings = append(settings, ConfigSetting{Name: field.Name, Env: key, Value: value, Source: cfg.source(field.Name)})
+	}
+	current := cfg.Features
+	if flags != nil {
+		current = flags.All()
+	}
+	for _, f := range features {
+		name := "Features." + f.name
+		setting := ConfigSetting{Name: name, Env: f.env, Value: current[f.name], Source: cfg.source(name)}
+		if current[f.name] != cfg.Features[f.name] {
+			setting.Source = SourceAdmin
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// source returns where the field named name comes from, configs built in
+// code having only defaults
+func (cfg *Config) source(name string) string {
+	if source, ok := cfg.sources[name]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// configHandler serves the effective configuration
+func configHandler(cfg *Config, flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, cfg.Settings(flags))
+	}
+}
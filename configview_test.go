@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigEndpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("block_log_sample_rate: 3\nexemption_secret: s3cret\nblocklist: docs.test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("BLOCKLIST", "news.test")
+	t.Setenv("REFERRER_POLICY", "")
+	t.Setenv("UPGRADE_HOSTS", " , ")
+	proxy, _ := startProxy(t, testConfig(t, nil))
+	if resp, err := admin.Post(proxy.URL+"/admin/flags", "application/json", strings.NewReader(`{"tarpit": false}`)); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+
+	resp, err := admin.Get(proxy.URL + "/admin/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(data), "s3cret") {
+		t.Fatalf("the secret is served: %s", data)
+	}
+	var settings []ConfigSetting
+	if err := json.Unmarshal(data, &settings); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]ConfigSetting)
+	for _, s := range settings {
+		got[s.Name] = s
+	}
+
+	tests := []struct {
+		name   string
+		value  interface{}
+		source string
+	}{
+		{"Blocklist", []interface{}{"news.test"}, SourceEnv},
+		{"BlockLogSampleRate", 3.0, SourceFile},
+		{"ExemptionSecret", redacted, SourceFile},
+		{"ExemptionPreviousSecrets", nil, SourceDefault},
+		{"UpstreamTimeout", "30s", SourceDefault},
+		// an empty string clears a default, a list of nothing is unset
+		{"ReferrerPolicy", "", SourceEnv},
+		{"UpgradeHosts", nil, SourceDefault},
+		{"Features." + FlagTarpit, false, SourceAdmin},
+		{"Features." + FlagAccessLog, true, SourceDefault},
+	}
+	for _, tt := range tests {
+		s, ok := got[tt.name]
+		if !ok {
+			t.Errorf("%s: missing", tt.name)
+			continue
+		}
+		if !equalJSON(s.Value, tt.value) || s.Source != tt.source {
+			t.Errorf("%s: got %v from %s, want %v from %s", tt.name, s.Value, s.Source, tt.value, tt.source)
+		}
+	}
+	if got["BlockLogSampleRate"].Env != "BLOCK_LOG_SAMPLE_RATE" {
+		t.Errorf("got env %q, want BLOCK_LOG_SAMPLE_RATE", got["BlockLogSampleRate"].Env)
+	}
+}
+
+func equalJSON(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
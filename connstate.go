@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnTracker logs connection lifecycle events and counts connections per state.
+// New, active and idle counts are current; closed and hijacked counts are totals.
+type ConnTracker struct {
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+	counts map[http.ConnState]int
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		states: make(map[net.Conn]http.ConnState),
+		counts: make(map[http.ConnState]int),
+	}
+}
+
+// ConnState is meant to be used as the http.Server ConnState callback
+func (t *ConnTracker) ConnState(c net.Conn, state http.ConnState) {
+	proxyLog.WithFields(log.Fields{
+		"remote_addr": c.RemoteAddr().String(),
+		"state":       state.String(),
+	}).Debug("connection state changed")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.states[c]; ok {
+		t.counts[prev]--
+	}
+	t.counts[state]++
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(t.states, c)
+	} else {
+		t.states[c] = state
+	}
+}
+
+// Stats returns the connection counts keyed by state name
+func (t *ConnTracker) Stats() map[string]int {
+	stats := make(map[string]int)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateHijacked, http.StateClosed} {
+		stats[state.String()] = t.counts[state]
+	}
+	return stats
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestConnTrackerCounts(t *testing.T) {
+	tracker := NewConnTracker()
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	c, _ := net.Pipe()
+	for _, step := range []struct {
+		conn  net.Conn
+		state http.ConnState
+	}{
+		{a, http.StateNew}, {a, http.StateActive}, {a, http.StateIdle},
+		{b, http.StateNew}, {b, http.StateActive},
+		{c, http.StateNew}, {c, http.StateActive}, {c, http.StateHijacked},
+		{a, http.StateActive}, {a, http.StateIdle}, {a, http.StateClosed},
+	} {
+		tracker.ConnState(step.conn, step.state)
+	}
+
+	want := map[string]int{"new": 0, "active": 1, "idle": 0, "hijacked": 1, "closed": 1}
+	if got := tracker.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(tracker.states) != 1 {
+		t.Errorf("tracking %d connections, want only the active one", len(tracker.states))
+	}
+}
+
+func TestConnStateLogged(t *testing.T) {
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+	tracker := NewConnTracker()
+	conn, _ := net.Pipe()
+	tracker.ConnState(conn, http.StateNew)
+
+	entries := logs.Find("connection state changed")
+	if len(entries) != 1 || entries[0].Data["state"] != "new" || entries[0].Data["subsystem"] != SubsystemProxy {
+		t.Errorf("got %+v, want one proxy entry for the new state", entries)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Cooldown escalates against clients which keep hitting blocked sites:
+	// more than threshold blocks within window puts the client in cooldown
+	// for duration, during which tolerated sites are blocked as well.
+	Cooldown struct {
+		threshold int
+		window    time.Duration
+		duration  time.Duration
+		now       func() time.Time
+
+		mu      sync.Mutex
+		clients map[string]*cooldownClient
+	}
+
+	cooldownClient struct {
+		attempts []time.Time // blocks within the window, oldest first
+		until    time.Time   // end of the cooldown, zero when not in cooldown
+	}
+
+	// CooldownState describes a client in cooldown, as reported by /admin/stats
+	CooldownState struct {
+		Client string    `json:"client"`
+		Until  time.Time `json:"until"`
+	}
+)
+
+// NewCooldown returns a cooldown which never triggers when threshold is zero
+func NewCooldown(threshold int, window, duration time.Duration) *Cooldown {
+	return &Cooldown{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		now:       time.Now,
+		clients:   make(map[string]*cooldownClient),
+	}
+}
+
+func (c *Cooldown) Enabled() bool {
+	return c.threshold > 0
+}
+
+// RecordBlocked counts a blocked attempt of client, starting its cooldown
+// once the threshold is exceeded. Attempts during a cooldown do not extend it.
+func (c *Cooldown) RecordBlocked(client string) {
+	if !c.Enabled() {
+		return
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	state, ok := c.clients[client]
+	if !ok {
+		state = &cooldownClient{}
+		c.clients[client] = state
+	}
+	if now.Before(state.until) {
+		return
+	}
+	state.attempts = append(state.attempts, now)
+	if len(state.attempts) <= c.threshold {
+		return
+	}
+	state.attempts = nil
+	state.until = now.Add(c.duration)
+	rulesLog.WithFields(log.Fields{
+		"client":    client,
+		"threshold": c.threshold,
+		"window":    c.window.String(),
+		"until":     state.until,
+	}).Info("client in cooldown")
+}
+
+// Until returns the end of the cooldown of client, or the zero time if it is not in one
+func (c *Cooldown) Until(client string) time.Time {
+	if !c.Enabled() {
+		return time.Time{}
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, ok := c.clients[client]; ok && now.Before(state.until) {
+		return state.until
+	}
+	return time.Time{}
+}
+
+// expire forgets the attempts out of the window and the ended cooldowns
+func (c *Cooldown) expire(now time.Time) {
+	for client, state := range c.clients {
+		i := 0
+		for i < len(state.attempts) && now.Sub(state.attempts[i]) > c.window {
+			i++
+		}
+		state.attempts = state.attempts[i:]
+		if !state.until.IsZero() && !now.Before(state.until) {
+			rulesLog.WithField("client", client).Debug("cooldown ended")
+			state.until = time.Time{}
+		}
+		if len(state.attempts) == 0 && state.until.IsZero() {
+			delete(c.clients, client)
+		}
+	}
+}
+
+// Stats returns the clients currently in cooldown
+func (c *Cooldown) Stats() []CooldownState {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := []CooldownState{}
+	for client, state := range c.clients {
+		if now.Before(state.until) {
+			states = append(states, CooldownState{Client: client, Until: state.until})
+		}
+	}
+	return states
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestCooldown(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	c := NewCooldown(2, time.Minute, 5*time.Minute)
+	c.now = clock.Now
+
+	// the attempts out of the window are forgotten
+	c.RecordBlocked("192.0.2.1")
+	c.RecordBlocked("192.0.2.1")
+	clock.Advance(61 * time.Second)
+	c.RecordBlocked("192.0.2.1")
+	if until := c.Until("192.0.2.1"); !until.IsZero() {
+		t.Fatalf("in cooldown until %s, want no cooldown", until)
+	}
+	c.RecordBlocked("192.0.2.1")
+	c.RecordBlocked("192.0.2.1")
+	want := clock.Now().Add(5 * time.Minute)
+	if until := c.Until("192.0.2.1"); !until.Equal(want) {
+		t.Fatalf("got cooldown until %s, want %s", until, want)
+	}
+	if until := c.Until("192.0.2.2"); !until.IsZero() {
+		t.Errorf("another client in cooldown until %s", until)
+	}
+
+	// the attempts during the cooldown do not extend it
+	clock.Advance(4 * time.Minute)
+	for i := 0; i < 5; i++ {
+		c.RecordBlocked("192.0.2.1")
+	}
+	if until := c.Until("192.0.2.1"); !until.Equal(want) {
+		t.Errorf("got cooldown until %s, want %s", until, want)
+	}
+	if got := c.Stats(); len(got) != 1 || got[0].Client != "192.0.2.1" {
+		t.Errorf("got %+v, want the client in cooldown", got)
+	}
+	clock.Advance(time.Minute)
+	if until := c.Until("192.0.2.1"); !until.IsZero() {
+		t.Errorf("still in cooldown until %s", until)
+	}
+	if got := c.Stats(); len(got) != 0 {
+		t.Errorf("got %+v once the cooldown ended", got)
+	}
+}
+
+func TestCooldownDisabled(t *testing.T) {
+	c := NewCooldown(0, time.Minute, time.Minute)
+	for i := 0; i < 10; i++ {
+		c.RecordBlocked("192.0.2.1")
+	}
+	if c.Enabled() || !c.Until("192.0.2.1").IsZero() {
+		t.Error("a disabled cooldown triggered")
+	}
+}
+
+func TestCooldownBlocksTarpittedHosts(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.Local))
+	cfg := testConfig(t, upstream)
+	cfg.now = clock.Now
+	cfg.Blocklist = []string{"news.test"}
+	cfg.TarpitHosts = []string{"slow.test"}
+	cfg.CooldownThreshold = 1
+	cfg.CooldownDuration = 30 * time.Minute
+	proxy, s := startProxy(t, cfg)
+	cooldown := func() []CooldownState {
+		resp, err := admin.Get(proxy.URL + "/admin/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var stats struct {
+			Cooldown []CooldownState `json:"cooldown"`
+		}
+		json.NewDecoder(resp.Body).Decode(&stats)
+		return stats.Cooldown
+	}
+
+	if resp, _ := get(t, proxy.Client, "http://slow.test/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d before the cooldown, want 200", resp.StatusCode)
+	}
+	get(t, proxy.Client, "http://news.test/")
+	get(t, proxy.Client, "http://news.test/")
+	if got := cooldown(); len(got) != 1 || got[0].Client != "127.0.0.1" || !got[0].Until.Equal(clock.Now().Add(30*time.Minute)) {
+		t.Fatalf("got %+v, want the client in cooldown for 30m", got)
+	}
+	resp, body := get(t, proxy.Client, "http://slow.test/")
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "until 09:30") {
+		t.Errorf("got %d %q during the cooldown, want the block page naming its end", resp.StatusCode, body)
+	}
+
+	// an exemption still lets the client through
+	token, _, err := s.exemptions.Mint("slow.test", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://slow.test/", nil)
+	req.Header.Set(ExemptionHeader, token)
+	if resp, err := proxy.Client.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %v, %v with an exemption, want 200", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	clock.Advance(30 * time.Minute)
+	if resp, _ := get(t, proxy.Client, "http://slow.test/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d once the cooldown ended, want 200", resp.StatusCode)
+	}
+	if got := cooldown(); len(got) != 0 {
+		t.Errorf("got %+v once the cooldown ended", got)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credential types
+const (
+	CredentialBearer = "bearer"
+	CredentialBasic  = "basic"
+	CredentialHeader = "header"
+)
+
+type (
+	// Credentials are added to the upstream requests of some hosts. A host
+	// such as "api.example.com" matches exactly, one starting with a dot such
+	// as ".corp.example.com" matches its subdomains. An exact host wins over a
+	// suffix, and a longer suffix over a shorter one.
+	Credentials struct {
+		exact    map[string]*credential
+		suffixes []*credential // longest first
+	}
+
+	credential struct {
+		host      string
+		header    string
+		value     string // never logged
+		allowHTTP bool
+	}
+
+	credentialsFile struct {
+		Credentials []credentialEntry `json:"credentials" yaml:"credentials"`
+	}
+
+	// credentialEntry is a credential of the file. Secrets are read from the
+	// variable named by the _env field or from the file of the _file field.
+	credentialEntry struct {
+		Host         string `json:"host" yaml:"host"`
+		Type         string `json:"type" yaml:"type"`
+		TokenEnv     string `json:"token_env" yaml:"token_env"`
+		TokenFile    string `json:"token_file" yaml:"token_file"`
+		Username     string `json:"username" yaml:"username"`
+		PasswordEnv  string `json:"password_env" yaml:"password_env"`
+		PasswordFile string `json:"password_file" yaml:"password_file"`
+		Header       string `json:"header" yaml:"header"`
+		ValueEnv     string `json:"value_env" yaml:"value_env"`
+		ValueFile    string `json:"value_file" yaml:"value_file"`
+		AllowHTTP    bool   `json:"allow_http" yaml:"allow_http"`
+	}
+)
+
+// LoadCredentials reads a YAML or JSON credentials file such as:
+//
+//	credentials:
+//	  - host: api.internal.example.com
+//	    type: bearer
+//	    token_env: INTERNAL_API_TOKEN
+//	  - host: .corp.example.com
+//	    type: basic
+//	    username: proxy
+//	    password_file: /run/secrets/corp
+//	  - host: metrics.example.com
+//	    type: header
+//	    header: X-Api-Key
+//	    value_env: METRICS_KEY
+//	    allow_http: true
+func LoadCredentials(path string) (*Credentials, error) {
+	var file credentialsFile
+	if err := decodeFile(path, &file); err != nil {
+		return nil, err
+	}
+	c := &Credentials{exact: make(map[string]*credential)}
+	for i, entry := range file.Credentials {
+		cred, err := newCredential(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: credential %d: %w", path, i+1, err)
+		}
+		if strings.HasPrefix(cred.host, ".") {
+			c.suffixes = append(c.suffixes, cred)
+		} else {
+			c.exact[cred.host] = cred
+		}
+	}
+	// the longest suffix is tried first
+	sort.SliceStable(c.suffixes, func(i, j int) bool { return len(c.suffixes[i].host) > len(c.suffixes[j].host) })
+	return c, nil
+}
+
+func newCredential(entry credentialEntry) (*credential, error) {
+	host := strings.ToLower(strings.TrimSpace(entry.Host))
+	if host == "" || host == "." {
+		return nil, fmt.Errorf("missing host")
+	}
+	if !validHost(strings.TrimPrefix(host, ".")) {
+		return nil, fmt.Errorf("invalid host %q", entry.Host)
+	}
+	cred := &credential{host: host, header: "Authorization", allowHTTP: entry.AllowHTTP}
+	switch entry.Type {
+	case CredentialBearer:
+		token, err := readSecret("token", entry.TokenEnv, entry.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		cred.value = "Bearer " + token
+	case CredentialBasic:
+		if entry.Username == "" {
+			return nil, fmt.Errorf("%s: missing username", host)
+		}
+		password, err := readSecret("password", entry.PasswordEnv, entry.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		r := &http.Request{Header: make(http.Header)}
+		r.SetBasicAuth(entry.Username, password)
+		cred.value = r.Header.Get("Authorization")
+	case CredentialHeader:
+		if entry.Header == "" {
+			return nil, fmt.Errorf("%s: missing header", host)
+		}
+		value, err := readSecret("value", entry.ValueEnv, entry.ValueFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		cred.header, cred.value = textproto.CanonicalMIMEHeaderKey(entry.Header), value
+	default:
+		return nil, fmt.Errorf("%s: invalid type %q, expected bearer, basic or header", host, entry.Type)
+	}
+	return cred, nil
+}
+
+// readSecret returns the value of the variable env, or else the content of
+// file trimmed of surrounding spaces
+func readSecret(name, env, file string) (string, error) {
+	var value string
+	switch {
+	case env != "" && file != "":
+		return "", fmt.Errorf("both %s_env and %s_file given", name, name)
+	case env != "":
+		value = os.Getenv(env)
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("%s_file: %w", name, err)
+		}
+		value = strings.TrimSpace(string(data))
+	default:
+		return "", fmt.Errorf("missing %s_env or %s_file", name, name)
+	}
+	if value == "" {
+		return "", fmt.Errorf("empty %s", name)
+	}
+	return value, nil
+}
+
+// match returns the credential of host, or nil
+func (c *Credentials) match(host string) *credential {
+	if c == nil {
+		return nil
+	}
+	host = normalizeHost(host)
+	if cred, ok := c.exact[host]; ok {
+		return cred
+	}
+	for _, cred := range c.suffixes {
+		if strings.HasSuffix(host, cred.host) {
+			return cred
+		}
+	}
+	return nil
+}
+
+// Inject adds the credential of the host of outReq unless the client sent
+// its own, from r. Credentials are only sent over https unless allowed
+// for plain http by their entry.
+func (c *Credentials) Inject(r, outReq *http.Request, logger *log.Entry) {
+	cred := c.match(outReq.URL.Hostname())
+	if cred == nil {
+		return
+	}
+	logger = logger.WithFields(log.Fields{"credential": cred.host, "header": cred.header})
+	if r.Header.Get(cred.header) != "" {
+		logger.Debug("client credentials kept")
+		return
+	}
+	if outReq.URL.Scheme != "https" && !cred.allowHTTP {
+		logger.Warn("credentials not injected over plain http")
+		return
+	}
+	outReq.Header.Set(cred.header, cred.value)
+	logger.Debug("credentials injected")
+}
+
+// CheckRedirect drops the injected credentials from redirects leaving their
+// host, or going to plain http when not allowed, as http.Client only does
+// it for Authorization
+func (c *Credentials) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	cred := c.match(via[0].URL.Hostname())
+	if cred == nil || req.Header.Get(cred.header) != cred.value {
+		return nil
+	}
+	if c.match(req.URL.Hostname()) != cred || (req.URL.Scheme != "https" && !cred.allowHTTP) {
+		req.Header.Del(cred.header)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+const testCredentials = `
+credentials:
+  - host: api.test
+    type: bearer
+    token_env: TEST_API_TOKEN
+  - host: .corp.test
+    type: basic
+    username: proxy
+    password_file: %s
+  - host: .eu.corp.test
+    type: header
+    header: x-api-key
+    value_env: TEST_EU_KEY
+    allow_http: true
+  - host: metrics.test
+    type: header
+    header: X-Api-Key
+    value_env: TEST_METRICS_KEY
+    allow_http: true
+`
+
+// writeCredentials writes the test credentials and the secrets they refer to
+func writeCredentials(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	password := filepath.Join(dir, "password")
+	if err := os.WriteFile(password, []byte(" corp-password\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_API_TOKEN", "api-token")
+	t.Setenv("TEST_EU_KEY", "eu-key")
+	t.Setenv("TEST_METRICS_KEY", "metrics-key")
+	path := filepath.Join(dir, "credentials.yaml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(testCredentials, password)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentialMatch(t *testing.T) {
+	c, err := LoadCredentials(writeCredentials(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"api.test":         "api.test",
+		"API.test.":        "api.test",
+		"www.api.test":     "",
+		"corp.test":        "",
+		"git.corp.test":    ".corp.test",
+		"git.eu.corp.test": ".eu.corp.test",
+		"metrics.test":     "metrics.test",
+	}
+	for host, want := range tests {
+		got := ""
+		if cred := c.match(host); cred != nil {
+			got = cred.host
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", host, got, want)
+		}
+	}
+	if cred := c.match("git.corp.test"); cred.value != "Basic cHJveHk6Y29ycC1wYXNzd29yZA==" {
+		t.Errorf("got %q, want the basic credentials of proxy:corp-password", cred.value)
+	}
+	if cred := c.match("git.eu.corp.test"); cred.header != "X-Api-Key" {
+		t.Errorf("got header %q, want it canonical", cred.header)
+	}
+}
+
+func TestLoadCredentialsErrors(t *testing.T) {
+	t.Setenv("TEST_EMPTY", "")
+	t.Setenv("TEST_TOKEN", "token")
+	tests := map[string]string{
+		"missing host":  "- type: bearer\n  token_env: TEST_TOKEN",
+		"invalid host":  "- host: api/test\n  type: bearer\n  token_env: TEST_TOKEN",
+		"invalid type":  "- host: api.test\n  type: digest",
+		"no secret":     "- host: api.test\n  type: bearer",
+		"both secrets":  "- host: api.test\n  type: bearer\n  token_env: TEST_TOKEN\n  token_file: /token",
+		"empty secret":  "- host: api.test\n  type: bearer\n  token_env: TEST_EMPTY",
+		"no username":   "- host: api.test\n  type: basic\n  password_env: TEST_TOKEN",
+		"no header":     "- host: api.test\n  type: header\n  value_env: TEST_TOKEN",
+		"missing file":  "- host: api.test\n  type: bearer\n  token_file: /no/such/file",
+		"unknown field": "- host: api.test\n  type: bearer\n  token: inline",
+	}
+	for name, entries := range tests {
+		path := filepath.Join(t.TempDir(), "credentials.yaml")
+		os.WriteFile(path, []byte("credentials:\n"+indent(entries)), 0o600)
+		if _, err := LoadCredentials(path); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+// indent indents the lines of s by two spaces
+func indent(s string) string {
+	return "  " + strings.ReplaceAll(s, "\n", "\n  ") + "\n"
+}
+
+func TestCredentialsInjected(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	echo := testutil.Route{Handler: func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Api-Key"))
+	}}
+	upstream.Handle("/", echo)
+	upstream.Handle("/away", testutil.Route{Handler: func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://other.test/", http.StatusFound)
+	}})
+	upstream.Handle("/here", testutil.Route{Handler: func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}})
+	cfg := testConfig(t, upstream)
+	cfg.UpstreamCredentialsFile = writeCredentials(t)
+	proxy, _ := startProxy(t, cfg)
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+	fetch := func(target string, header http.Header) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := proxy.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	tests := []struct {
+		name, target string
+		header       http.Header
+		want         string
+	}{
+		{"header over http", "http://metrics.test/", nil, "|metrics-key"},
+		{"suffix over http", "http://git.eu.corp.test/", nil, "|eu-key"},
+		{"bearer over http", "http://api.test/", nil, "|"},
+		{"no credential", "http://docs.test/", nil, "|"},
+		{"client credentials", "http://metrics.test/", http.Header{"X-Api-Key": {"mine"}}, "|mine"},
+		{"redirect to the same host", "http://metrics.test/here", nil, "|metrics-key"},
+		{"redirect to another host", "http://metrics.test/away", nil, "|"},
+	}
+	for _, tt := range tests {
+		if got := fetch(tt.target, tt.header); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if len(logs.Find("credentials not injected over plain http")) != 1 {
+		t.Error("the credential refused over plain http is not logged")
+	}
+	logs.Wait(t, "request completed", len(tests))
+	for _, e := range logs.Entries() {
+		line := fmt.Sprint(e.Message, e.Data)
+		for _, secret := range []string{"metrics-key", "eu-key", "api-token", "corp-password"} {
+			if strings.Contains(line, secret) {
+				t.Errorf("the secret %s is logged: %s", secret, line)
+			}
+		}
+	}
+}
+
+func TestCheckRedirectDropsCredentials(t *testing.T) {
+	c, err := LoadCredentials(writeCredentials(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(target, authorization string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, target, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return r
+	}
+	via := []*http.Request{request("https://api.test/", "Bearer api-token")}
+	tests := []struct {
+		target, authorization string
+		kept                  bool
+	}{
+		{"https://api.test/next", "Bearer api-token", true},
+		{"http://api.test/next", "Bearer api-token", false},
+		{"https://other.test/", "Bearer api-token", false},
+		// credentials of the client are not the business of the proxy
+		{"https://other.test/", "Bearer mine", true},
+	}
+	for _, tt := range tests {
+		req := request(tt.target, tt.authorization)
+		if err := c.CheckRedirect(req, via); err != nil {
+			t.Fatal(err)
+		}
+		if kept := req.Header.Get("Authorization") != ""; kept != tt.kept {
+			t.Errorf("%s with %s: kept %t, want %t", tt.target, tt.authorization, kept, tt.kept)
+		}
+	}
+	if err := c.CheckRedirect(request("https://api.test/", ""), make([]*http.Request, 10)); err == nil {
+		t.Error("got no error after 10 redirects")
+	}
+}
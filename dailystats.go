@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/report"
+)
+
+// dailyRetention is the number of days of statistics kept
+const dailyRetention = 400
+
+// DailyStats counts the blocked attempts per domain for each local date
+type DailyStats struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	days map[string]report.Day
+	last string // date of the last record, to prune old days once a day
+}
+
+func NewDailyStats() *DailyStats {
+	return &DailyStats{
+		now:  time.Now,
+		days: make(map[string]report.Day),
+	}
+}
+
+// RecordBlocked counts a blocked attempt on domain today
+func (d *DailyStats) RecordBlocked(domain string) {
+	now := d.now()
+	date := now.Format(report.DateLayout)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if date != d.last {
+		d.last = date
+		d.prune(now.AddDate(0, 0, -dailyRetention).Format(report.DateLayout))
+	}
+	day, ok := d.days[date]
+	if !ok {
+		day = report.Day{Blocked: make(map[string]int64)}
+		d.days[date] = day
+	}
+	day.Blocked[domain]++
+}
+
+// prune drops the days before oldest, must be called with mu held
+func (d *DailyStats) prune(oldest string) {
+	for date := range d.days {
+		if date < oldest {
+			delete(d.days, date)
+		}
+	}
+}
+
+// Days returns a copy of the statistics keyed by date
+func (d *DailyStats) Days() map[string]report.Day {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	days := make(map[string]report.Day, len(d.days))
+	for date, day := range d.days {
+		blocked := make(map[string]int64, len(day.Blocked))
+		for domain, n := range day.Blocked {
+			blocked[domain] = n
+		}
+		days[date] = report.Day{Blocked: blocked}
+	}
+	return days
+}
+
+// Today returns a copy of the blocked attempts per domain today
+func (d *DailyStats) Today() map[string]int64 {
+	date := d.now().Format(report.DateLayout)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	blocked := make(map[string]int64, len(d.days[date].Blocked))
+	for domain, n := range d.days[date].Blocked {
+		blocked[domain] = n
+	}
+	return blocked
+}
+
+// Restore replaces the statistics with days, as loaded from the state file
+func (d *DailyStats) Restore(days map[string]report.Day) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.days = make(map[string]report.Day, len(days))
+	for date, day := range days {
+		if day.Blocked == nil {
+			day.Blocked = make(map[string]int64)
+		}
+		d.days[date] = day
+	}
+}
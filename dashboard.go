@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// dashboardPolicy lets the dashboard run its own script and poll the admin endpoints
+const dashboardPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; img-src 'self'; form-action 'none'; frame-ancestors 'none'"
+
+// loginPolicy lets the login page post its form, and nothing else
+const loginPolicy = "default-src 'none'; form-action 'self'; frame-ancestors 'none'"
+
+var loginTemplate = template.Must(template.ParseFS(templatesFS, "templates/login.html"))
+
+// serveLogin serves the login page of the dashboard, with the error of the previous attempt if any
+func serveLogin(w http.ResponseWriter, status int, failure string) {
+	w.Header().Set("Content-Security-Policy", loginPolicy)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, failure); err != nil {
+		adminLog.WithField("event", "render login").Warn(err)
+	}
+}
+
+// loginHandler serves the login page of the dashboard at /dashboard/login,
+// and trades the ADMIN_TOKEN posted to it for the cookie which lets the
+// browser read the admin endpoints
+func loginHandler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			serveLogin(w, http.StatusOK, "")
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// without ADMIN_TOKEN, there is no login, only the listeners trusted or not
+		if cfg.AdminToken == "" {
+			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+			return
+		}
+		token := r.PostFormValue("token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			adminLog.WithField("remote", r.RemoteAddr).Warn("dashboard login refused")
+			serveLogin(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     adminCookie,
+			Value:    token,
+			Path:     "/",
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	})
+}
+
+// dashboardHandler serves the embedded dashboard at /dashboard, and its
+// assets below /dashboard/
+func dashboardHandler() http.Handler {
+	assets, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	index, err := fs.ReadFile(assets, "index.html")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix("/dashboard/", http.FileServer(http.FS(assets)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", dashboardPolicy)
+		if r.URL.Path == "/dashboard" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(index))
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
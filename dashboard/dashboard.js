@@ -0,0 +1,107 @@
+// The dashboard polls the admin endpoints and fills the page in.
+"use strict";
+
+const pollInterval = 5000;
+const topCount = 5;
+// settings shown to the reader, the others being for operators
+const shownSettings = ["BlocklistFile", "ScheduleFile", "DistinctSiteBudget", "CooldownThreshold", "CooldownDuration"];
+
+function text(id, value) {
+  document.getElementById(id).textContent = value;
+}
+
+function rows(id, items, cells) {
+  const body = document.getElementById(id);
+  body.replaceChildren(...items.map((item) => {
+    const tr = document.createElement("tr");
+    for (const value of cells(item)) {
+      const td = document.createElement("td");
+      td.textContent = value;
+      tr.append(td);
+    }
+    return tr;
+  }));
+}
+
+function bytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function time(value) {
+  return new Date(value).toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+}
+
+async function get(path) {
+  const resp = await fetch(path, { headers: { Accept: "application/json" } });
+  // the login cookie is missing, or ADMIN_TOKEN changed since
+  if (resp.status === 401) {
+    location.assign("/dashboard/login");
+  }
+  if (!resp.ok) {
+    throw new Error(path + ": " + resp.status + " " + resp.statusText);
+  }
+  return resp.json();
+}
+
+function showStatus(status) {
+  const focus = document.getElementById("focus");
+  focus.classList.toggle("active", status.mode !== "normal");
+  switch (status.mode) {
+    case "maintenance":
+      focus.textContent = "Maintenance, nothing is blocked";
+      break;
+    case "cooldown":
+      focus.textContent = "Cooldown until " + time(status.cooldown_until);
+      break;
+    case "focus":
+      focus.textContent = status.schedules.map((s) => s.name).join(", ") + " until " + time(status.focus_until);
+      break;
+    default:
+      focus.textContent = status.next_focus ? "Free until " + time(status.next_focus) : "No schedule";
+  }
+  text("blocked-today", status.blocked_today);
+  rows("top-blocked", status.top_domains, (d) => [d.domain, d.blocked]);
+}
+
+function showStats(stats) {
+  text("blocked-total", stats.blocked);
+  text("bypassed", stats.bypassed);
+  text("streams", stats.streams);
+  const latency = stats.latency;
+  text("latency-p50", latency.samples ? latency.p50_ms + " ms" : "–");
+  text("latency-p95", latency.samples ? latency.p95_ms + " ms" : "–");
+}
+
+function showSettings(settings) {
+  const list = document.getElementById("settings");
+  list.replaceChildren();
+  for (const s of settings.filter((s) => shownSettings.includes(s.name))) {
+    const dt = document.createElement("dt");
+    dt.textContent = s.env;
+    const dd = document.createElement("dd");
+    dd.textContent = s.value === null || s.value === "" ? "–" : s.value;
+    list.append(dt, dd);
+  }
+}
+
+async function poll() {
+  const results = await Promise.allSettled([
+    get("/api/status").then(showStatus),
+    get("/admin/stats").then(showStats),
+    get("/usage").then((usage) => rows("usage", usage.slice(0, topCount), (h) => [h.host, h.requests, bytes(h.bytes)])),
+    get("/admin/config").then(showSettings),
+  ]);
+  const errors = results.filter((r) => r.status === "rejected").map((r) => r.reason.message);
+  const error = document.getElementById("error");
+  error.hidden = errors.length === 0;
+  error.textContent = errors.join("; ");
+}
+
+poll();
+setInterval(poll, pollInterval);
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	proxy, _ := startProxy(t, testConfig(t, nil))
+	tests := []struct {
+		path, file, contentType string
+	}{
+		{"/dashboard", "index.html", "text/html"},
+		{"/dashboard/dashboard.js", "dashboard.js", "text/javascript"},
+		{"/dashboard/dashboard.css", "dashboard.css", "text/css"},
+	}
+	for _, tt := range tests {
+		resp, body := get(t, admin, proxy.URL+tt.path)
+		want, err := os.ReadFile(filepath.Join("dashboard", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || body != string(want) {
+			t.Errorf("%s: got %d with %d bytes, want the embedded %s", tt.path, resp.StatusCode, len(body), tt.file)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), tt.contentType) {
+			t.Errorf("%s: got Content-Type %q, want %s", tt.path, resp.Header.Get("Content-Type"), tt.contentType)
+		}
+		// the policy of the dashboard replaces the one of the other pages
+		if resp.Header.Get("Content-Security-Policy") != dashboardPolicy {
+			t.Errorf("%s: got Content-Security-Policy %q", tt.path, resp.Header.Get("Content-Security-Policy"))
+		}
+	}
+
+	if resp, _ := get(t, admin, proxy.URL+"/dashboard/missing.js"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d for a missing asset, want 404", resp.StatusCode)
+	}
+	resp, err := admin.Post(proxy.URL+"/dashboard", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got %d for a POST, want 405", resp.StatusCode)
+	}
+}
+
+func TestDashboardLogin(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.StatusAPIToken = "t0ken"
+	proxy, _ := startProxy(t, cfg)
+	// the cookie is only ever sent by a browser, not redirected along
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	login := func(token string) *http.Response {
+		t.Helper()
+		resp, err := browser.PostForm(proxy.URL+"/dashboard/login", url.Values{"token": {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp, body := get(t, browser, proxy.URL+"/dashboard")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body, `action="/dashboard/login"`) {
+		t.Errorf("got %d %q without the cookie, want the login page", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Security-Policy") != loginPolicy {
+		t.Errorf("got Content-Security-Policy %q", resp.Header.Get("Content-Security-Policy"))
+	}
+	if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 0 {
+		t.Errorf("got %d with cookies %v for a wrong token, want 401", resp.StatusCode, resp.Cookies())
+	}
+	resp = login(testAdminToken)
+	cookies := resp.Cookies()
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/dashboard" || len(cookies) != 1 {
+		t.Fatalf("got %d to %q with cookies %v, want the dashboard with the cookie", resp.StatusCode, resp.Header.Get("Location"), cookies)
+	}
+	if c := cookies[0]; c.Name != adminCookie || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("got cookie %+v, want it HttpOnly and SameSite=Strict", c)
+	}
+
+	send := func(method, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, proxy.URL+path, nil)
+		req.AddCookie(cookies[0])
+		resp, err := browser.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// the page and every endpoint it polls, /api/status included
+	for _, path := range []string{"/dashboard", "/dashboard/dashboard.js", "/api/status", "/admin/stats", "/usage", "/admin/config"} {
+		if status := send(http.MethodGet, path); status != http.StatusOK {
+			t.Errorf("%s: got %d with the cookie, want 200", path, status)
+		}
+	}
+	// the cookie reads only, so that no other page can change anything
+	if status := send(http.MethodPost, "/admin/drain"); status != http.StatusUnauthorized {
+		t.Errorf("got %d for a POST with the cookie, want 401", status)
+	}
+}
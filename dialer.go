@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IP_PREFERENCE values
+const (
+	IPPreferenceAuto = "auto"
+	IPPreferenceIPv4 = "ipv4"
+	IPPreferenceIPv6 = "ipv6"
+)
+
+type (
+	// resolver is the part of net.Resolver used to pick upstream addresses
+	resolver interface {
+		LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	}
+
+	// upstreamDialer dials upstreams, trying the addresses of the preferred family first.
+	// With the auto preference it leaves the dialer racing both families (happy eyeballs).
+	upstreamDialer struct {
+		dialer     *net.Dialer
+		resolver   resolver
+		preference string
+	}
+
+	// dialTrace collects the connection details of an upstream request through httptrace
+	dialTrace struct {
+		mu       sync.Mutex
+		attempts []string
+		remote   string
+		reused   bool
+	}
+)
+
+func newUpstreamDialer(preference string, fallbackDelay time.Duration) *upstreamDialer {
+	return &upstreamDialer{
+		dialer: &net.Dialer{
+			Timeout:       30 * time.Second,
+			KeepAlive:     30 * time.Second,
+			FallbackDelay: fallbackDelay,
+		},
+		resolver:   net.DefaultResolver,
+		preference: preference,
+	}
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || d.preference == IPPreferenceAuto || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, ip := range preferFamily(addrs, d.preference) {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("dial %s: no addresses found", addr)
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// preferFamily orders addrs with the preferred family first, keeping the
+// resolver order within each family
+func preferFamily(addrs []net.IPAddr, preference string) []net.IPAddr {
+	var preferred, others []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (preference == IPPreferenceIPv4) {
+			preferred = append(preferred, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// ClientTrace returns the hooks recording the dial attempts and the connection used
+func (t *dialTrace) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			attempt := network + " " + addr
+			if err != nil {
+				attempt += " failed"
+			}
+			t.mu.Lock()
+			t.attempts = append(t.attempts, attempt)
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.remote = info.Conn.RemoteAddr().String()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+	}
+}
+
+// Fields returns the log fields describing the connection
+func (t *dialTrace) Fields() log.Fields {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fields := log.Fields{"conn_reused": t.reused}
+	if len(t.attempts) > 0 {
+		fields["dial_attempts"] = append([]string(nil), t.attempts...)
+	}
+	if t.remote != "" {
+		fields["upstream_addr"] = t.remote
+		fields["address_family"] = addressFamily(t.remote)
+	}
+	return fields
+}
+
+func addressFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return IPPreferenceIPv6
+	}
+	return IPPreferenceIPv4
+}
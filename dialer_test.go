@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// stubResolver resolves every host to its addresses
+type stubResolver []string
+
+func (r stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if len(r) == 0 {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range r {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestPreferFamily(t *testing.T) {
+	addrs, _ := stubResolver{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}.LookupIPAddr(context.Background(), "")
+	tests := map[string][]string{
+		IPPreferenceIPv4: {"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"},
+		IPPreferenceIPv6: {"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+	}
+	for preference, want := range tests {
+		var got []string
+		for _, addr := range preferFamily(addrs, preference) {
+			got = append(got, addr.IP.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", preference, got, want)
+		}
+	}
+}
+
+func TestUpstreamDialerFallsBack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+
+	tests := []struct {
+		name       string
+		preference string
+		addrs      stubResolver
+		port       string
+		ok         bool
+	}{
+		{"preferred family", IPPreferenceIPv4, stubResolver{"::1", "127.0.0.1"}, port, true},
+		// nothing listens on the IPv6 loopback, the IPv4 one is tried next
+		{"other family", IPPreferenceIPv6, stubResolver{"127.0.0.1", "::1"}, port, true},
+		{"every address failing", IPPreferenceIPv4, stubResolver{"127.0.0.1"}, closedPort, false},
+		{"resolver failing", IPPreferenceIPv4, nil, port, false},
+	}
+	for _, tt := range tests {
+		d := newUpstreamDialer(tt.preference, 0)
+		d.resolver = tt.addrs
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("upstream.test", tt.port))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %t", tt.name, err, tt.ok)
+		}
+		if conn != nil {
+			if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+				t.Errorf("%s: connected to %s, want %s", tt.name, got, ln.Addr())
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1:80":        IPPreferenceIPv4,
+		"[::1]:80":            IPPreferenceIPv6,
+		"[::ffff:1.2.3.4]:80": IPPreferenceIPv4,
+		"2001:db8::1":         IPPreferenceIPv6,
+	}
+	for addr, want := range tests {
+		if got := addressFamily(addr); got != want {
+			t.Errorf("%s: got %s, want %s", addr, got, want)
+		}
+	}
+}
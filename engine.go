@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// stages of the block decision, the names DECISION_ORDER lists
+const (
+	StageBypass    = "bypass"
+	StageBlocklist = "blocklist"
+	StageSchedule  = "schedule"
+	StageReferer   = "referer"
+	StageTarpit    = "tarpit"
+)
+
+// DefaultDecisionOrder is the order in which the stages decide by default
+var DefaultDecisionOrder = []string{StageBypass, StageBlocklist, StageSchedule, StageReferer, StageTarpit}
+
+// stages are the available stages, by name
+var stages = map[string]Stage{
+	StageBypass:    bypassStage{},
+	StageBlocklist: blocklistStage{},
+	StageSchedule:  scheduleStage{},
+	StageReferer:   refererStage{},
+	StageTarpit:    tarpitStage{},
+}
+
+// verdicts of a stage
+const (
+	// VerdictContinue leaves the request to the next stages
+	VerdictContinue Verdict = iota
+	// VerdictAllow forwards the request without evaluating the next stages
+	VerdictAllow
+	// VerdictBlock stops the request, unless Request.Pass lets it through to
+	// the next stages
+	VerdictBlock
+)
+
+// DecisionForward is the action of requests no rule stops
+const DecisionForward = "forward"
+
+type (
+	Verdict int
+
+	// Stage is a step of the block decision, matching the rules of its kind
+	Stage interface {
+		Name() string
+		Decide(rules *Rules, req Request) Decision
+	}
+
+	// Stages are the stages of the block decision, in order
+	Stages []Stage
+
+	// Request is what the stages decide on
+	Request struct {
+		Target Target
+		Now    time.Time
+		// Referer is left empty unless blocking by referer is enabled
+		Referer string
+		// Pass reports whether the blocking decision lets the request through
+		// to the next stages, e.g. for the holders of an exemption. Without
+		// it every block stops the request.
+		Pass func(Decision) bool
+	}
+
+	// Decision is the outcome of a stage, or of all of them, for a request.
+	// A stage may continue with an action, such as tarpit, which the proxy
+	// applies before the next stages.
+	Decision struct {
+		Verdict  Verdict
+		Stage    string // set by Stages.Evaluate
+		Action   string
+		Rule     *Rule
+		Schedule *Schedule
+		Referer  string
+		// Exception is the exception letting the request through the
+		// stage, whose hit the proxy records
+		Exception *Rule
+		// Exceptions are those of every stage evaluated, set by Stages.Evaluate
+		Exceptions []*Rule
+	}
+)
+
+// NewStages returns the stages named by order. The stages left out are not evaluated.
+func NewStages(order []string) (Stages, error) {
+	result := make(Stages, 0, len(order))
+	seen := make(map[string]bool, len(order))
+	for _, name := range order {
+		name = strings.ToLower(strings.TrimSpace(name))
+		stage, ok := stages[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid DECISION_ORDER stage %q, expected %s", name, strings.Join(DefaultDecisionOrder, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("invalid DECISION_ORDER, stage %q given twice", name)
+		}
+		seen[name] = true
+		result = append(result, stage)
+	}
+	return result, nil
+}
+
+// Evaluate returns the first decision allowing or blocking req which
+// req.Pass does not let through, or else the first action of a stage
+// continuing with one, or else forward. Only the blocks are passed, not the
+// upgrades to https.
+func (s Stages) Evaluate(rules *Rules, req Request) Decision {
+	result := Decision{Verdict: VerdictContinue, Action: DecisionForward}
+	var exceptions []*Rule
+	for _, stage := range s {
+		d := stage.Decide(rules, req)
+		if d.Exception != nil {
+			exceptions = append(exceptions, d.Exception)
+		}
+		if d.Rule != nil {
+			d.Stage = stage.Name()
+		}
+		if d.Verdict == VerdictBlock && d.Action == ActionBlock && req.Pass != nil && req.Pass(d) {
+			continue
+		}
+		if d.Verdict != VerdictContinue {
+			d.Exceptions = exceptions
+			return d
+		}
+		if d.Rule != nil && result.Rule == nil {
+			result = d
+		}
+	}
+	result.Exceptions = exceptions
+	return result
+}
+
+// Evaluate returns what the proxy does with req under the rules. The
+// cooldown is left to the caller, as it depends on earlier requests.
+func (r *Rules) Evaluate(req Request) Decision {
+	return r.Stages.Evaluate(r, req)
+}
+
+// bypassStage allows the bypassed hosts, which leave no trace
+type bypassStage struct{}
+
+func (bypassStage) Name() string { return StageBypass }
+
+func (bypassStage) Decide(rules *Rules, req Request) Decision {
+	rule, exception := rules.Bypass.Lookup(req.Target)
+	if rule != nil {
+		return Decision{Verdict: VerdictAllow, Action: ActionBypass, Rule: rule}
+	}
+	return Decision{Exception: exception}
+}
+
+// blocklistStage blocks the blocked hosts, or upgrades them to https
+type blocklistStage struct{}
+
+func (blocklistStage) Name() string { return StageBlocklist }
+
+func (blocklistStage) Decide(rules *Rules, req Request) Decision {
+	rule, exception := rules.MatchBlock(req.Target)
+	if rule != nil {
+		return Decision{Verdict: VerdictBlock, Action: rule.Action, Rule: rule}
+	}
+	return Decision{Exception: exception}
+}
+
+// scheduleStage blocks the hosts of the active schedules
+type scheduleStage struct{}
+
+func (scheduleStage) Name() string { return StageSchedule }
+
+func (scheduleStage) Decide(rules *Rules, req Request) Decision {
+	schedule, rule, exception := rules.MatchSchedule(req.Target, req.Now)
+	if rule != nil {
+		return Decision{Verdict: VerdictBlock, Action: ActionBlock, Rule: rule, Schedule: schedule}
+	}
+	return Decision{Exception: exception}
+}
+
+// refererStage blocks the content embedded in blocked pages
+type refererStage struct{}
+
+func (refererStage) Name() string { return StageReferer }
+
+func (refererStage) Decide(rules *Rules, req Request) Decision {
+	if req.Referer == "" {
+		return Decision{}
+	}
+	rule, exception := rules.Block.LookupURL(req.Referer)
+	if rule != nil {
+		return Decision{Verdict: VerdictBlock, Action: ActionBlock, Rule: rule, Referer: req.Referer}
+	}
+	return Decision{Exception: exception}
+}
+
+// tarpitStage delays the tolerated hosts, and lets the next stages decide
+type tarpitStage struct{}
+
+func (tarpitStage) Name() string { return StageTarpit }
+
+func (tarpitStage) Decide(rules *Rules, req Request) Decision {
+	rule, exception := rules.Tarpit.Lookup(req.Target)
+	if rule != nil {
+		return Decision{Verdict: VerdictContinue, Action: ActionTarpit, Rule: rule}
+	}
+	return Decision{Exception: exception}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testRules returns rules for every stage and a request made at 10:00
+// on Monday 4 March 2024, while the work schedule is active
+func testRules(t *testing.T, order ...string) (*Rules, Request) {
+	t.Helper()
+	cfg := testConfig(t, nil)
+	cfg.BypassHosts = []string{"bank.test", "both.test"}
+	cfg.Blocklist = []string{"news.test", "both.test", "!news.test/docs", "slow.test/blocked"}
+	cfg.UpgradeHosts = []string{"plain.test"}
+	cfg.TarpitHosts = []string{"slow.test"}
+	cfg.ScheduleFile = writeSchedules(t, testSchedules)
+	if len(order) > 0 {
+		cfg.DecisionOrder = order
+	}
+	rules, err := NewRules(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules, Request{Now: time.Date(2024, 3, 4, 10, 0, 0, 0, time.Local)}
+}
+
+func TestStagesDecide(t *testing.T) {
+	rules, req := testRules(t)
+	tests := []struct {
+		stage     Stage
+		host      string
+		path      string
+		referer   string
+		verdict   Verdict
+		action    string
+		exception bool
+	}{
+		{bypassStage{}, "bank.test", "/", "", VerdictAllow, ActionBypass, false},
+		{bypassStage{}, "news.test", "/", "", VerdictContinue, "", false},
+		{blocklistStage{}, "news.test", "/", "", VerdictBlock, ActionBlock, false},
+		{blocklistStage{}, "news.test", "/docs", "", VerdictContinue, "", true},
+		{blocklistStage{}, "plain.test", "/", "", VerdictBlock, ActionUpgrade, false},
+		{blocklistStage{}, "chat.test", "/", "", VerdictContinue, "", false},
+		{scheduleStage{}, "chat.test", "/", "", VerdictBlock, ActionBlock, false},
+		{scheduleStage{}, "docs.test", "/", "", VerdictContinue, "", false},
+		{refererStage{}, "cdn.test", "/", "http://news.test/", VerdictBlock, ActionBlock, false},
+		{refererStage{}, "cdn.test", "/", "", VerdictContinue, "", false},
+		{refererStage{}, "cdn.test", "/", "http://docs.test/", VerdictContinue, "", false},
+		{tarpitStage{}, "slow.test", "/", "", VerdictContinue, ActionTarpit, false},
+		{tarpitStage{}, "news.test", "/", "", VerdictContinue, "", false},
+	}
+	for _, tt := range tests {
+		req.Target = Target{Scheme: "http", Host: tt.host, Path: tt.path}
+		req.Referer = tt.referer
+		d := tt.stage.Decide(rules, req)
+		if d.Verdict != tt.verdict || d.Action != tt.action || (d.Exception != nil) != tt.exception {
+			t.Errorf("%s %s%s: got %+v, want verdict %d, action %q", tt.stage.Name(), tt.host, tt.path, d, tt.verdict, tt.action)
+		}
+		// a stage never sets its own name, Stages.Evaluate does
+		if d.Stage != "" {
+			t.Errorf("%s: got stage %q", tt.stage.Name(), d.Stage)
+		}
+	}
+	req.Target, req.Referer = Target{Scheme: "http", Host: "chat.test", Path: "/"}, ""
+	if d := (scheduleStage{}).Decide(rules, req); d.Schedule == nil || d.Schedule.Name != "work" {
+		t.Errorf("got %+v, want chat.test blocked by the work schedule", d)
+	}
+}
+
+func TestStagesOrder(t *testing.T) {
+	at := func(host, path string) Target { return Target{Scheme: "http", Host: host, Path: path} }
+	tests := []struct {
+		name   string
+		order  []string
+		target Target
+		stage  string
+		action string
+	}{
+		{"bypass first", nil, at("both.test", "/"), StageBypass, ActionBypass},
+		{"blocklist first", []string{StageBlocklist, StageBypass}, at("both.test", "/"), StageBlocklist, ActionBlock},
+		// a continuing stage does not prevent the next ones from blocking
+		{"tarpit then block", []string{StageTarpit, StageBlocklist}, at("slow.test", "/blocked"), StageBlocklist, ActionBlock},
+		{"tarpit alone", nil, at("slow.test", "/"), StageTarpit, ActionTarpit},
+		{"stage left out", []string{StageBypass, StageTarpit}, at("news.test", "/"), "", DecisionForward},
+		{"nothing matches", nil, at("docs.test", "/"), "", DecisionForward},
+	}
+	for _, tt := range tests {
+		rules, _ := testRules(t, tt.order...)
+		d := rules.Evaluate(Request{Target: tt.target, Now: time.Date(2024, 3, 4, 10, 0, 0, 0, time.Local)})
+		if d.Stage != tt.stage || d.Action != tt.action {
+			t.Errorf("%s: got stage %q and action %q, want %q and %q", tt.name, d.Stage, d.Action, tt.stage, tt.action)
+		}
+	}
+}
+
+func TestStagesPass(t *testing.T) {
+	rules, req := testRules(t, StageBlocklist, StageBypass, StageTarpit)
+	var passed []string
+	req.Pass = func(d Decision) bool {
+		passed = append(passed, d.Stage)
+		return true
+	}
+	// a passed block leaves the request to the next stages
+	req.Target = Target{Scheme: "http", Host: "both.test", Path: "/"}
+	if d := rules.Evaluate(req); d.Stage != StageBypass || len(passed) != 1 || passed[0] != StageBlocklist {
+		t.Errorf("got %+v after passing %v, want the bypass after the passed block", d, passed)
+	}
+	// upgrades are not passed
+	passed = nil
+	req.Target = Target{Scheme: "http", Host: "plain.test", Path: "/"}
+	if d := rules.Evaluate(req); d.Action != ActionUpgrade || len(passed) != 0 {
+		t.Errorf("got %+v after passing %v, want the upgrade", d, passed)
+	}
+	// the exceptions of every stage are returned, whatever the decision
+	req.Target = Target{Scheme: "http", Host: "news.test", Path: "/docs"}
+	if d := rules.Evaluate(req); d.Action != DecisionForward || len(d.Exceptions) != 1 {
+		t.Errorf("got %+v, want the exception of the blocklist", d)
+	}
+	req.Pass = func(Decision) bool { return false }
+	req.Target = Target{Scheme: "http", Host: "both.test", Path: "/"}
+	if d := rules.Evaluate(req); d.Stage != StageBlocklist || d.Verdict != VerdictBlock {
+		t.Errorf("got %+v, want the block", d)
+	}
+}
+
+func TestNewStages(t *testing.T) {
+	s, err := NewStages([]string{" Blocklist ", "TARPIT"})
+	if err != nil || len(s) != 2 || s[0].Name() != StageBlocklist || s[1].Name() != StageTarpit {
+		t.Errorf("got %v, %v, want blocklist then tarpit", s, err)
+	}
+	for _, order := range [][]string{{"blocklist", "firewall"}, {"blocklist", "bypass", "Blocklist"}} {
+		if _, err := NewStages(order); err == nil {
+			t.Errorf("%v: got no error", order)
+		}
+	}
+	if s, err := NewStages(DefaultDecisionOrder); err != nil || len(s) != len(stages) {
+		t.Errorf("got %d stages, %v, want every stage by default", len(s), err)
+	}
+}
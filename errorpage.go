@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//go:embed templates
+var templatesFS embed.FS
+
+// upstream failure categories
+const (
+	categoryBadGateway       = "bad_gateway"
+	categoryTimeout          = "timeout"
+	categoryResponseTooLarge = "response_too_large"
+	categoryTruncated        = "truncated"
+	categoryRejected         = "rejected"
+)
+
+type (
+	// ErrorPage renders the response sent when the upstream cannot be fetched
+	ErrorPage struct {
+		tmpl    *template.Template
+		locales *Locales
+	}
+
+	upstreamError struct {
+		Locale     `json:"-"`
+		Status     int    `json:"status"`
+		StatusText string `json:"error"`
+		Category   string `json:"category"`
+		Host       string `json:"host"`
+	}
+)
+
+// NewErrorPage loads the template at path, or the embedded one when path is
+// empty, rendered in the language picked by locales
+func NewErrorPage(path string, locales *Locales) (*ErrorPage, error) {
+	var tmpl *template.Template
+	var err error
+	if path == "" {
+		tmpl, err = template.ParseFS(templatesFS, "templates/upstream_error.html")
+	} else {
+		tmpl, err = template.ParseFiles(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ErrorPage{tmpl: tmpl, locales: locales}, nil
+}
+
+// Serve responds with 504 when err is a timeout and 502 otherwise, as JSON if the client prefers it
+func (p *ErrorPage) Serve(w http.ResponseWriter, r *http.Request, host string, err error) {
+	markLocalResponse(r)
+	data := upstreamError{Locale: p.locales.For(r), Status: http.StatusBadGateway, Category: categoryBadGateway, Host: host}
+	switch {
+	case isTimeout(err):
+		data.Status, data.Category = http.StatusGatewayTimeout, categoryTimeout
+	case errors.Is(err, errResponseTooLarge):
+		data.Category = categoryResponseTooLarge
+	case errors.Is(err, errBodyTruncated):
+		data.Category = categoryTruncated
+	case errors.As(err, new(*vetoError)):
+		data.Category = categoryRejected
+	}
+	data.StatusText = http.StatusText(data.Status)
+
+	if preferredType(r, "application/json", "text/html") == "application/json" {
+		writeJSON(w, data.Status, data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(data.Status)
+	if err := p.tmpl.Execute(w, data); err != nil {
+		proxyLog.WithField("event", "render error page").Warn(err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// preferredType returns the first of mediaTypes listed in the Accept header, or an empty string
+func preferredType(r *http.Request, mediaTypes ...string) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		for _, t := range mediaTypes {
+			if mediaType == t {
+				return t
+			}
+		}
+	}
+	return ""
+}
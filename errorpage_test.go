@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestErrorPageOnUpstreamFailures(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/slow", testutil.Route{Latency: time.Second})
+	down := testutil.NewUpstream(t)
+	down.Close()
+
+	tests := []struct {
+		name     string
+		upstream *testutil.Upstream
+		path     string
+		status   int
+		category string
+	}{
+		{"unreachable", down, "/", http.StatusBadGateway, categoryBadGateway},
+		{"timeout", upstream, "/slow", http.StatusGatewayTimeout, categoryTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.upstream)
+			cfg.UpstreamTimeout = 50 * time.Millisecond
+			proxy, _ := startProxy(t, cfg)
+
+			resp, body := get(t, proxy.Client, "http://news.test"+tt.path)
+			if resp.StatusCode != tt.status || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+				t.Errorf("got %d %s, want %d text/html", resp.StatusCode, resp.Header.Get("Content-Type"), tt.status)
+			}
+			if !strings.Contains(body, "news.test") {
+				t.Errorf("page %q does not name the host", body)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "http://news.test"+tt.path, nil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := proxy.Client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var got upstreamError
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			want := upstreamError{Status: tt.status, StatusText: http.StatusText(tt.status), Category: tt.category, Host: "news.test"}
+			if resp.StatusCode != tt.status || got != want {
+				t.Errorf("got %d %+v, want %+v", resp.StatusCode, got, want)
+			}
+		})
+	}
+}
+
+func TestErrorPageTemplate(t *testing.T) {
+	down := testutil.NewUpstream(t)
+	down.Close()
+	path := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(path, []byte("custom {{.Status}} {{.Category}} {{.Host}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, down)
+	cfg.ErrorPageTemplate = path
+	proxy, _ := startProxy(t, cfg)
+
+	_, body := get(t, proxy.Client, "http://news.test/")
+	if body != "custom 502 bad_gateway news.test" {
+		t.Errorf("got %q, want the custom template", body)
+	}
+}
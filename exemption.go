@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/token"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// exemptionCookie carries the token on the exempted host, set once the
+	// token is redeemed through the exemptionParam query parameter
+	exemptionCookie = "procrastiproxy_exemption"
+	exemptionParam  = "procrastiproxy_exemption"
+	// ExemptionHeader carries the token for clients which can set headers
+	ExemptionHeader = "X-Procrastiproxy-Exemption"
+)
+
+type (
+	// Exemptions let a client through the blocks of a host with a signed token
+	// minted by the admin endpoint
+	Exemptions struct {
+		keys *token.Keyring
+		now  func() time.Time
+	}
+
+	exemptionRequest struct {
+		Host     string `json:"host"`
+		Client   string `json:"client"`
+		Duration string `json:"duration"`
+	}
+)
+
+// NewExemptions signs with EXEMPTION_SECRET, or with the key of
+// EXEMPTION_KEY_FILE created on first use, or with a key lasting until restart
+func NewExemptions(cfg *Config) (*Exemptions, error) {
+	var previous [][]byte
+	for _, secret := range cfg.ExemptionPreviousSecrets {
+		previous = append(previous, []byte(secret))
+	}
+	var key []byte
+	var err error
+	switch {
+	case cfg.ExemptionSecret != "":
+		key = []byte(cfg.ExemptionSecret)
+	case cfg.ExemptionKeyFile != "":
+		if key, err = loadOrCreateKey(cfg.ExemptionKeyFile); err != nil {
+			return nil, err
+		}
+	default:
+		if key, err = token.NewKey(); err != nil {
+			return nil, err
+		}
+	}
+	keys := token.NewKeyring(key, previous...)
+	keys.Skew = cfg.ExemptionSkew
+	keys.Now = cfg.clock()
+	return &Exemptions{keys: keys, now: cfg.clock()}, nil
+}
+
+// loadOrCreateKey reads the base64 key at path, generating it if missing
+func loadOrCreateKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := token.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n")); err != nil {
+		return nil, err
+	}
+	log.WithField("path", path).Info("exemption key created")
+	return key, nil
+}
+
+// Mint returns a token exempting client, or any client when empty, from the
+// blocks of host and its subdomains for d
+func (e *Exemptions) Mint(host, client string, d time.Duration) (string, time.Time, error) {
+	expires := e.now().Add(d).Truncate(time.Second)
+	t, err := e.keys.Mint(token.Claims{Host: normalizeHost(host), Client: client, Expires: expires})
+	return t, expires, err
+}
+
+// exempted reports whether r carries a valid token for host and client,
+// returning it when it came from the query parameter and must be redeemed
+func (e *Exemptions) exempted(r *http.Request, host, client string, logger *log.Entry) (bool, string) {
+	candidates := []string{r.Header.Get(ExemptionHeader)}
+	if c, err := r.Cookie(exemptionCookie); err == nil {
+		candidates = append(candidates, c.Value)
+	}
+	redeem := r.URL.Query().Get(exemptionParam)
+	candidates = append(candidates, redeem)
+	for _, t := range candidates {
+		if t == "" {
+			continue
+		}
+		claims, err := e.keys.Verify(t, host, client)
+		if err != nil {
+			logger.WithField("error", err.Error()).Info("exemption token rejected")
+			continue
+		}
+		logger.WithFields(log.Fields{"exempted_host": claims.Host, "expires": claims.Expires}).Debug("blocked request exempted")
+		if t == redeem {
+			return true, t
+		}
+		return true, ""
+	}
+	return false, ""
+}
+
+// redeemExemption stores the token of the query parameter in a cookie of the
+// host and redirects to the URL without it
+func redeemExemption(w http.ResponseWriter, r *http.Request, t string) {
+	http.SetCookie(w, &http.Cookie{Name: exemptionCookie, Value: t, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	u := *r.URL
+	query := u.Query()
+	query.Del(exemptionParam)
+	u.RawQuery = query.Encode()
+	markLocalResponse(r)
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// stripExemption keeps the tokens from reaching the upstream, whether they
+// come in the header, the cookie or the query parameter of r
+func stripExemption(r *http.Request) {
+	if r.URL.RawQuery != "" {
+		r.URL.RawQuery = withoutParam(r.URL.RawQuery, exemptionParam)
+	}
+	h := r.Header
+	h.Del(ExemptionHeader)
+	cookies := h.Values("Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	h.Del("Cookie")
+	for _, line := range cookies {
+		var kept []string
+		for _, pair := range strings.Split(line, ";") {
+			if name, _, _ := strings.Cut(strings.TrimSpace(pair), "="); name != exemptionCookie {
+				kept = append(kept, strings.TrimSpace(pair))
+			}
+		}
+		if len(kept) > 0 {
+			h.Add("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
+
+// withoutParam removes the parameter name from the raw query, keeping the
+// others as they are written
+func withoutParam(rawQuery, name string) string {
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
+
+// exemptionsHandler mints tokens from a POST of {"host", "client", "duration"}
+func exemptionsHandler(exemptions *Exemptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req exemptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.Host == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing host"})
+			return
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration " + strconv.Quote(req.Duration)})
+			return
+		}
+		t, expires, err := exemptions.Mint(req.Host, req.Client, d)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		adminLog.WithFields(log.Fields{"host": req.Host, "client": req.Client, "expires": expires}).Info("exemption minted")
+		redeem := url.URL{Scheme: "http", Host: req.Host, Path: "/", RawQuery: url.Values{exemptionParam: {t}}.Encode()}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"token":      t,
+			"expires":    expires,
+			"redeem_url": redeem.String(),
+		})
+	}
+}
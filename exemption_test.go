@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestMintExemptionRequiresAdmin(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	mint := func(client *http.Client) (int, map[string]interface{}) {
+		resp, err := client.Post(proxy.URL+"/admin/exemptions", "application/json", strings.NewReader(`{"host": "news.test", "duration": "1h"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var got map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got
+	}
+
+	// a client of the proxy cannot let itself through its blocks
+	if status, got := mint(http.DefaultClient); status != http.StatusUnauthorized || got["token"] != nil {
+		t.Errorf("got %d %v without the admin token, want 401", status, got)
+	}
+	status, got := mint(admin)
+	token, _ := got["token"].(string)
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("got %d %v with the admin token, want a token", status, got)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+	req.Header.Set(ExemptionHeader, token)
+	resp, err := proxy.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d with the minted token, want 200", resp.StatusCode)
+	}
+}
+
+func TestMintExemptionWithoutAdminToken(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.AdminToken = ""
+	proxy, _ := startProxy(t, cfg)
+	// the listener serves the proxy as well, so no one is trusted as an admin
+	resp, err := http.Post(proxy.URL+"/admin/exemptions", "application/json", strings.NewReader(`{"host": "news.test", "duration": "1h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestExemptionNotForwarded(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+
+	// docs.test is not blocked, so the token is not redeemed
+	req, _ := http.NewRequest(http.MethodGet, "http://docs.test/?a=1&"+exemptionParam+"=t0ken&b=%20&"+exemptionParam+"=again", nil)
+	req.Header.Set(ExemptionHeader, "t0ken")
+	req.Header.Set("Cookie", "session=1; "+exemptionCookie+"=t0ken")
+	resp, err := proxy.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+	got := upstream.Requests()[0]
+	if got.Query != "a=1&b=%20" {
+		t.Errorf("got query %q, want the others kept as they were", got.Query)
+	}
+	if got.Header.Get(ExemptionHeader) != "" || got.Header.Get("Cookie") != "session=1" {
+		t.Errorf("got %s %q and Cookie %q, want the token stripped", ExemptionHeader, got.Header.Get(ExemptionHeader), got.Header.Get("Cookie"))
+	}
+}
+
+func TestWithoutParam(t *testing.T) {
+	tests := map[string]string{
+		"a=1":               "a=1",
+		"p=1":               "",
+		"a=1&p=2&b=3":       "a=1&b=3",
+		"%70=1&b":           "b",
+		"a=%26p%3D1&pp=2&p": "a=%26p%3D1&pp=2",
+		"a=1&&p=2":          "a=1&",
+	}
+	for raw, want := range tests {
+		if got := withoutParam(raw, "p"); got != want {
+			t.Errorf("%q: got %q, want %q", raw, got, want)
+		}
+	}
+}
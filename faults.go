@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// injected faults, as reported in the X-Injected-Fault header and the access log
+const (
+	FaultError    = "error"
+	FaultLatency  = "latency"
+	FaultTruncate = "truncate"
+	FaultDrop     = "drop"
+
+	faultHeader = "X-Injected-Fault"
+)
+
+var errTruncated = errors.New("injected fault: response truncated")
+
+type (
+	// Faults injects failures into proxied requests, for developing clients
+	// against a flaky network. Only the first entry matching a request applies.
+	Faults struct {
+		mu      sync.Mutex
+		rand    *rand.Rand
+		entries []FaultEntry
+		hosts   []*Blocklist
+	}
+
+	faultsFile struct {
+		Faults []FaultEntry `json:"faults" yaml:"faults"`
+	}
+
+	// FaultEntry sets the probabilities of each fault for the matching hosts
+	FaultEntry struct {
+		Hosts        []string `json:"hosts" yaml:"hosts"`
+		ErrorRate    float64  `json:"error_rate,omitempty" yaml:"error_rate"`
+		Latency      string   `json:"latency,omitempty" yaml:"latency"`
+		Jitter       string   `json:"jitter,omitempty" yaml:"jitter"`
+		TruncateRate float64  `json:"truncate_rate,omitempty" yaml:"truncate_rate"`
+		DropRate     float64  `json:"drop_rate,omitempty" yaml:"drop_rate"`
+
+		latency, jitter time.Duration
+	}
+
+	// truncatingWriter cuts the connection once limit body bytes were written
+	truncatingWriter struct {
+		http.ResponseWriter
+		limit int
+		cut   bool
+	}
+)
+
+// NewFaults creates a fault injector whose randomness comes from seed, so
+// that a run can be replayed
+func NewFaults(seed int64) *Faults {
+	return &Faults{rand: rand.New(rand.NewSource(seed))}
+}
+
+// LoadFaults reads a YAML or JSON fault file such as:
+//
+//	faults:
+//	  - hosts: [api.example.com]
+//	    error_rate: 0.1
+//	    latency: 200ms
+//	    jitter: 100ms
+//	    truncate_rate: 0.05
+//	    drop_rate: 0.01
+func (f *Faults) LoadFaults(path string) error {
+	var file faultsFile
+	if err := decodeFile(path, &file); err != nil {
+		return err
+	}
+	if err := f.Set(file.Faults); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Set validates and replaces the fault entries
+func (f *Faults) Set(entries []FaultEntry) error {
+	hosts := make([]*Blocklist, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		if len(e.Hosts) == 0 {
+			return fmt.Errorf("fault %d: no hosts", i+1)
+		}
+		if err := checkPatterns(e.Hosts); err != nil {
+			return fmt.Errorf("fault %d: %w", i+1, err)
+		}
+		for name, rate := range map[string]float64{"error_rate": e.ErrorRate, "truncate_rate": e.TruncateRate, "drop_rate": e.DropRate} {
+			if rate < 0 || rate > 1 {
+				return fmt.Errorf("fault %d: %s %v is not between 0 and 1", i+1, name, rate)
+			}
+		}
+		var err error
+		if e.latency, err = parseFaultDuration(e.Latency); err != nil {
+			return fmt.Errorf("fault %d: latency: %w", i+1, err)
+		}
+		if e.jitter, err = parseFaultDuration(e.Jitter); err != nil {
+			return fmt.Errorf("fault %d: jitter: %w", i+1, err)
+		}
+		hosts[i] = NewBlocklist("fault", "faults", e.Hosts)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries, f.hosts = entries, hosts
+	return nil
+}
+
+func parseFaultDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration %s", s)
+	}
+	return d, err
+}
+
+func (f *Faults) Entries() []FaultEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FaultEntry(nil), f.entries...)
+}
+
+// roll picks the faults to inject for t: added latency, then at most one of
+// drop, error or truncate, truncating after a random number of bytes
+func (f *Faults) roll(t Target) (latency time.Duration, fault string, truncateAt int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, hosts := range f.hosts {
+		if hosts.Match(t) == nil {
+			continue
+		}
+		e := f.entries[i]
+		latency = e.latency
+		if e.jitter > 0 {
+			latency += time.Duration(f.rand.Int63n(int64(e.jitter)))
+		}
+		switch p := f.rand.Float64(); {
+		case p < e.DropRate:
+			fault = FaultDrop
+		case p < e.DropRate+e.ErrorRate:
+			fault = FaultError
+		case p < e.DropRate+e.ErrorRate+e.TruncateRate:
+			fault = FaultTruncate
+			truncateAt = f.rand.Intn(4096)
+		}
+		return latency, fault, truncateAt
+	}
+	return 0, "", 0
+}
+
+// Middleware injects the faults into the requests handled by next
+func (f *Faults) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		latency, fault, truncateAt := f.roll(RequestTarget(r))
+		var injected []string
+		if latency > 0 {
+			injected = append(injected, FaultLatency)
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault != "" {
+			injected = append(injected, fault)
+		}
+		if len(injected) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		annotateAccessLog(r, log.Fields{"fault": injected, "fault_latency_ns": latency.Nanoseconds()})
+		for _, name := range injected {
+			w.Header().Add(faultHeader, name)
+		}
+
+		switch fault {
+		case FaultDrop:
+			hijacker, ok := w.(http.Hijacker)
+			if !ok {
+				http.Error(w, "injected fault: dropped connection", http.StatusInternalServerError)
+				return
+			}
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+			}
+		case FaultError:
+			http.Error(w, "injected fault", http.StatusInternalServerError)
+		case FaultTruncate:
+			next.ServeHTTP(&truncatingWriter{ResponseWriter: w, limit: truncateAt}, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (w *truncatingWriter) Write(b []byte) (int, error) {
+	if w.cut {
+		return 0, errTruncated
+	}
+	if len(b) <= w.limit {
+		w.limit -= len(b)
+		return w.ResponseWriter.Write(b)
+	}
+	n, err := w.ResponseWriter.Write(b[:w.limit])
+	w.cut = true
+	// hijacking flushes what was written before the connection is closed
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+	if err == nil {
+		err = errTruncated
+	}
+	return n, err
+}
+
+// faultsHandler lists the fault entries, PUT replacing them and DELETE removing them
+func faultsHandler(faults *Faults) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var file faultsFile
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&file); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := faults.Set(file.Faults); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			adminLog.WithField("entries", len(file.Faults)).Info("faults changed")
+		case http.MethodDelete:
+			faults.Set(nil)
+			adminLog.Info("faults removed")
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, faultsFile{Faults: faults.Entries()})
+	}
+}
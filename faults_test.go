@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestFaultsReplayedFromSeed(t *testing.T) {
+	entries := []FaultEntry{{Hosts: []string{"news.test"}, ErrorRate: 0.3, DropRate: 0.1, TruncateRate: 0.2, Latency: "10ms", Jitter: "5ms"}}
+	rolls := func(seed int64) []string {
+		f := NewFaults(seed)
+		if err := f.Set(append([]FaultEntry(nil), entries...)); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := 0; i < 50; i++ {
+			latency, fault, truncateAt := f.roll(Target{Scheme: "http", Host: "news.test", Path: "/"})
+			if latency < 10*time.Millisecond || latency >= 15*time.Millisecond {
+				t.Errorf("latency %s out of 10ms+5ms", latency)
+			}
+			got = append(got, fault+" "+latency.String()+" "+string(rune('0'+truncateAt%10)))
+		}
+		return got
+	}
+	first := rolls(42)
+	if again := rolls(42); !reflect.DeepEqual(first, again) {
+		t.Error("the same seed rolled different faults")
+	}
+	if other := rolls(43); reflect.DeepEqual(first, other) {
+		t.Error("another seed rolled the same faults")
+	}
+	counts := make(map[string]int)
+	for _, roll := range first {
+		counts[strings.Fields(roll)[0]]++
+	}
+	for _, fault := range []string{FaultError, FaultDrop, FaultTruncate} {
+		if counts[fault] == 0 {
+			t.Errorf("no %s fault in 50 rolls", fault)
+		}
+	}
+
+	f := NewFaults(1)
+	f.Set(entries)
+	if latency, fault, _ := f.roll(Target{Scheme: "http", Host: "docs.test", Path: "/"}); latency != 0 || fault != "" {
+		t.Errorf("got %s %q for a host without faults", latency, fault)
+	}
+}
+
+func TestFaultsSetValidates(t *testing.T) {
+	tests := map[string]FaultEntry{
+		"no hosts":        {ErrorRate: 0.5},
+		"invalid host":    {Hosts: []string{"/path"}},
+		"rate above one":  {Hosts: []string{"a.test"}, ErrorRate: 1.5},
+		"negative rate":   {Hosts: []string{"a.test"}, DropRate: -0.1},
+		"invalid latency": {Hosts: []string{"a.test"}, Latency: "soon"},
+		"negative jitter": {Hosts: []string{"a.test"}, Jitter: "-1s"},
+	}
+	for name, entry := range tests {
+		f := NewFaults(1)
+		if err := f.Set([]FaultEntry{entry}); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+		if len(f.Entries()) != 0 {
+			t.Errorf("%s: entries set despite the error", name)
+		}
+	}
+}
+
+func TestFaultsInjected(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	cfg := testConfig(t, upstream)
+	cfg.EnableFaults = true
+	cfg.FaultsSeed = 1
+	proxy, _ := startProxy(t, cfg)
+	faults := func(method, body string) int {
+		req, _ := http.NewRequest(method, proxy.URL+"/admin/faults", strings.NewReader(body))
+		resp, err := admin.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := faults(http.MethodPut, `{"faults": [{"hosts": ["news.test"], "error_rate": 1}]}`); status != http.StatusOK {
+		t.Fatalf("got %d setting the faults, want 200", status)
+	}
+	resp, _ := get(t, proxy.Client, "http://news.test/")
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get(faultHeader) != FaultError {
+		t.Errorf("got %d with %s %q, want an injected 500", resp.StatusCode, faultHeader, resp.Header.Get(faultHeader))
+	}
+	if resp, body := get(t, proxy.Client, "http://docs.test/"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("got %d %q for a host without faults, want the upstream response", resp.StatusCode, body)
+	}
+
+	if status := faults(http.MethodPut, `{"faults": [{"hosts": ["news.test"], "drop_rate": 1}]}`); status != http.StatusOK {
+		t.Fatalf("got %d setting the faults, want 200", status)
+	}
+	if resp, err := proxy.Client.Get("http://news.test/"); err == nil {
+		resp.Body.Close()
+		t.Errorf("got %d, want the connection dropped", resp.StatusCode)
+	}
+
+	if status := faults(http.MethodPut, `{"faults": [{"hosts": ["news.test"], "error_rat": 1}]}`); status != http.StatusBadRequest {
+		t.Errorf("got %d for an unknown field, want 400", status)
+	}
+	if status := faults(http.MethodDelete, ""); status != http.StatusOK {
+		t.Fatalf("got %d removing the faults, want 200", status)
+	}
+	if resp, _ := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d once the faults are removed, want 200", resp.StatusCode)
+	}
+}
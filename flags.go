@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// feature flags toggling optional behaviour at runtime
+const (
+	FlagAccessLog      = "access_log"
+	FlagBlockByReferer = "block_by_referer"
+	FlagSiteBudget     = "site_budget"
+	FlagTarpit         = "tarpit"
+)
+
+// Flags is the registry of feature flags. The set of flags is fixed once
+// created, only their values change, so that lookups need no lock.
+type Flags struct {
+	flags map[string]*atomic.Bool
+}
+
+func NewFlags(initial map[string]bool) *Flags {
+	f := &Flags{flags: make(map[string]*atomic.Bool, len(initial))}
+	for name, enabled := range initial {
+		v := &atomic.Bool{}
+		v.Store(enabled)
+		f.flags[name] = v
+	}
+	return f
+}
+
+// Enabled reports whether the flag is on, unknown flags being off
+func (f *Flags) Enabled(name string) bool {
+	v, ok := f.flags[name]
+	return ok && v.Load()
+}
+
+// Set changes the given flags, none of them when one is unknown
+func (f *Flags) Set(values map[string]bool) error {
+	var unknown []string
+	for name := range values {
+		if _, ok := f.flags[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &unknownFlagsError{names: unknown}
+	}
+	for name, enabled := range values {
+		f.flags[name].Store(enabled)
+	}
+	return nil
+}
+
+func (f *Flags) All() map[string]bool {
+	all := make(map[string]bool, len(f.flags))
+	for name, v := range f.flags {
+		all[name] = v.Load()
+	}
+	return all
+}
+
+type unknownFlagsError struct {
+	names []string
+}
+
+func (e *unknownFlagsError) Error() string {
+	return "unknown feature flags: " + strings.Join(e.names, ", ")
+}
+
+// flagsHandler lists the flags, a POST of {"name": bool, ...} toggling them
+func flagsHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var values map[string]bool
+			if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := flags.Set(values); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			adminLog.WithField("flags", values).Info("feature flags changed")
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, flags.All())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestFlagsSetIsAllOrNothing(t *testing.T) {
+	f := NewFlags(map[string]bool{FlagTarpit: true, FlagAccessLog: true})
+	err := f.Set(map[string]bool{FlagTarpit: false, "zeta": true, "alpha": true})
+	if err == nil || err.Error() != "unknown feature flags: alpha, zeta" {
+		t.Errorf("got %v, want the unknown flags sorted", err)
+	}
+	if !f.Enabled(FlagTarpit) {
+		t.Error("a known flag changed along with unknown ones")
+	}
+	if f.Enabled("zeta") {
+		t.Error("an unknown flag is enabled")
+	}
+	if err := f.Set(map[string]bool{FlagTarpit: false}); err != nil || f.Enabled(FlagTarpit) {
+		t.Errorf("got %v, %t, want the flag disabled", err, f.Enabled(FlagTarpit))
+	}
+}
+
+func TestToggleFlagsAtRuntime(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+	post := func(body string) (int, map[string]interface{}) {
+		resp, err := admin.Post(proxy.URL+"/admin/flags", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var got map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got
+	}
+
+	if status, got := post(`{"access_log": false, "nope": true}`); status != http.StatusBadRequest || got["error"] != "unknown feature flags: nope" {
+		t.Errorf("got %d %v, want 400 naming the unknown flag", status, got)
+	}
+	status, got := post(`{"access_log": false}`)
+	want := map[string]interface{}{FlagAccessLog: false, FlagBlockByReferer: false, FlagSiteBudget: true, FlagTarpit: true}
+	if status != http.StatusOK || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d %v, want %v", status, got, want)
+	}
+
+	logs.Reset()
+	get(t, proxy.Client, "http://news.test/")
+	post(`{"access_log": true}`)
+	get(t, proxy.Client, "http://news.test/")
+	// the request before the flag was enabled again is not logged
+	var uris []string
+	for _, e := range logs.Wait(t, "request completed", 2) {
+		uris = append(uris, e.Data["uri"].(string))
+	}
+	sort.Strings(uris)
+	if want := []string{"/admin/flags", "http://news.test/"}; !reflect.DeepEqual(uris, want) {
+		t.Errorf("got entries for %v, want %v", uris, want)
+	}
+}
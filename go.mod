@@ -2,6 +2,10 @@ module github.com/Jasstkn/procrastiproxy
 
 go 1.19
 
-require github.com/sirupsen/logrus v1.9.0
+require (
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/sirupsen/logrus v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+require golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Health tracks whether the proxy should receive new traffic
+type Health struct {
+	draining    atomic.Bool
+	shedding    atomic.Bool
+	maintenance atomic.Pointer[Maintenance]
+}
+
+// Drain marks the proxy as not ready, requests keep being served
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+func (h *Health) Ready() bool {
+	return !h.draining.Load() && !h.Shedding() && h.Maintenance() == nil
+}
+
+// Shedding reports whether proxy requests are refused to relieve memory pressure
+func (h *Health) Shedding() bool {
+	return h.shedding.Load()
+}
+
+func (h *Health) Shed(shedding bool) {
+	h.shedding.Store(shedding)
+}
+
+// Maintenance returns the ongoing maintenance, or nil
+func (h *Health) Maintenance() *Maintenance {
+	return h.maintenance.Load()
+}
+
+func (h *Health) StartMaintenance(m *Maintenance) {
+	h.maintenance.Store(m)
+}
+
+func (h *Health) StopMaintenance() {
+	h.maintenance.Store(nil)
+}
+
+// readyzHandler reports 503 once draining so that load balancers stop sending traffic
+func readyzHandler(h *Health) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Maintenance() != nil {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if h.Shedding() {
+			http.Error(w, "shedding load", http.StatusServiceUnavailable)
+			return
+		}
+		if !h.Ready() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ready\n"))
+	}
+}
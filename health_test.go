@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDrain(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+
+	if resp, body := get(t, http.DefaultClient, proxy.URL+"/readyz"); resp.StatusCode != http.StatusOK || body != "ready\n" {
+		t.Errorf("got %d %q before draining, want 200", resp.StatusCode, body)
+	}
+	if resp, _ := get(t, admin, proxy.URL+"/admin/drain"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got %d for GET /admin/drain, want 405", resp.StatusCode)
+	}
+	resp, err := admin.Post(proxy.URL+"/admin/drain", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d for POST /admin/drain, want 200", resp.StatusCode)
+	}
+
+	if resp, body := get(t, http.DefaultClient, proxy.URL+"/readyz"); resp.StatusCode != http.StatusServiceUnavailable || !strings.HasPrefix(body, "draining") {
+		t.Errorf("got %d %q while draining, want 503", resp.StatusCode, body)
+	}
+	// requests keep being served until the process stops
+	if resp, _ := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d for a proxied request while draining, want 200", resp.StatusCode)
+	}
+}
+
+func TestForcedShed(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	proxy, s := startProxy(t, testConfig(t, upstream))
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	s.health.Shed(true)
+	resp, _ := get(t, proxy.Client, "http://news.test/")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q while shedding, want 503", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if n := len(upstream.Requests()); n != 0 {
+		t.Errorf("the upstream got %d requests while shedding", n)
+	}
+	if e := logs.Wait(t, "request completed", 1); e[0].Data["shed"] != true {
+		t.Errorf("got %v, want the access log entry marked as shed", e[0].Data)
+	}
+	if resp, body := get(t, http.DefaultClient, proxy.URL+"/readyz"); resp.StatusCode != http.StatusServiceUnavailable || body != "shedding load\n" {
+		t.Errorf("got %d %q from /readyz, want 503", resp.StatusCode, body)
+	}
+	// the admin endpoints are still served
+	resp, body := get(t, admin, proxy.URL+"/admin/stats")
+	var stats struct {
+		Shed     int64 `json:"shed"`
+		Shedding bool  `json:"shedding"`
+	}
+	json.Unmarshal([]byte(body), &stats)
+	if resp.StatusCode != http.StatusOK || stats.Shed != 1 || !stats.Shedding {
+		t.Errorf("got %d %+v, want one request shed", resp.StatusCode, stats)
+	}
+
+	s.health.Shed(false)
+	if resp, _ := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d once shedding stopped, want 200", resp.StatusCode)
+	}
+}
+
+func TestWatchMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := &Health{}
+	go watchMemory(ctx, h, 1, time.Millisecond)
+	eventually(t, h.Shedding, "shedding over a threshold of one byte")
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go watchMemory(ctx, h, math.MaxUint64, time.Millisecond)
+	eventually(t, func() bool { return !h.Shedding() }, "recovered under the largest threshold")
+}
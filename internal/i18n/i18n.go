@@ -0,0 +1,169 @@
+// Package i18n translates the pages served by the proxy, picking the
+// language from the Accept-Language header of the request.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fallback is the language of the messages used when a translation lacks them
+const Fallback = "en"
+
+//go:embed translations/*.json
+var bundled embed.FS
+
+// Catalog holds the messages of every language, keyed by lowercase language tag
+type Catalog struct {
+	languages map[string]map[string]string
+	// OnMissing is called once per language and key missing a translation
+	OnMissing func(lang, key string)
+	reported  sync.Map
+}
+
+// NewCatalog returns the bundled translations, overridden and extended by
+// the <lang>.json files of dir unless it is empty
+func NewCatalog(dir string) (*Catalog, error) {
+	c := &Catalog{languages: make(map[string]map[string]string)}
+	if err := c.load(bundled, "translations"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := c.load(os.DirFS(dir), "."); err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Catalog) load(fsys fs.FS, dir string) error {
+	paths, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(p), ".json"))
+		if c.languages[lang] == nil {
+			c.languages[lang] = make(map[string]string)
+		}
+		for key, message := range messages {
+			c.languages[lang][key] = message
+		}
+	}
+	return nil
+}
+
+// Languages returns the available languages, sorted
+func (c *Catalog) Languages() []string {
+	langs := make([]string, 0, len(c.languages))
+	for lang := range c.languages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Has reports whether lang has translations
+func (c *Catalog) Has(lang string) bool {
+	_, ok := c.languages[strings.ToLower(lang)]
+	return ok
+}
+
+// Negotiate returns the available language preferred by an Accept-Language
+// header, trying the base language of regional tags such as fr-CH, or def
+// when none is acceptable
+func (c *Catalog) Negotiate(acceptLanguage, def string) string {
+	for _, tag := range ParseAcceptLanguage(acceptLanguage) {
+		if tag == "*" {
+			return def
+		}
+		if c.Has(tag) {
+			return tag
+		}
+		if base, _, ok := strings.Cut(tag, "-"); ok && c.Has(base) {
+			return base
+		}
+	}
+	return def
+}
+
+// ParseAcceptLanguage returns the lowercase language tags of an
+// Accept-Language header by decreasing quality, leaving out the ones with
+// a quality of zero. Tags of equal quality keep their order.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
+
+// T returns the message of key in lang formatted with args, falling back to
+// the Fallback message and then to the key itself
+func (c *Catalog) T(lang, key string, args ...interface{}) string {
+	message, ok := c.languages[lang][key]
+	if !ok {
+		c.missing(lang, key)
+		if message, ok = c.languages[Fallback][key]; !ok {
+			if lang != Fallback {
+				c.missing(Fallback, key)
+			}
+			message = key
+		}
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+func (c *Catalog) missing(lang, key string) {
+	if _, reported := c.reported.LoadOrStore(lang+"\x00"+key, true); !reported && c.OnMissing != nil {
+		c.OnMissing(lang, key)
+	}
+}
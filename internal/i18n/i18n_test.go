@@ -0,0 +1,90 @@
+package i18n
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := map[string][]string{
+		"":                             {},
+		"fr":                           {"fr"},
+		"de;q=0.5, FR-ch, en;q=0.8":    {"fr-ch", "en", "de"},
+		"en;q=0.5, de;q=0.5, fr;q=0.5": {"en", "de", "fr"},
+		"fr;q=0, de":                   {"de"},
+		"fr;q=2, de;q=abc, en;q=0.1":   {"en"},
+		"fr; level=1; q=0.3, de;q=0.2": {"fr", "de"},
+		" , *;q=0.1, en":               {"en", "*"},
+	}
+	for header, want := range tests {
+		if got := ParseAcceptLanguage(header); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	c, err := NewCatalog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"de;q=0.5, fr":          "fr",
+		"fr-CH":                 "fr",
+		"es, de;q=0.1":          "de",
+		"es":                    "en",
+		"es, *;q=0.5, fr;q=0.1": "en",
+		"":                      "en",
+	}
+	for header, want := range tests {
+		if got := c.Negotiate(header, "en"); got != want {
+			t.Errorf("%q: got %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestMissingTranslations(t *testing.T) {
+	dir := t.TempDir()
+	// a new language with a single message, and a bundled one overridden
+	os.WriteFile(filepath.Join(dir, "NL.json"), []byte(`{"blocked.title": "Geblokkeerd"}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "fr.json"), []byte(`{"blocked.title": "Interdit"}`), 0o644)
+	c, err := NewCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing []string
+	c.OnMissing = func(lang, key string) { missing = append(missing, lang+" "+key) }
+
+	if got := c.T("nl", "blocked.title"); got != "Geblokkeerd" {
+		t.Errorf("got %q, want the translation of the directory", got)
+	}
+	if got := c.T("fr", "blocked.title"); got != "Interdit" {
+		t.Errorf("got %q, want the bundled translation overridden", got)
+	}
+	if got := c.T("fr", "blocked.heading", "news.test"); got != "news.test est bloqué" {
+		t.Errorf("got %q, want the bundled messages kept", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := c.T("nl", "blocked.heading", "news.test"); got != "news.test is blocked" {
+			t.Errorf("got %q, want the english message", got)
+		}
+	}
+	if got := c.T("nl", "no.such.key"); got != "no.such.key" {
+		t.Errorf("got %q, want the key itself", got)
+	}
+	// every missing message is reported once
+	want := []string{"nl blocked.heading", "nl no.such.key", "en no.such.key"}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("got missing %q, want %q", missing, want)
+	}
+}
+
+func TestInvalidTranslations(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "nl.json"), []byte(`{"blocked.title": 1}`), 0o644)
+	if _, err := NewCatalog(dir); err == nil {
+		t.Error("got no error for an invalid translation file")
+	}
+}
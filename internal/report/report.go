@@ -0,0 +1,128 @@
+// Package report aggregates the daily blocking statistics into period summaries.
+package report
+
+import (
+	"embed"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// DateLayout is the format of the dates used by days and reports
+const DateLayout = "2006-01-02"
+
+// topDomains is the number of domains listed in a report
+const topDomains = 10
+
+//go:embed report.html
+var templatesFS embed.FS
+
+var htmlTemplate = template.Must(template.ParseFS(templatesFS, "report.html"))
+
+type (
+	// Day holds the blocked attempts per domain on a single date
+	Day struct {
+		Blocked map[string]int64 `json:"blocked"`
+	}
+
+	// Report summarizes the blocked attempts over a period
+	Report struct {
+		From          string         `json:"from"`
+		To            string         `json:"to"`
+		TotalBlocked  int64          `json:"total_blocked"`
+		PreviousTotal int64          `json:"previous_total_blocked"`
+		Change        int64          `json:"change"`
+		TopDomains    []DomainCount  `json:"top_domains"`
+		Days          []DayTotal     `json:"days"`
+		Streaks       ZeroDayStreaks `json:"zero_attempt_streaks"`
+	}
+
+	DomainCount struct {
+		Domain   string `json:"domain"`
+		Attempts int64  `json:"attempts"`
+	}
+
+	DayTotal struct {
+		Date    string `json:"date"`
+		Blocked int64  `json:"blocked"`
+	}
+
+	// ZeroDayStreaks are runs of consecutive days without any blocked attempt
+	ZeroDayStreaks struct {
+		Longest int `json:"longest"`
+		Current int `json:"current"` // the run ending on the last day of the period
+	}
+)
+
+// Build aggregates days, keyed by date, from from to to inclusive, comparing
+// them to the period of the same length right before
+func Build(days map[string]Day, from, to time.Time) Report {
+	from, to = truncate(from), truncate(to)
+	length := int(to.Sub(from).Hours()/24) + 1
+	r := Report{
+		From:       from.Format(DateLayout),
+		To:         to.Format(DateLayout),
+		TopDomains: []DomainCount{},
+		Days:       []DayTotal{},
+	}
+
+	domains := make(map[string]int64)
+	streak := 0
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format(DateLayout)
+		total := int64(0)
+		for domain, n := range days[date].Blocked {
+			domains[domain] += n
+			total += n
+		}
+		r.Days = append(r.Days, DayTotal{Date: date, Blocked: total})
+		r.TotalBlocked += total
+
+		if total == 0 {
+			streak++
+		} else {
+			streak = 0
+		}
+		if streak > r.Streaks.Longest {
+			r.Streaks.Longest = streak
+		}
+	}
+	r.Streaks.Current = streak
+
+	for d := from.AddDate(0, 0, -length); d.Before(from); d = d.AddDate(0, 0, 1) {
+		for _, n := range days[d.Format(DateLayout)].Blocked {
+			r.PreviousTotal += n
+		}
+	}
+	r.Change = r.TotalBlocked - r.PreviousTotal
+
+	for domain, n := range domains {
+		r.TopDomains = append(r.TopDomains, DomainCount{Domain: domain, Attempts: n})
+	}
+	sort.Slice(r.TopDomains, func(i, j int) bool {
+		if r.TopDomains[i].Attempts != r.TopDomains[j].Attempts {
+			return r.TopDomains[i].Attempts > r.TopDomains[j].Attempts
+		}
+		return r.TopDomains[i].Domain < r.TopDomains[j].Domain
+	})
+	if len(r.TopDomains) > topDomains {
+		r.TopDomains = r.TopDomains[:topDomains]
+	}
+	return r
+}
+
+// LastWeek returns the seven days ending on the day of now
+func LastWeek(now time.Time) (from, to time.Time) {
+	to = truncate(now)
+	return to.AddDate(0, 0, -6), to
+}
+
+// RenderHTML writes the report as a simple HTML page
+func RenderHTML(w io.Writer, r Report) error {
+	return htmlTemplate.Execute(w, r)
+}
+
+func truncate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,76 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// testDays are the statistics of a fortnight, the last week being reported
+var testDays = map[string]Day{
+	"2024-02-26": {Blocked: map[string]int64{"news.test": 4}},
+	"2024-02-29": {Blocked: map[string]int64{"video.test": 7}},
+	"2024-03-04": {Blocked: map[string]int64{"news.test": 3, "video.test": 1}},
+	"2024-03-05": {Blocked: map[string]int64{"news.test": 2}},
+	"2024-03-08": {Blocked: map[string]int64{"chat.test": 2, "video.test": 2}},
+}
+
+// golden compares got to the file of testdata named name, rewriting it with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, run go test -update to see how:\n%s", name, got)
+	}
+}
+
+func TestBuildWeekly(t *testing.T) {
+	// Sunday 10 March 2024
+	from, to := LastWeek(time.Date(2024, 3, 10, 18, 30, 0, 0, time.UTC))
+	r := Build(testDays, from, to)
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "weekly.json", append(data, '\n'))
+
+	var html bytes.Buffer
+	if err := RenderHTML(&html, r); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "weekly.html", html.Bytes())
+}
+
+func TestBuildEmptyPeriod(t *testing.T) {
+	from, to := LastWeek(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+	r := Build(nil, from, to)
+	if r.TotalBlocked != 0 || len(r.Days) != 7 || len(r.TopDomains) != 0 || r.Streaks != (ZeroDayStreaks{Longest: 7, Current: 7}) {
+		t.Errorf("got %+v, want seven days without attempts", r)
+	}
+}
+
+func TestBuildKeepsTopDomains(t *testing.T) {
+	day := Day{Blocked: make(map[string]int64)}
+	for i := 0; i < topDomains+5; i++ {
+		day.Blocked[string(rune('a'+i))+".test"] = int64(i + 1)
+	}
+	r := Build(map[string]Day{"2024-03-10": day}, time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+	if len(r.TopDomains) != topDomains || r.TopDomains[0].Domain != "o.test" || r.TopDomains[topDomains-1].Domain != "f.test" {
+		t.Errorf("got %+v, want the %d domains with the most attempts", r.TopDomains, topDomains)
+	}
+}
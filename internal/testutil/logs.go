@@ -0,0 +1,103 @@
+package testutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// Logs captures the entries of a logrus logger, at every level
+	Logs struct {
+		mu      sync.Mutex
+		entries []Entry
+	}
+
+	// Entry is a captured log entry
+	Entry struct {
+		Level   logrus.Level
+		Message string
+		Data    logrus.Fields
+	}
+)
+
+// CaptureLogs captures the entries of logger until the end of the test, when
+// its hooks and level are restored. Tests capturing the same logger must not
+// run in parallel.
+func CaptureLogs(t testing.TB, logger *logrus.Logger) *Logs {
+	l := &Logs{}
+	previous := logger.ReplaceHooks(make(logrus.LevelHooks))
+	hooks := make(logrus.LevelHooks)
+	for level, h := range previous {
+		hooks[level] = append([]logrus.Hook(nil), h...)
+	}
+	hooks.Add(l)
+	logger.ReplaceHooks(hooks)
+	level := logger.GetLevel()
+	logger.SetLevel(logrus.TraceLevel)
+	t.Cleanup(func() {
+		logger.ReplaceHooks(previous)
+		logger.SetLevel(level)
+	})
+	return l
+}
+
+func (l *Logs) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (l *Logs) Fire(entry *logrus.Entry) error {
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, Entry{Level: entry.Level, Message: entry.Message, Data: data})
+	return nil
+}
+
+// Entries returns the entries captured so far
+func (l *Logs) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Entry(nil), l.entries...)
+}
+
+// Find returns the entries whose message is msg
+func (l *Logs) Find(msg string) []Entry {
+	var found []Entry
+	for _, e := range l.Entries() {
+		if e.Message == msg {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// Wait waits for n entries whose message is msg and returns them, failing
+// the test after a while. The access log entries in particular come after
+// the client got the response.
+func (l *Logs) Wait(t testing.TB, msg string, n int) []Entry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		found := l.Find(msg)
+		if len(found) >= n {
+			return found
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d entries %q, want %d", len(found), msg, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Reset drops the entries captured so far
+func (l *Logs) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
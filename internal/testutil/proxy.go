@@ -0,0 +1,83 @@
+package testutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Proxy is a server under test, listening on an ephemeral port
+type Proxy struct {
+	// URL is the base URL of the server, for its local endpoints
+	URL string
+	// Client sends every request through the server as a forward proxy,
+	// returning redirects instead of following them
+	Client *http.Client
+
+	mu      sync.Mutex
+	clients []*http.Client
+}
+
+// StartProxy serves srv on an ephemeral port of the loopback interface until
+// the end of the test, when it is shut down
+func StartProxy(t testing.TB, srv *http.Server) *Proxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Error(err)
+		}
+	}()
+	p := &Proxy{URL: "http://" + ln.Addr().String()}
+	p.Client = p.ClientAs(nil)
+	t.Cleanup(func() {
+		// a connection dialed but never used counts as active for a while,
+		// delaying the shutdown
+		p.closeIdleConnections()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-served
+	})
+	return p
+}
+
+// ClientAs returns a client sending every request through the proxy with
+// the credentials of user, none when nil
+func (p *Proxy) ClientAs(user *url.Userinfo) *http.Client {
+	proxyURL, _ := url.Parse(p.URL)
+	proxyURL.User = user
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	p.mu.Lock()
+	p.clients = append(p.clients, client)
+	p.mu.Unlock()
+	return client
+}
+
+// closeIdleConnections closes the idle connections of the clients of p, and
+// of the default client used for the local endpoints
+func (p *Proxy) closeIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, client := range p.clients {
+		client.CloseIdleConnections()
+	}
+	http.DefaultClient.CloseIdleConnections()
+}
@@ -0,0 +1,192 @@
+// Package testutil is the harness of the end-to-end tests: a fake upstream,
+// the proxy served on an ephemeral port, a capture of the log entries and a
+// manual clock. Nothing of it reaches beyond the loopback interface.
+package testutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// Upstream is a fake upstream server answering the routes given by the
+	// tests, and recording the requests it receives
+	Upstream struct {
+		*httptest.Server
+
+		mu       sync.Mutex
+		routes   map[string]Route
+		requests []Request
+	}
+
+	// Route is the response of the upstream for a path
+	Route struct {
+		Status int // 200 when zero
+		Header http.Header
+		Body   string
+		// Latency delays the response headers
+		Latency time.Duration
+		// Chunks are written after Body, each one flushed Interval after the
+		// previous one, the response having no Content-Length
+		Chunks   []string
+		Interval time.Duration
+		// Drop closes the connection after DropAfter bytes of Body, the
+		// Content-Length announcing all of them
+		Drop      bool
+		DropAfter int
+		// Trailer is sent after the body
+		Trailer http.Header
+		// Handler serves the route instead when set
+		Handler http.HandlerFunc
+	}
+
+	// Request is a request received by the upstream
+	Request struct {
+		Method string
+		Host   string
+		Path   string
+		Query  string // raw, as sent
+		Header http.Header
+	}
+)
+
+// NewUpstream starts an upstream closed at the end of the test. Paths without
+// a route are answered with 404.
+func NewUpstream(t testing.TB) *Upstream {
+	u := &Upstream{routes: make(map[string]Route)}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// NewTLSUpstream starts an upstream over https
+func NewTLSUpstream(t testing.TB) *Upstream {
+	u := &Upstream{routes: make(map[string]Route)}
+	u.Server = httptest.NewTLSServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// Handle sets the route of path
+func (u *Upstream) Handle(path string, route Route) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.routes[path] = route
+}
+
+// Requests returns the requests received so far
+func (u *Upstream) Requests() []Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]Request(nil), u.requests...)
+}
+
+// Addr returns the host:port the upstream listens on
+func (u *Upstream) Addr() string {
+	return u.Listener.Addr().String()
+}
+
+// Port returns the port the upstream listens on
+func (u *Upstream) Port() string {
+	_, port, _ := net.SplitHostPort(u.Addr())
+	return port
+}
+
+// Dial connects to the upstream whatever addr is, so that the proxy reaches
+// it for any host name
+func (u *Upstream) Dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, u.Addr())
+}
+
+// Trust makes transport dial the upstream for every host and accept its
+// certificate, which is only valid for the loopback addresses
+func (u *Upstream) Trust(transport *http.Transport) {
+	transport.DialContext = u.Dial
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+}
+
+func (u *Upstream) serve(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests = append(u.requests, Request{Method: r.Method, Host: r.Host, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header.Clone()})
+	route, ok := u.routes[r.URL.Path]
+	u.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if route.Latency > 0 {
+		select {
+		case <-time.After(route.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if route.Handler != nil {
+		route.Handler(w, r)
+		return
+	}
+	for name, values := range route.Header {
+		w.Header()[name] = values
+	}
+	for name := range route.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	switch {
+	case route.Drop:
+		u.drop(w, status, route)
+	case len(route.Chunks) > 0:
+		w.WriteHeader(status)
+		w.Write([]byte(route.Body))
+		w.(http.Flusher).Flush()
+		for _, chunk := range route.Chunks {
+			select {
+			case <-time.After(route.Interval):
+			case <-r.Context().Done():
+				return
+			}
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	default:
+		if route.Trailer == nil {
+			w.Header().Set("Content-Length", strconv.Itoa(len(route.Body)))
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(route.Body))
+	}
+	for name, values := range route.Trailer {
+		w.Header()[name] = values
+	}
+}
+
+// drop announces the whole body of route and closes the connection partway
+func (u *Upstream) drop(w http.ResponseWriter, status int, route Route) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	h := route.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(route.Body)))
+	rw.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	h.Write(rw)
+	rw.WriteString("\r\n")
+	rw.WriteString(route.Body[:route.DropAfter])
+	rw.Flush()
+}
@@ -0,0 +1,140 @@
+package token
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var issued = time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+
+// keyring returns a keyring whose clock reads *now
+func keyring(now *time.Time, current string, previous ...string) *Keyring {
+	var keys [][]byte
+	for _, key := range previous {
+		keys = append(keys, []byte(key))
+	}
+	k := NewKeyring([]byte(current), keys...)
+	k.Now = func() time.Time { return *now }
+	return k
+}
+
+func mint(t *testing.T, k *Keyring, c Claims) string {
+	t.Helper()
+	token, err := k.Mint(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	now := issued
+	k := keyring(&now, "key")
+	token := mint(t, k, Claims{Host: "news.test", Client: "192.0.2.1", Expires: issued.Add(time.Hour)})
+
+	tests := []struct {
+		name, host, client string
+		err                error
+	}{
+		{"host", "news.test", "192.0.2.1", nil},
+		{"subdomain", "www.news.test", "192.0.2.1", nil},
+		{"suffix of another domain", "othernews.test", "192.0.2.1", ErrHostMismatch},
+		{"parent domain", "test", "192.0.2.1", ErrHostMismatch},
+		{"another client", "news.test", "192.0.2.2", ErrClientMismatch},
+	}
+	for _, tt := range tests {
+		c, err := k.Verify(token, tt.host, tt.client)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && c.Host != "news.test" {
+			t.Errorf("%s: got claims %+v", tt.name, c)
+		}
+	}
+
+	anyone := mint(t, k, Claims{Host: "news.test", Expires: issued.Add(time.Hour)})
+	if _, err := k.Verify(anyone, "news.test", "192.0.2.2"); err != nil {
+		t.Errorf("got %v for a token of any client", err)
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	now := issued
+	k := keyring(&now, "key")
+	k.Skew = time.Minute
+	token := mint(t, k, Claims{Host: "news.test", Expires: issued.Add(time.Hour)})
+
+	for _, step := range []struct {
+		at  time.Duration
+		err error
+	}{
+		{time.Hour, nil},
+		{time.Hour + time.Minute, nil},
+		{time.Hour + time.Minute + time.Second, ErrExpired},
+	} {
+		now = issued.Add(step.at)
+		if _, err := k.Verify(token, "news.test", ""); !errors.Is(err, step.err) {
+			t.Errorf("after %s: got %v, want %v", step.at, err, step.err)
+		}
+	}
+}
+
+func TestVerifyRotation(t *testing.T) {
+	now := issued
+	old := keyring(&now, "old")
+	token := mint(t, old, Claims{Host: "news.test", Expires: issued.Add(time.Hour)})
+
+	rotated := keyring(&now, "new", "old")
+	if _, err := rotated.Verify(token, "news.test", ""); err != nil {
+		t.Errorf("got %v for a token of the previous key", err)
+	}
+	// the new tokens are signed with the current key only
+	fresh := mint(t, rotated, Claims{Host: "news.test", Expires: issued.Add(time.Hour)})
+	if _, err := old.Verify(fresh, "news.test", ""); !errors.Is(err, ErrSignature) {
+		t.Errorf("got %v verifying with the previous key alone, want %v", err, ErrSignature)
+	}
+	if _, err := keyring(&now, "new").Verify(token, "news.test", ""); !errors.Is(err, ErrSignature) {
+		t.Errorf("got %v once the previous key is dropped, want %v", err, ErrSignature)
+	}
+}
+
+func TestVerifyForged(t *testing.T) {
+	now := issued
+	k := keyring(&now, "key")
+	token := mint(t, k, Claims{Host: "news.test", Expires: issued.Add(time.Hour)})
+	_, sig, _ := strings.Cut(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"host":"test","exp":"2099-01-01T00:00:00Z"}`))
+
+	tests := map[string]error{
+		"":                 ErrMalformed,
+		"nodot":            ErrMalformed,
+		forged + ".!!!":    ErrMalformed,
+		forged + "." + sig: ErrSignature,
+		mint(t, keyring(&now, "other"), Claims{Host: "news.test", Expires: issued.Add(time.Hour)}): ErrSignature,
+	}
+	for token, want := range tests {
+		if _, err := k.Verify(token, "news.test", ""); !errors.Is(err, want) {
+			t.Errorf("%q: got %v, want %v", token, err, want)
+		}
+	}
+
+	// a valid signature over a payload without a host is still malformed
+	empty := mint(t, k, Claims{Expires: issued.Add(time.Hour)})
+	if _, err := k.Verify(empty, "news.test", ""); !errors.Is(err, ErrMalformed) {
+		t.Errorf("got %v for a token without a host, want %v", err, ErrMalformed)
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	a, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewKey()
+	if len(a) != KeySize || string(a) == string(b) {
+		t.Errorf("got keys %x and %x, want distinct %d byte keys", a, b, KeySize)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of recent upstream responses Latency keeps
+const latencySamples = 256
+
+type (
+	// Latency keeps the time to the response headers of the recent upstream requests
+	Latency struct {
+		mu      sync.Mutex
+		samples [latencySamples]time.Duration
+		next    int
+		count   int
+	}
+
+	// LatencyReport summarizes the recent samples, in milliseconds
+	LatencyReport struct {
+		Samples int     `json:"samples"`
+		P50     float64 `json:"p50_ms"`
+		P95     float64 `json:"p95_ms"`
+		Max     float64 `json:"max_ms"`
+	}
+)
+
+func (l *Latency) Record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+	if l.count < latencySamples {
+		l.count++
+	}
+}
+
+func (l *Latency) Report() LatencyReport {
+	l.mu.Lock()
+	samples := append([]time.Duration(nil), l.samples[:l.count]...)
+	l.mu.Unlock()
+
+	report := LatencyReport{Samples: len(samples)}
+	if len(samples) == 0 {
+		return report
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	report.P50 = ms(samples[len(samples)/2])
+	report.P95 = ms(samples[len(samples)*95/100])
+	report.Max = ms(samples[len(samples)-1])
+	return report
+}
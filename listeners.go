@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// ListenerConfig describes one address the process serves and the roles it serves there
+	ListenerConfig struct {
+		Addr     string
+		Roles    []string
+		CertFile string
+		KeyFile  string
+	}
+
+	// Listeners is a set of bound servers started and stopped together
+	Listeners struct {
+		servers   []*http.Server
+		listeners []net.Listener
+	}
+)
+
+// roles which can be served by a listener
+const (
+	// RoleProxy proxies the requests of the clients
+	RoleProxy = "proxy"
+	// RoleWeb serves the PAC file and the block pages
+	RoleWeb = "web"
+	// RoleAdmin serves the endpoints managing the proxy
+	RoleAdmin = "admin"
+	// RoleMetrics serves the metrics of the proxy
+	RoleMetrics = "metrics"
+)
+
+// Roles are all the roles a listener may serve
+var Roles = []string{RoleProxy, RoleWeb, RoleAdmin, RoleMetrics}
+
+// Routes are the endpoints of a role, by ServeMux pattern
+type Routes map[string]http.Handler
+
+// ParseListeners parses a LISTENERS specification: entries separated by ";",
+// each written as roles@address with an optional " tls=cert.pem,key.pem" suffix,
+// for example "proxy@:3128; web+metrics@:8080; admin@unix:/run/procrastiproxy.sock".
+func ParseListeners(spec string) ([]ListenerConfig, error) {
+	var configs []ListenerConfig
+	for _, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		roles, addr, ok := strings.Cut(fields[0], "@")
+		if !ok || roles == "" || addr == "" {
+			return nil, fmt.Errorf("listener %q: expected roles@address", entry)
+		}
+		lc := ListenerConfig{Addr: addr, Roles: strings.Split(roles, "+")}
+		for _, role := range lc.Roles {
+			if !knownRole(role) {
+				return nil, fmt.Errorf("listener %q: unknown role %q, expected %s", entry, role, strings.Join(Roles, ", "))
+			}
+		}
+		for _, opt := range fields[1:] {
+			if !strings.HasPrefix(opt, "tls=") {
+				return nil, fmt.Errorf("listener %q: unknown option %q", entry, opt)
+			}
+			lc.CertFile, lc.KeyFile, ok = strings.Cut(strings.TrimPrefix(opt, "tls="), ",")
+			if !ok {
+				return nil, fmt.Errorf("listener %q: expected tls=cert,key", entry)
+			}
+		}
+		configs = append(configs, lc)
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no listeners configured")
+	}
+	return configs, nil
+}
+
+func knownRole(role string) bool {
+	for _, known := range Roles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerRolesKey holds the roles of the listener which accepted a connection
+type listenerRolesKey struct{}
+
+// listenerRoles returns the roles of the listener which accepted the
+// connection of r, when Listen bound it
+func listenerRoles(r *http.Request) ([]string, bool) {
+	roles, ok := r.Context().Value(listenerRolesKey{}).([]string)
+	return roles, ok
+}
+
+// unboundRoles are the roles of the listeners not bound by Listen, such as
+// the ones of a program serving NewServer itself
+var unboundRoles = Roles
+
+// servedRoles returns the roles of the listener which accepted the connection of r
+func servedRoles(r *http.Request) []string {
+	if roles, ok := listenerRoles(r); ok {
+		return roles
+	}
+	return unboundRoles
+}
+
+// servesRole reports whether the listener which accepted the connection of r serves role
+func servesRole(r *http.Request, role string) bool {
+	for _, served := range servedRoles(r) {
+		if served == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen binds every configured listener, closing the ones already bound if any of them fails.
+// Each listener is served by a server with the handler and ConnState
+// callback of srv, the handler finding the roles of the listener with
+// listenerRoles.
+func Listen(configs []ListenerConfig, srv *http.Server) (*Listeners, error) {
+	l := &Listeners{}
+	for _, lc := range configs {
+		server, ln, err := listen(lc, srv)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listen on %s: %w", lc.Addr, err)
+		}
+		l.servers = append(l.servers, server)
+		l.listeners = append(l.listeners, ln)
+	}
+	return l, nil
+}
+
+func listen(lc ListenerConfig, template *http.Server) (*http.Server, net.Listener, error) {
+	roles := lc.Roles
+	srv := &http.Server{
+		Handler:   template.Handler,
+		ConnState: template.ConnState,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, listenerRolesKey{}, roles)
+		},
+	}
+	if lc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	network, addr := "tcp", lc.Addr
+	if strings.HasPrefix(lc.Addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(lc.Addr, "unix:")
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if srv.TLSConfig != nil {
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+	return srv, ln, nil
+}
+
+// roleHandler serves proxy requests only when the proxy role is enabled and
+// routes everything else to the endpoints of the other roles
+func roleHandler(roles []string, proxy http.Handler, routes map[string]Routes) http.Handler {
+	var p http.Handler = http.NotFoundHandler()
+	local := http.NewServeMux()
+	registered := make(map[string]bool)
+	for _, role := range roles {
+		if role == RoleProxy {
+			p = proxy
+			continue
+		}
+		for pattern, h := range routes[role] {
+			// endpoints such as /readyz belong to several roles
+			if !registered[pattern] {
+				local.Handle(pattern, h)
+				registered[pattern] = true
+			}
+		}
+	}
+	return RouteRequests(p, local)
+}
+
+// Serve runs every server until they are shut down
+func (l *Listeners) Serve() {
+	var wg sync.WaitGroup
+	for i := range l.servers {
+		srv, ln := l.servers[i], l.listeners[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.WithField("addr", ln.Addr().String()).Info("starting server")
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithFields(log.Fields{"event": "serve", "addr": ln.Addr().String()}).Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Shutdown gracefully stops all servers, waiting for in-flight requests until ctx expires
+func (l *Listeners) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(l.servers))
+	for i, srv := range l.servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}(i, srv)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases the bound listeners without serving them
+func (l *Listeners) Close() {
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+}
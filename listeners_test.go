@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestParseListeners(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []ListenerConfig
+		wantErr bool
+	}{
+		{spec: "proxy@:3128", want: []ListenerConfig{{Addr: ":3128", Roles: []string{RoleProxy}}}},
+		{spec: "proxy@:3128; admin@unix:/run/p.sock", want: []ListenerConfig{
+			{Addr: ":3128", Roles: []string{RoleProxy}},
+			{Addr: "unix:/run/p.sock", Roles: []string{RoleAdmin}},
+		}},
+		{spec: "proxy+admin@:8443 tls=cert.pem,key.pem", want: []ListenerConfig{
+			{Addr: ":8443", Roles: []string{RoleProxy, RoleAdmin}, CertFile: "cert.pem", KeyFile: "key.pem"},
+		}},
+		{spec: ":3128", wantErr: true},
+		{spec: "proxy+web@:3128; metrics@:9090", want: []ListenerConfig{
+			{Addr: ":3128", Roles: []string{RoleProxy, RoleWeb}},
+			{Addr: ":9090", Roles: []string{RoleMetrics}},
+		}},
+		{spec: "cache@:3128", wantErr: true},
+		{spec: "proxy@:3128 tls=cert.pem", wantErr: true},
+		{spec: "proxy@:3128 gzip", wantErr: true},
+		{spec: " ; ", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseListeners(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestListenersServeTheirRoles(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "upstream"})
+	srv, err := NewServer(testConfig(t, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.Handler.(*Server)
+	t.Cleanup(func() { <-s.done })
+	var configs []ListenerConfig
+	for _, role := range Roles {
+		configs = append(configs, ListenerConfig{Addr: "127.0.0.1:0", Roles: []string{role}})
+	}
+	listeners, err := Listen(configs, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		listeners.Serve()
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		listeners.Shutdown(ctx)
+		srv.Shutdown(ctx)
+		<-served
+	})
+
+	// what each role serves, the other roles answering 404
+	endpoints := map[string][]string{
+		RoleProxy:   {"http://news.test/"},
+		RoleWeb:     {"/proxy.pac", "/api/status"},
+		RoleAdmin:   {"/admin/stats", "/dashboard", "/usage"},
+		RoleMetrics: {"/metrics"},
+	}
+	for i, role := range Roles {
+		addr := "http://" + listeners.listeners[i].Addr().String()
+		proxyURL, _ := url.Parse(addr)
+		through := &http.Client{Transport: adminTransport{&http.Transport{Proxy: http.ProxyURL(proxyURL)}}, Timeout: 5 * time.Second}
+		for owner, paths := range endpoints {
+			for _, path := range paths {
+				client, target := admin, addr+path
+				if owner == RoleProxy {
+					client, target = through, path
+				}
+				want := http.StatusNotFound
+				// the other roles share the status API with the admin one
+				if owner == role || (path == "/api/status" && role == RoleAdmin) {
+					want = http.StatusOK
+				}
+				if resp, _ := get(t, client, target); resp.StatusCode != want {
+					t.Errorf("%s on the %s listener: got %d, want %d", target, role, resp.StatusCode, want)
+				}
+			}
+		}
+		// the probes are served by every role but the proxy
+		want := http.StatusOK
+		if role == RoleProxy {
+			want = http.StatusNotFound
+		}
+		if resp, _ := get(t, http.DefaultClient, addr+"/readyz"); resp.StatusCode != want {
+			t.Errorf("/readyz on the %s listener: got %d, want %d", role, resp.StatusCode, want)
+		}
+	}
+	if n := len(upstream.Requests()); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestListenerSharingRoles(t *testing.T) {
+	_, s := startProxy(t, testConfig(t, nil))
+	h := s.Handler([]string{RoleWeb, RoleMetrics})
+	for path, want := range map[string]int{"/proxy.pac": http.StatusOK, "/metrics": http.StatusOK, "/admin/stats": http.StatusNotFound, "/readyz": http.StatusOK} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Jasstkn/procrastiproxy/internal/i18n"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Locale is the language of a page served by the proxy, available to the
+	// templates as .Lang along with the .T method translating messages
+	Locale struct {
+		Lang    string
+		catalog *i18n.Catalog
+	}
+
+	// Locales picks the language of the pages from the Accept-Language header
+	Locales struct {
+		catalog *i18n.Catalog
+		def     string
+	}
+)
+
+// NewLocales loads the bundled translations and those of dir, def being
+// the language of clients accepting none of them
+func NewLocales(dir, def string) (*Locales, error) {
+	catalog, err := i18n.NewCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	def = strings.ToLower(def)
+	if !catalog.Has(def) {
+		return nil, fmt.Errorf("no translations for DEFAULT_LANGUAGE %q, expected one of %s", def, strings.Join(catalog.Languages(), ", "))
+	}
+	catalog.OnMissing = func(lang, key string) {
+		log.WithFields(log.Fields{"lang": lang, "key": key}).Warn("missing translation")
+	}
+	return &Locales{catalog: catalog, def: def}, nil
+}
+
+// For returns the locale of r
+func (l *Locales) For(r *http.Request) Locale {
+	return Locale{Lang: l.catalog.Negotiate(r.Header.Get("Accept-Language"), l.def), catalog: l.catalog}
+}
+
+// T returns the message of key in the language of the locale, formatted with args
+func (l Locale) T(key string, args ...interface{}) string {
+	return l.catalog.T(l.Lang, key, args...)
+}
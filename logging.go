@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// subsystems whose level and output LOG_LEVEL_<NAME> and LOG_OUTPUT_<NAME> tune
+const (
+	SubsystemAccess = "access"
+	SubsystemProxy  = "proxy"
+	SubsystemRules  = "rules"
+	SubsystemAdmin  = "admin"
+)
+
+var subsystems = []string{SubsystemAccess, SubsystemProxy, SubsystemRules, SubsystemAdmin}
+
+// the loggers of the subsystems, the entries logged without one falling
+// under LOG_LEVEL and the default output
+var (
+	accessLog = log.WithField("subsystem", SubsystemAccess)
+	proxyLog  = log.WithField("subsystem", SubsystemProxy)
+	rulesLog  = log.WithField("subsystem", SubsystemRules)
+	adminLog  = log.WithField("subsystem", SubsystemAdmin)
+)
+
+// logRouter writes every entry at or above the level of its subsystem to the
+// output of it, and from error level to the error output when set. The
+// logger itself discards its output, its level being the most verbose one.
+type logRouter struct {
+	level   log.Level
+	levels  map[string]log.Level
+	outputs map[string]io.Writer
+	errors  io.Writer
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// configureLogging sets up the loggers to write through the router of newLogRouter
+func configureLogging() *logRouter {
+	router := newLogRouter()
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(io.Discard)
+	log.SetLevel(router.maxLevel())
+	log.AddHook(router)
+	return router
+}
+
+// newLogRouter reads LOG_LEVEL, LOG_LEVEL_<SUBSYSTEM>, LOG_OUTPUT_<SUBSYSTEM>
+// and LOG_ERROR_OUTPUT, an output being a file appended to or stdout or stderr
+func newLogRouter() *logRouter {
+	router := &logRouter{
+		level:   parseLevel(os.Getenv("LOG_LEVEL"), log.InfoLevel),
+		levels:  make(map[string]log.Level),
+		outputs: make(map[string]io.Writer),
+		out:     os.Stdout,
+	}
+	for _, name := range subsystems {
+		suffix := strings.ToUpper(name)
+		router.levels[name] = parseLevel(os.Getenv("LOG_LEVEL_"+suffix), router.level)
+		if path := os.Getenv("LOG_OUTPUT_" + suffix); path != "" {
+			router.outputs[name] = openLogOutput(path)
+		}
+	}
+	if path := os.Getenv("LOG_ERROR_OUTPUT"); path != "" {
+		router.errors = openLogOutput(path)
+	}
+	return router
+}
+
+// maxLevel returns the most verbose level of any subsystem
+func (l *logRouter) maxLevel() log.Level {
+	level := l.level
+	for _, subsystemLevel := range l.levels {
+		if subsystemLevel > level {
+			level = subsystemLevel
+		}
+	}
+	return level
+}
+
+func parseLevel(value string, def log.Level) log.Level {
+	level, err := log.ParseLevel(value)
+	if err != nil {
+		return def
+	}
+	return level
+}
+
+// openLogOutput opens path for appending, falling back to stdout
+func openLogOutput(path string) io.Writer {
+	switch path {
+	case "stdout":
+		return os.Stdout
+	case "stderr":
+		return os.Stderr
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		log.WithField("path", path).Error("cannot open log output, using stdout:", err)
+		return os.Stdout
+	}
+	return f
+}
+
+// SetOutput changes the output of the entries without an output of their own
+func (l *logRouter) SetOutput(out io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = out
+}
+
+// Enabled reports whether the entries of subsystem at level are written
+func (l *logRouter) Enabled(subsystem string, level log.Level) bool {
+	if subsystemLevel, ok := l.levels[subsystem]; ok {
+		return level <= subsystemLevel
+	}
+	return level <= l.level
+}
+
+func (l *logRouter) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (l *logRouter) Fire(entry *log.Entry) error {
+	subsystem, _ := entry.Data["subsystem"].(string)
+	level, ok := l.levels[subsystem]
+	if !ok {
+		level = l.level
+	}
+	if entry.Level > level {
+		return nil
+	}
+	line, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out, ok := l.outputs[subsystem]
+	if !ok {
+		out = l.out
+	}
+	_, err = out.Write(line)
+	if l.errors != nil && entry.Level <= log.ErrorLevel && l.errors != out {
+		l.errors.Write(line)
+	}
+	return err
+}
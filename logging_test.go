@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// routedLogger returns a logger writing through the router of the environment,
+// the entries without an output of their own going to out
+func routedLogger(t *testing.T, out *bytes.Buffer) (*log.Logger, *logRouter) {
+	t.Helper()
+	router := newLogRouter()
+	router.SetOutput(out)
+	logger := log.New()
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.SetOutput(&bytes.Buffer{})
+	logger.SetLevel(router.maxLevel())
+	logger.AddHook(router)
+	return logger, router
+}
+
+// messages returns the messages of the JSON entries of data
+func messages(t *testing.T, data string) []string {
+	t.Helper()
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry["msg"].(string))
+	}
+	return got
+}
+
+func TestSubsystemLogLevels(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_LEVEL_RULES", "debug")
+	t.Setenv("LOG_LEVEL_ACCESS", "error")
+	t.Setenv("LOG_LEVEL_ADMIN", "verbose")
+	var out bytes.Buffer
+	logger, router := routedLogger(t, &out)
+	if level := router.maxLevel(); level != log.DebugLevel {
+		t.Errorf("got the logger at %s, want debug for the rules", level)
+	}
+
+	logger.WithField("subsystem", SubsystemRules).Debug("rules debug")
+	logger.WithField("subsystem", SubsystemAccess).Warn("access warn")
+	logger.WithField("subsystem", SubsystemAccess).Error("access error")
+	// an invalid level falls back to LOG_LEVEL
+	logger.WithField("subsystem", SubsystemAdmin).Info("admin info")
+	logger.WithField("subsystem", SubsystemAdmin).Warn("admin warn")
+	logger.Info("info")
+	logger.Warn("warn")
+	want := []string{"rules debug", "access error", "admin warn", "warn"}
+	if got := messages(t, out.String()); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !router.Enabled(SubsystemRules, log.DebugLevel) || router.Enabled(SubsystemAccess, log.WarnLevel) || router.Enabled("other", log.InfoLevel) {
+		t.Error("Enabled disagrees with the levels")
+	}
+}
+
+func TestSubsystemLogOutputs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LOG_OUTPUT_ACCESS", filepath.Join(dir, "access.log"))
+	t.Setenv("LOG_ERROR_OUTPUT", filepath.Join(dir, "errors.log"))
+	var out bytes.Buffer
+	logger, _ := routedLogger(t, &out)
+
+	logger.WithField("subsystem", SubsystemAccess).Info("request completed")
+	logger.WithField("subsystem", SubsystemAccess).Error("access error")
+	logger.WithField("subsystem", SubsystemProxy).Info("proxied")
+	logger.WithField("subsystem", SubsystemProxy).Error("proxy error")
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for name, want := range map[string][]string{
+		"access.log": {"request completed", "access error"},
+		"errors.log": {"access error", "proxy error"},
+	} {
+		if got := messages(t, read(name)); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if got, want := messages(t, out.String()), []string{"proxied", "proxy error"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q on the default output, want %q", got, want)
+	}
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -12,10 +21,15 @@ import (
 type (
 	// struct for holding response details
 	responseData struct {
-		status int
-		size   int
+		status     int
+		size       int
+		suppressed bool       // set by handlers which must not be logged
+		hijacked   bool       // the handler took over the connection
+		fields     log.Fields // added to the access log entry by handlers
 	}
 
+	responseDataKey struct{}
+
 	// our http.ResponseWriter implementation
 	loggingResponseWriter struct {
 		http.ResponseWriter // compose original http.ResponseWriter
@@ -34,7 +48,61 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 	r.responseData.status = statusCode       // capture status code
 }
 
-func WithLogging(h http.Handler) http.Handler {
+// Flush sends buffered data to the client, if the wrapped writer can
+func (r *loggingResponseWriter) Flush() {
+	f, ok := r.ResponseWriter.(http.Flusher)
+	if !ok {
+		accessLog.WithField("writer", fmt.Sprintf("%T", r.ResponseWriter)).Debug("response writer does not support flushing")
+		return
+	}
+	f.Flush()
+}
+
+// Hijack lets the handler take over the connection, if the wrapped writer can
+func (r *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer %T does not support hijacking", r.ResponseWriter)
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		r.responseData.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// suppressAccessLog tells WithLogging not to log the request
+func suppressAccessLog(r *http.Request) {
+	if responseData, ok := r.Context().Value(responseDataKey{}).(*responseData); ok {
+		responseData.suppressed = true
+	}
+}
+
+// annotateAccessLog adds fields to the access log entry of the request
+func annotateAccessLog(r *http.Request, fields log.Fields) {
+	if responseData, ok := r.Context().Value(responseDataKey{}).(*responseData); ok {
+		if responseData.fields == nil {
+			responseData.fields = log.Fields{}
+		}
+		for k, v := range fields {
+			responseData.fields[k] = v
+		}
+	}
+}
+
+// LogOptions tune the access log of WithLogging
+type LogOptions struct {
+	// SlowThreshold warns about the requests taking longer, when it is set
+	SlowThreshold time.Duration
+	// Combined receives the entries instead of the application logs, when it is set
+	Combined *CombinedLog
+	// Skip leaves the matching requests out
+	Skip  *LogFilter
+	Flags *Flags
+}
+
+// WithLogging logs every request
+func WithLogging(h http.Handler, opts LogOptions) http.Handler {
 	loggingFn := func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -46,57 +114,570 @@ func WithLogging(h http.Handler) http.Handler {
 			ResponseWriter: w, // compose original http.ResponseWriter
 			responseData:   responseData,
 		}
+		r = r.WithContext(context.WithValue(r.Context(), responseDataKey{}, responseData))
 		h.ServeHTTP(&lrw, r) // inject our implementation of http.ResponseWriter
+		if responseData.suppressed || !opts.Flags.Enabled(FlagAccessLog) || opts.Skip.Skip(r) {
+			return
+		}
 
-		duration := time.Since(start).Nanoseconds()
+		elapsed := time.Since(start)
+		duration := elapsed.Nanoseconds()
 
-		log.WithFields(log.Fields{
-			"uri":         r.RequestURI,
-			"method":      r.Method,
-			"status":      responseData.status,
-			"duration_ns": duration,
-			"size":        responseData.size,
-		}).Info("request completed")
+		if opts.Combined != nil {
+			user, _ := responseData.fields["user"].(string)
+			opts.Combined.Log(r, user, responseData.status, responseData.size, start)
+		} else {
+			entry := accessLog.WithFields(log.Fields{
+				"uri":         r.RequestURI,
+				"method":      r.Method,
+				"status":      responseData.status,
+				"duration_ns": duration,
+				"size":        responseData.size,
+			})
+			if responseData.hijacked {
+				entry = entry.WithField("hijacked", true)
+			}
+			entry.WithFields(responseData.fields).Info("request completed")
+		}
+		if opts.SlowThreshold > 0 && elapsed > opts.SlowThreshold {
+			accessLog.WithFields(log.Fields{
+				"uri":          r.RequestURI,
+				"duration_ns":  duration,
+				"threshold_ns": opts.SlowThreshold.Nanoseconds(),
+			}).Warn("slow request")
+		}
 	}
 	return http.HandlerFunc(loggingFn)
 }
 
-func ProxyHandler() http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		req, err := http.Get(r.RequestURI)
+// ProxyHandler relays the requests of the clients under the rules of s
+func ProxyHandler(s *Server) http.Handler {
+	cfg, stats, flags := s.cfg, s.stats, s.flags
+	client := &http.Client{Transport: s.pool, Timeout: cfg.UpstreamTimeout, CheckRedirect: s.creds.CheckRedirect}
+	now := cfg.clock()
+
+	// tunnel relays the bytes of a CONNECT request both ways between the
+	// client and its target until either side closes, or the stream of the
+	// tunnel is canceled by its lifetime, the admin or the shutdown
+	tunnel := func(w http.ResponseWriter, r *http.Request, logger *log.Entry, bypassed bool) {
+		target := r.Host
+		if bypassed {
+			target = redacted
+		}
+		st, ctx, err := stats.Streams.Open(r, target)
 		if err != nil {
-			log.WithFields(log.Fields{"url": r.RequestURI}).Warn("failed with error:", err)
+			logger.Warn("tunnel refused:", err)
+			markLocalResponse(r)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer st.Close()
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			logger.Warnf("tunnel refused: response writer %T does not support hijacking", w)
+			markLocalResponse(r)
+			http.Error(w, "CONNECT tunnels require HTTP/1.1", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		upstream, err := s.pool.DialTunnel(ctx, r.Host)
+		if err != nil {
+			err = wrapTransportError(err)
+			logger.Warn("failed with error:", err)
+			s.errorPage.Serve(w, r, r.URL.Host, err)
+			return
+		}
+		defer upstream.Close()
+		client, rw, err := hijacker.Hijack()
+		if err != nil {
+			logger.Warn("failed to hijack the connection:", err)
+			return
+		}
+		defer client.Close()
+		if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			logger.Debug("failed to establish tunnel:", err)
+			return
+		}
+		// the client may have sent more than the request already
+		fromClient := io.Reader(client)
+		if n := rw.Reader.Buffered(); n > 0 {
+			fromClient = io.MultiReader(io.LimitReader(rw.Reader, int64(n)), client)
+		}
+		errs := make(chan error, 2)
+		go func() {
+			_, err := io.Copy(upstream, st.Body(fromClient))
+			errs <- err
+		}()
+		go func() {
+			_, err := io.Copy(client, st.Body(upstream))
+			errs <- err
+		}()
+		pending := 2
+		select {
+		case err = <-errs:
+			pending--
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		// closing both sides ends the copy still running
+		client.Close()
+		upstream.Close()
+		for ; pending > 0; pending-- {
+			<-errs
+		}
+		logger = logger.WithField("bytes", st.Bytes())
+		if err != nil {
+			logger.Debug("tunnel closed:", err)
+			return
+		}
+		logger.Debug("tunnel closed")
+	}
+
+	// forward relays r to its upstream. The bypassed requests are still
+	// bounded and counted, but their target is neither listed nor timed.
+	forward := func(w http.ResponseWriter, r *http.Request, logger *log.Entry, bypassed bool) {
+		if r.Method == http.MethodConnect {
+			tunnel(w, r, logger, bypassed)
+			return
+		}
+		outReq, err := newUpstreamRequest(r, cfg.StripRequestHeaders)
+		if err != nil {
+			logger.Warn("invalid request:", err)
+			markLocalResponse(r)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stripExemption(outReq)
+		if cfg.AllowUpstreamOverride {
+			override, err := overrideUpstream(outReq)
+			if err != nil {
+				logger.Info("invalid upstream override:", err)
+				markLocalResponse(r)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if override != "" {
+				logger = logger.WithField("upstream_override", override)
+				annotateAccessLog(r, log.Fields{"upstream_override": override})
+			}
+		}
+		// plain http upstreams may be refused, or first tried over https
+		upgraded := false
+		if cfg.HTTPSOnlyUpstreams && outReq.URL.Scheme == "http" {
+			if !cfg.HTTPSOnlyTryUpgrade {
+				logger.Info("plain http upstream refused")
+				markLocalResponse(r)
+				http.Error(w, "this proxy only fetches https:// upstreams", http.StatusBadRequest)
+				return
+			}
+			outReq.URL, outReq.Host = httpsURL(outReq.URL), ""
+			upgraded = true
+		}
+		s.creds.Inject(r, outReq, logger)
+
+		target := r.URL.String()
+		if bypassed {
+			target = redacted
+		}
+		st, ctx, err := stats.Streams.Open(r, target)
+		if err != nil {
+			logger.Warn("request refused:", err)
+			markLocalResponse(r)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer st.Close()
+		trace := &dialTrace{}
+		outReq = outReq.WithContext(httptrace.WithClientTrace(ctx, trace.ClientTrace()))
+		sent := time.Now()
+		resp, err := client.Do(outReq)
+		logger = logger.WithFields(trace.Fields())
+		if err != nil && upgraded {
+			logger.Info("plain http upstream refused after failed https upgrade:", err)
+			markLocalResponse(r)
+			http.Error(w, "this proxy only fetches https:// upstreams and "+outReq.URL.Host+" could not be reached over https", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			err = wrapTransportError(err)
+			logger.Warn("failed with error:", err)
+			s.errorPage.Serve(w, r, r.URL.Host, err)
+			return
+		}
+		defer resp.Body.Close()
+		if !bypassed {
+			stats.Latency.Record(time.Since(sent))
+		}
+		if err := checkResponseHeaders(resp.Header, cfg.MaxResponseHeaders, cfg.MaxResponseHeaderValueBytes); err != nil {
+			var limitErr *headerLimitError
+			errors.As(err, &limitErr)
+			logger.WithField("header", limitErr.Header).Warn("upstream response rejected:", err)
+			s.errorPage.Serve(w, r, r.URL.Host, err)
+			return
+		}
+
+		// Retry-After is relayed as is, the delay asked for is logged too
+		if value := resp.Header.Get("Retry-After"); value != "" && resp.StatusCode >= 400 {
+			if delay, ok := parseRetryAfter(value, now()); ok {
+				logger = logger.WithField("retry_after", delay.String())
+				annotateAccessLog(r, log.Fields{"retry_after": delay.String()})
+				logger.WithField("status", resp.StatusCode).Info("upstream asked to retry later")
+			} else {
+				logger.WithField("retry_after", value).Debug("invalid Retry-After from upstream")
+			}
+		}
+		upstreamBody, upstreamLength := resp.Body, resp.ContentLength
+		for _, hook := range cfg.ResponseHooks {
+			if err := hook(resp); err != nil {
+				err = &vetoError{err}
+				logger.Warn(err)
+				s.errorPage.Serve(w, r, r.URL.Host, err)
+				return
+			}
+		}
+		if fixContentLength(resp, upstreamBody, upstreamLength) {
+			// the upstream body is closed by the deferred close of the response
+			defer resp.Body.Close()
+			logger.WithFields(log.Fields{"upstream_length": upstreamLength, "length": resp.ContentLength}).Debug("response body transformed")
+		}
+		body := st.Body(resp.Body)
+		declared := declaresLength(r, resp)
+		var head []byte
+		if declared && cfg.RelayBufferBytes > 0 {
+			// the declared length is up to the upstream, the buffer is not
+			n := resp.ContentLength
+			if n > cfg.RelayBufferBytes {
+				n = cfg.RelayBufferBytes
+			}
+			head = make([]byte, n)
+			if n, err := io.ReadFull(body, head); err != nil {
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					stats.Truncated.Add(1)
+					logger.WithFields(log.Fields{"expected": resp.ContentLength, "actual": n}).Error(errBodyTruncated)
+					err = errBodyTruncated
+				} else {
+					logger.Warn("failed to read response body:", err)
+				}
+				s.errorPage.Serve(w, r, r.URL.Host, wrapTransportError(err))
+				return
+			}
+		}
+
+		copyResponseHeaders(w.Header(), resp.Header)
+		// trailers must be announced before the body and are only known after it
+		for name := range resp.Trailer {
+			w.Header().Add("Trailer", name)
+		}
+		w.WriteHeader(resp.StatusCode)
+		dst := io.Writer(w)
+		if f, ok := w.(http.Flusher); ok && streamed(resp) {
+			// the client gets the headers, then every chunk, as soon as they come
+			f.Flush()
+			dst = flushWriter{w: w, f: f}
+		}
+		written, _ := w.Write(head)
+		size, err := io.Copy(dst, body)
+		size += int64(written)
+		switch {
+		case declared && st.Bytes() < resp.ContentLength:
+			// the declared length tells the client that the body was cut short
+			stats.Truncated.Add(1)
+			logger.WithFields(log.Fields{"expected": resp.ContentLength, "actual": st.Bytes()}).Error("relayed truncated body:", err)
+		case err != nil:
+			logger.Warn("failed to relay response body:", err)
+		}
+		for name, values := range resp.Trailer {
+			w.Header()[name] = values
+		}
+		logger.WithField("size", size).Debug("response relayed")
+	}
+
+	// every block is counted while only a sample of them is logged
+	blockLogs := NewSampler(cfg.BlockLogSampleRate)
+	// exempt reports whether the client holds an exemption for the host the
+	// rule blocks, or the daily site budget lets its domain through, which it
+	// does not for clients in cooldown. redeem is the exemption the client
+	// gave in the query, to trade for a cookie instead.
+	exempt := func(r *http.Request, rule *Rule, logger *log.Entry) (ok bool, redeem string) {
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ok, redeem := s.exemptions.exempted(r, normalizeHost(r.URL.Hostname()), client, logger.WithField("rule", rule.ID)); ok {
+			return redeem == "", redeem
+		}
+		if stats.Cooldown.Until(client).IsZero() && flags.Enabled(FlagSiteBudget) && stats.Budget.Allow(blockedDomain(r, rule)) {
+			logger.WithFields(log.Fields{"rule": rule.ID, "tokens_left": stats.Budget.Remaining()}).Debug("blocked domain allowed by site budget")
+			return true, ""
+		}
+		return false, ""
+	}
+	// deny serves the block page
+	deny := func(w http.ResponseWriter, r *http.Request, rule *Rule, logger *log.Entry, msg string) {
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		cooldownUntil := stats.Cooldown.Until(client)
+		domain := blockedDomain(r, rule)
+		stats.Blocked.Add(1)
+		stats.Score.RecordBlocked()
+		stats.Daily.RecordBlocked(domain)
+		stats.Cooldown.RecordBlocked(client)
+		if blockLogs.Sample() {
+			logger.WithField("rule", rule.ID).Info(msg)
+		}
+		page := blockedPage{
+			Locale:        s.locales.For(r),
+			Host:          r.URL.Hostname(),
+			Rule:          rule.Pattern,
+			BudgetEnabled: flags.Enabled(FlagSiteBudget) && stats.Budget.Enabled(),
+			TokensLeft:    stats.Budget.Remaining(),
+		}
+		if !cooldownUntil.IsZero() {
+			page.CooldownUntil = cooldownUntil.Format("15:04")
+		}
+		serveBlocked(w, r, cfg.BlockStatusCode, page)
+	}
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// overlong targets are refused before matching or fetching anything
+		if cfg.MaxURLLength > 0 && len(r.RequestURI) > cfg.MaxURLLength {
+			// bypassed hosts leave no trace, even when refused
+			if s.rules.Load().Bypass.Match(RequestTarget(r)) != nil {
+				suppressAccessLog(r)
+			} else {
+				proxyLog.WithFields(log.Fields{"host": r.URL.Host, "length": len(r.RequestURI), "max": cfg.MaxURLLength}).Info("request URI too long")
+			}
+			markLocalResponse(r)
+			http.Error(w, "request URI too long", http.StatusRequestURITooLong)
+			return
+		}
+		// under memory pressure, requests are refused before buffering anything
+		if s.health.Shedding() {
+			stats.Shed.Add(1)
+			serveShed(w, r)
+			return
+		}
+		// with PROXY_USERS, clients authenticate and get the rules of their user
+		var user string
+		if len(cfg.users) > 0 {
+			var ok bool
+			if user, ok = cfg.users.Authenticate(r); !ok {
+				requireProxyAuth(w, r)
+				return
+			}
+			annotateAccessLog(r, log.Fields{"user": user})
+		}
+		// the whole request is evaluated against the rules current at its start
+		rules := s.rules.Load().For(user)
+		target := RequestTarget(r)
+		host := target.Host
+		if m := s.health.Maintenance(); m != nil {
+			if rules.Bypass.Match(target) != nil {
+				suppressAccessLog(r)
+			}
+			serveMaintenance(w, r, m, now())
+			return
+		}
+
+		logger := proxyLog.WithFields(log.Fields{"url": r.RequestURI})
+		if user != "" {
+			logger = logger.WithField("user", user)
+		}
+		req := Request{Target: target, Now: now()}
+		// embedded content is better identified by the page that requested it
+		if flags.Enabled(FlagBlockByReferer) {
+			req.Referer = r.Referer()
+		}
+		// exempted blocks leave the request to the next stages
+		var redeem string
+		req.Pass = func(d Decision) bool {
+			d.Rule.Hit(req.Now)
+			ok, token := exempt(r, d.Rule, blockLogger(logger, d))
+			redeem = token
+			return ok
+		}
+		d := rules.Evaluate(req)
+		for _, exception := range d.Exceptions {
+			exception.Hit(req.Now)
+		}
+		switch {
+		case d.Action == ActionBypass:
+			// bypassed hosts leave no trace besides a counter
+			d.Rule.Hit(req.Now)
+			suppressAccessLog(r)
+			stats.Bypassed.Add(1)
+			forward(w, r, silentLog, true)
+			return
+		case d.Action == ActionUpgrade:
+			d.Rule.Hit(req.Now)
+			logger.WithField("rule", d.Rule.ID).Info("request upgraded to https")
+			markLocalResponse(r)
+			http.Redirect(w, r, httpsURL(r.URL).String(), http.StatusMovedPermanently)
+			return
+		case d.Verdict == VerdictBlock && redeem != "":
+			redeemExemption(w, r, redeem)
+			return
+		case d.Verdict == VerdictBlock:
+			logger := blockLogger(logger, d)
+			msg := "request blocked"
+			switch {
+			case d.Schedule != nil:
+				msg = "request blocked by schedule"
+			case d.Referer != "":
+				msg = "request blocked by referer"
+			}
+			deny(w, r, d.Rule, logger, msg)
+			return
+		case d.Action == ActionTarpit:
+			client, _, _ := net.SplitHostPort(r.RemoteAddr)
+			// tolerated sites are blocked as well for clients in cooldown
+			if until := stats.Cooldown.Until(client); !until.IsZero() {
+				d.Rule.Hit(req.Now)
+				logger := logger.WithField("cooldown_until", until)
+				ok, redeem := exempt(r, d.Rule, logger)
+				if redeem != "" {
+					redeemExemption(w, r, redeem)
+					return
+				}
+				if !ok {
+					deny(w, r, d.Rule, logger, "request blocked during cooldown")
+					return
+				}
+			}
+			if flags.Enabled(FlagTarpit) {
+				d.Rule.Hit(req.Now)
+				delay := s.tarpit.Delay(client, host)
+				logger.WithField("delay_ns", delay.Nanoseconds()).Debug("request tarpitted")
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		if target, ok := schemeLessTarget(r); ok {
+			logger.WithField("target", target).Debug("scheme-less target")
+		}
+		forward(w, r, logger, false)
+		stats.Score.RecordAllowed()
+		if responseData, ok := r.Context().Value(responseDataKey{}).(*responseData); ok {
+			stats.Usage.Record(host, responseData.size)
 		}
-		defer req.Body.Close()
-		body, _ := io.ReadAll(req.Body)
-		log.WithFields(log.Fields{"body": body}).Debug("body was parsed")
-		w.Write(body)
-		w.WriteHeader(http.StatusOK)
 	}
 	return http.HandlerFunc(fn)
 }
 
-func init() {
-	log.SetOutput(os.Stdout)
-	log.SetFormatter(&log.JSONFormatter{})
+// blockedDomain is the domain of the rule blocking r, or the host of r for
+// the regular expressions, which have no domain of their own
+func blockedDomain(r *http.Request, rule *Rule) string {
+	if rule.Domain != "" {
+		return rule.Domain
+	}
+	return normalizeHost(r.URL.Hostname())
+}
 
-	// allow to change LOG_LEVEL via environment variable
-	logLevel, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
-	if err != nil {
-		logLevel = log.InfoLevel
+// blockLogger adds what blocked the request, besides its rule, to logger
+func blockLogger(logger *log.Entry, d Decision) *log.Entry {
+	switch {
+	case d.Schedule != nil:
+		return logger.WithField("schedule", d.Schedule.Name)
+	case d.Referer != "":
+		return logger.WithField("referer", d.Referer)
 	}
-	log.SetLevel(logLevel)
+	return logger
+}
+
+// silentLog discards everything, for requests which must leave no trace
+var silentLog = func() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(log.PanicLevel)
+	return log.NewEntry(logger)
+}()
+
+// logs routes the entries of every subsystem to its level and output
+var logs *logRouter
+
+func init() {
+	logs = configureLogging()
 }
 
 func main() {
-	http.Handle("/", WithLogging(ProxyHandler()))
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
-	}
-	addr := "localhost:" + port
-	log.WithField("addr", addr).Info("starting server")
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "test-url":
+			os.Exit(runTestURL(os.Args[2:]))
+		}
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.WithField("event", "load config").Fatal(err)
+	}
+	if cfg.LogConfig {
+		log.WithField("config", cfg.Settings(nil)).Info("effective configuration")
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
 		log.WithField("event", "start server").Fatal(err)
 	}
+	s := srv.Handler.(*Server)
+
+	// SIGHUP reloads the rules and recycles the upstream connections, e.g.
+	// after a network change
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-hup:
+				if _, err := s.Reload(); err != nil {
+					rulesLog.WithField("event", "reload").Error(err)
+				}
+			}
+		}
+	}()
+
+	listeners, err := Listen(cfg.Listeners, srv)
+	if err != nil {
+		log.WithField("event", "start server").Fatal(err)
+	}
+
+	// Serve returns as soon as shutting down starts, main waits for the end of it
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		<-stop
+		// give load balancers time to notice readyz failing before refusing connections
+		if cfg.DrainDelay > 0 {
+			s.health.Drain()
+			log.WithField("delay", cfg.DrainDelay.String()).Info("draining before shutdown")
+			time.Sleep(cfg.DrainDelay)
+		}
+		log.WithField("timeout", cfg.ShutdownTimeout.String()).Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := listeners.Shutdown(ctx); err != nil {
+			log.WithField("event", "shutdown").Error(err)
+		}
+		// the streams still relayed past the deadline are cut short, as are
+		// the tunnels, which the listeners do not wait for
+		if n := s.stats.Streams.CloseAll(); n > 0 {
+			log.WithField("streams", n).Warn("closed active streams")
+		}
+	}()
+	listeners.Serve()
+	<-shutdown
+	// shutting srv down stops the background tasks, which save the state one last time
+	srv.Shutdown(context.Background())
+	background.Wait()
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// the entries are asserted through testutil.CaptureLogs, not printed
+	logs.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig returns the default configuration, with every upstream host
+// reached at upstream
+func testConfig(t *testing.T, upstream *testutil.Upstream) *Config {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.AdminToken = testAdminToken
+	if upstream != nil {
+		cfg.transport = upstream.Trust
+	}
+	return cfg
+}
+
+// testAdminToken is the admin token of the servers of testConfig
+const testAdminToken = "4dm1n"
+
+// admin sends requests to the local endpoints with the admin token
+var admin = &http.Client{Transport: adminTransport{http.DefaultTransport}}
+
+// adminTransport adds the admin token to the requests of its transport
+type adminTransport struct {
+	http.RoundTripper
+}
+
+func (t adminTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// startProxy serves the server of cfg until the end of the test
+func startProxy(t *testing.T, cfg *Config) (*testutil.Proxy, *Server) {
+	t.Helper()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := srv.Handler.(*Server)
+	// the background tasks are over before the files of the test are removed
+	t.Cleanup(func() { <-s.done })
+	return testutil.StartProxy(t, srv), s
+}
+
+// get fetches url through the proxy, returning the response with its body read
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestProxyRelaysUpstreamResponse(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/hello", testutil.Route{
+		Status: http.StatusCreated,
+		Header: http.Header{"X-Upstream": {"yes"}},
+		Body:   "hello",
+	})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://news.test/hello", nil)
+	req.Header.Set("X-Client", "forwarded")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	resp, err := proxy.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated || string(body) != "hello" || resp.Header.Get("X-Upstream") != "yes" {
+		t.Errorf("got %d %q with X-Upstream %q, want 201 \"hello\" with yes", resp.StatusCode, body, resp.Header.Get("X-Upstream"))
+	}
+
+	requests := upstream.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("upstream got %d requests, want 1", len(requests))
+	}
+	got := requests[0]
+	if got.Host != "news.test" || got.Path != "/hello" {
+		t.Errorf("upstream got %s%s, want news.test/hello", got.Host, got.Path)
+	}
+	if got.Header.Get("X-Client") != "forwarded" {
+		t.Error("client header not forwarded")
+	}
+	if got.Header.Get("X-Hop") != "" {
+		t.Error("hop-by-hop header forwarded")
+	}
+}
+
+func TestProxyServesUnknownPathsLocally(t *testing.T) {
+	proxy, _ := startProxy(t, testConfig(t, nil))
+	resp, _ := get(t, admin, proxy.URL+"/nothing-here")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAccessLogFields(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/page", testutil.Route{Body: "0123456789"})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	get(t, proxy.Client, "http://news.test/page")
+	entries := logs.Wait(t, "request completed", 1)
+	if len(entries) != 1 {
+		t.Fatalf("got %d access entries, want 1", len(entries))
+	}
+	e := entries[0]
+	want := log.Fields{
+		"subsystem": SubsystemAccess,
+		"uri":       "http://news.test/page",
+		"method":    http.MethodGet,
+		"status":    http.StatusOK,
+		"size":      10,
+	}
+	for k, v := range want {
+		if e.Data[k] != v {
+			t.Errorf("%s = %v, want %v", k, e.Data[k], v)
+		}
+	}
+	if d, ok := e.Data["duration_ns"].(int64); !ok || d <= 0 {
+		t.Errorf("duration_ns = %v, want a positive duration", e.Data["duration_ns"])
+	}
+
+	relayed := logs.Find("response relayed")
+	if len(relayed) != 1 || relayed[0].Data["subsystem"] != SubsystemProxy || relayed[0].Data["size"] != int64(10) {
+		t.Errorf("got relay entries %+v, want one of the proxy with size 10", relayed)
+	}
+}
+
+func TestBlockByReferer(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/video.mp4", testutil.Route{Body: "video"})
+	tests := []struct {
+		name    string
+		enabled bool
+		referer string
+		want    int
+	}{
+		{"blocked referer", true, "http://news.test/article", http.StatusForbidden},
+		{"subdomain of a blocked referer", true, "https://www.news.test/", http.StatusForbidden},
+		{"unblocked referer", true, "http://docs.test/", http.StatusOK},
+		{"no referer", true, "", http.StatusOK},
+		{"unparsable referer", true, "::news.test", http.StatusOK},
+		{"disabled", false, "http://news.test/article", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, upstream)
+			cfg.Blocklist = []string{"news.test"}
+			cfg.Features[FlagBlockByReferer] = tt.enabled
+			proxy, _ := startProxy(t, cfg)
+
+			req, _ := http.NewRequest(http.MethodGet, "http://cdn.test/video.mp4", nil)
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+			resp, err := proxy.Client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripRequestHeaders(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.StripRequestHeaders = []string{"cookie", "Authorization"}
+	proxy, _ := startProxy(t, cfg)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := proxy.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := upstream.Requests()[0].Header
+	for _, name := range []string{"Cookie", "Authorization"} {
+		if got.Get(name) != "" {
+			t.Errorf("%s forwarded", name)
+		}
+	}
+	if got.Get("Accept") != "text/plain" {
+		t.Error("Accept not forwarded")
+	}
+}
+
+func TestRequestHeadersForwardedByDefault(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+	req.Header.Set("Cookie", "session=secret")
+	resp, err := proxy.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if upstream.Requests()[0].Header.Get("Cookie") != "session=secret" {
+		t.Error("Cookie not forwarded")
+	}
+}
+
+func TestBypassLeavesNoTrace(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	cfg := testConfig(t, upstream)
+	cfg.BypassHosts = []string{"bank.test"}
+	cfg.MaxURLLength = 64
+	proxy, s := startProxy(t, cfg)
+	var streams []StreamState
+	upstream.Handle("/account", testutil.Route{Handler: func(w http.ResponseWriter, r *http.Request) {
+		streams = s.stats.Streams.Stats()
+		io.WriteString(w, "balance")
+	}})
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	resp, body := get(t, proxy.Client, "http://bank.test/account")
+	if resp.StatusCode != http.StatusOK || body != "balance" {
+		t.Fatalf("got %d %q, want the upstream response", resp.StatusCode, body)
+	}
+	resp, _ = get(t, proxy.Client, "http://bank.test/"+strings.Repeat("a", 64))
+	if resp.StatusCode != http.StatusRequestURITooLong {
+		t.Errorf("got %d for an overlong target, want 414", resp.StatusCode)
+	}
+
+	for _, e := range logs.Entries() {
+		t.Errorf("bypassed request logged: %s %v", e.Message, e.Data)
+	}
+	if len(streams) != 1 || streams[0].Target != redacted {
+		t.Errorf("got streams %+v, want one with a redacted target", streams)
+	}
+	if n := s.stats.Latency.Report().Samples; n != 0 {
+		t.Errorf("got %d latency samples, want none", n)
+	}
+	if n := s.stats.Bypassed.Load(); n != 1 {
+		t.Errorf("got %d bypassed requests, want 1", n)
+	}
+	if hits := s.rules.Load().Bypass.rules[0].Hits(); hits != 1 {
+		t.Errorf("got %d hits of the bypass rule, want 1", hits)
+	}
+}
+
+func TestRuleHitsCountedOnRequests(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/docs", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test", "!news.test/docs", "unused.test"}
+	cfg.MaxURLLength = 64
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC))
+	cfg.now = clock.Now
+	proxy, s := startProxy(t, cfg)
+
+	get(t, proxy.Client, "http://news.test/")
+	get(t, proxy.Client, "http://www.news.test/")
+	get(t, proxy.Client, "http://news.test/docs")
+	// refused before any rule is evaluated
+	get(t, proxy.Client, "http://news.test/"+strings.Repeat("a", 64))
+	// the status API evaluates the rules without counting
+	get(t, http.DefaultClient, proxy.URL+"/api/status")
+
+	want := map[string]int64{"news.test": 2, "news.test/docs": 1, "unused.test": 0}
+	for _, rule := range s.rules.Load().Block.rules {
+		if rule.Hits() != want[rule.Pattern] {
+			t.Errorf("%s: got %d hits, want %d", rule.Pattern, rule.Hits(), want[rule.Pattern])
+		}
+		if rule.Hits() > 0 && !rule.LastHit().Equal(clock.Now()) || rule.Hits() == 0 && !rule.LastHit().IsZero() {
+			t.Errorf("%s: last hit %v with %d hits, want the time of the clock", rule.Pattern, rule.LastHit(), rule.Hits())
+		}
+	}
+}
+
+func TestSlowRequestWarning(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/slow", testutil.Route{Latency: 100 * time.Millisecond})
+	upstream.Handle("/fast", testutil.Route{})
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		want      []string
+	}{
+		{"threshold", 50 * time.Millisecond, []string{"http://news.test/slow"}},
+		{"disabled", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, upstream)
+			cfg.SlowRequestThreshold = tt.threshold
+			proxy, _ := startProxy(t, cfg)
+			logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+			get(t, proxy.Client, "http://news.test/slow")
+			get(t, proxy.Client, "http://news.test/fast")
+			// the requests share a connection, the warning about the first one
+			// is logged before the second one is served
+			logs.Wait(t, "request completed", 2)
+			var got []string
+			for _, e := range logs.Find("slow request") {
+				got = append(got, e.Data["uri"].(string))
+				if e.Level != log.WarnLevel || e.Data["threshold_ns"] != tt.threshold.Nanoseconds() || e.Data["duration_ns"].(int64) < tt.threshold.Nanoseconds() {
+					t.Errorf("got %v %v, want a warning above the threshold", e.Level, e.Data)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got slow requests %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// plainWriter is a response writer supporting neither flushing nor hijacking
+type plainWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *plainWriter) Header() http.Header         { return w.header }
+func (w *plainWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *plainWriter) WriteHeader(status int)      { w.status = status }
+
+func TestLoggingWriterWithoutFlushOrHijack(t *testing.T) {
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+	var hijackErr error
+	h := WithLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		_, _, hijackErr = w.(http.Hijacker).Hijack()
+		w.WriteHeader(http.StatusAccepted)
+	}), LogOptions{Flags: NewFlags(map[string]bool{FlagAccessLog: true})})
+
+	w := &plainWriter{header: make(http.Header)}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if hijackErr == nil || !strings.Contains(hijackErr.Error(), "*main.plainWriter does not support hijacking") {
+		t.Errorf("got %v, want an error naming the writer", hijackErr)
+	}
+	if w.status != http.StatusAccepted {
+		t.Errorf("got %d, want the handler to go on after both", w.status)
+	}
+	if entries := logs.Find("response writer does not support flushing"); len(entries) != 1 || entries[0].Data["writer"] != "*main.plainWriter" {
+		t.Errorf("got %+v, want one entry naming the writer", entries)
+	}
+	if entries := logs.Find("request completed"); len(entries) != 1 || entries[0].Data["hijacked"] != nil {
+		t.Errorf("got %+v, want one entry, not hijacked", entries)
+	}
+}
+
+func TestLoggingWriterHijacked(t *testing.T) {
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+	srv := httptest.NewServer(WithLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		rw.Flush()
+	}), LogOptions{Flags: NewFlags(map[string]bool{FlagAccessLog: true})}))
+	defer srv.Close()
+
+	resp, body := get(t, http.DefaultClient, srv.URL)
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("got %d %q, want the response written on the hijacked connection", resp.StatusCode, body)
+	}
+	if entries := logs.Wait(t, "request completed", 1); entries[0].Data["hijacked"] != true {
+		t.Errorf("got %+v, want the entry marked hijacked", entries[0].Data)
+	}
+}
+
+func TestRequestURITooLong(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/"+strings.Repeat("a", 100), testutil.Route{})
+	cfg := testConfig(t, upstream)
+	if cfg.MaxURLLength != 8192 {
+		t.Errorf("got MaxURLLength %d by default, want 8192", cfg.MaxURLLength)
+	}
+	cfg.Blocklist = []string{"news.test"}
+	cfg.MaxURLLength = 64
+	proxy, _ := startProxy(t, cfg)
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	// the target is counted in full, scheme and host included
+	fits := "http://docs.test/" + strings.Repeat("a", 64-len("http://docs.test/"))
+	if resp, _ := get(t, proxy.Client, fits); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d for a target of the maximum length, want it fetched", resp.StatusCode)
+	}
+	for _, target := range []string{fits + "a", "http://news.test/" + strings.Repeat("a", 64)} {
+		if resp, _ := get(t, proxy.Client, target); resp.StatusCode != http.StatusRequestURITooLong {
+			t.Errorf("%s: got %d, want 414", target, resp.StatusCode)
+		}
+	}
+	if n := len(upstream.Requests()); n != 1 {
+		t.Errorf("the upstream got %d requests, want only the one of the maximum length", n)
+	}
+	entries := logs.Find("request URI too long")
+	if len(entries) != 2 || entries[0].Data["length"] != 65 || entries[0].Data["max"] != 64 {
+		t.Errorf("got %v, want both refusals logged with their length", entries)
+	}
+	// blocked hosts are refused before matching the rules
+	if logs.Find("request blocked") != nil {
+		t.Error("an overlong target was matched against the rules")
+	}
+
+	cfg = testConfig(t, upstream)
+	cfg.MaxURLLength = 0
+	proxy, _ = startProxy(t, cfg)
+	if resp, _ := get(t, proxy.Client, "http://docs.test/"+strings.Repeat("a", 100)); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d without a limit, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultRetryAfter is advertised when maintenance has no expected end, or overruns it
+const defaultRetryAfter = time.Minute
+
+type (
+	// Maintenance describes an ongoing maintenance, during which proxy traffic gets a 503
+	Maintenance struct {
+		Message string     `json:"message,omitempty"`
+		Since   time.Time  `json:"since"`
+		Until   *time.Time `json:"until,omitempty"` // nil when no duration was given
+		Persist bool       `json:"persist"`         // saved to the state file
+	}
+
+	maintenanceRequest struct {
+		Message  string `json:"message"`
+		Duration string `json:"duration"`
+		Persist  bool   `json:"persist"`
+	}
+)
+
+// RetryAfter returns the whole seconds a client should wait before retrying at now
+func (m *Maintenance) RetryAfter(now time.Time) int {
+	wait := defaultRetryAfter
+	if m.Until != nil && m.Until.After(now) {
+		wait = m.Until.Sub(now)
+	}
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// serveMaintenance answers a proxy request made at now during maintenance
+func serveMaintenance(w http.ResponseWriter, r *http.Request, m *Maintenance, now time.Time) {
+	annotateAccessLog(r, log.Fields{"maintenance": true})
+	markLocalResponse(r)
+	w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter(now)))
+	message := m.Message
+	if message == "" {
+		message = "the proxy is under maintenance"
+	}
+	http.Error(w, message, http.StatusServiceUnavailable)
+}
+
+// maintenanceHandler starts maintenance on POST, ends it on DELETE and reports it on GET
+func maintenanceHandler(health *Health, now func() time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req maintenanceRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			m := &Maintenance{Message: req.Message, Since: now(), Persist: req.Persist}
+			if req.Duration != "" {
+				d, err := time.ParseDuration(req.Duration)
+				if err != nil || d <= 0 {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration " + strconv.Quote(req.Duration)})
+					return
+				}
+				until := m.Since.Add(d)
+				m.Until = &until
+			}
+			health.StartMaintenance(m)
+			adminLog.WithFields(log.Fields{"message": m.Message, "until": m.Until, "persist": m.Persist}).Info("maintenance started")
+		case http.MethodDelete:
+			health.StopMaintenance()
+			adminLog.Info("maintenance ended")
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"maintenance": health.Maintenance()})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestMaintenanceRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	until := now.Add(90*time.Second + time.Millisecond)
+	tests := []struct {
+		name string
+		m    *Maintenance
+		want int
+	}{
+		{"no end", &Maintenance{Since: now}, 60},
+		{"until", &Maintenance{Since: now, Until: &until}, 91},
+		{"overrun", &Maintenance{Since: now, Until: &now}, 60},
+	}
+	for _, tt := range tests {
+		if got := tt.m.RetryAfter(now); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	cfg.now = clock.Now
+	proxy, s := startProxy(t, cfg)
+	maintenance := func(method, body string) int {
+		req, _ := http.NewRequest(method, proxy.URL+"/admin/maintenance", strings.NewReader(body))
+		resp, err := admin.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := maintenance(http.MethodPost, `{"duration": "soon"}`); status != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid duration, want 400", status)
+	}
+	if status := maintenance(http.MethodPost, `{"message": "moving house", "duration": "90s"}`); status != http.StatusOK {
+		t.Fatalf("got %d starting maintenance, want 200", status)
+	}
+	if m := s.health.Maintenance(); m == nil || !m.Since.Equal(clock.Now()) {
+		t.Errorf("got %+v, want the maintenance started at the time of the clock", m)
+	}
+	clock.Advance(30 * time.Second)
+	resp, body := get(t, proxy.Client, "http://news.test/")
+	if resp.StatusCode != http.StatusServiceUnavailable || body != "moving house\n" {
+		t.Errorf("got %d %q during maintenance, want 503 with the message", resp.StatusCode, body)
+	}
+	if retry := resp.Header.Get("Retry-After"); retry != "60" {
+		t.Errorf("got Retry-After %q, want the 60s left", retry)
+	}
+	// the local endpoints stay up, reporting the maintenance
+	if resp, body := get(t, http.DefaultClient, proxy.URL+"/readyz"); resp.StatusCode != http.StatusServiceUnavailable || !strings.HasPrefix(body, "maintenance") {
+		t.Errorf("got readyz %d %q, want 503 maintenance", resp.StatusCode, body)
+	}
+	if resp, _ := get(t, admin, proxy.URL+"/admin/stats"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d for /admin/stats, want 200", resp.StatusCode)
+	}
+	if n := len(upstream.Requests()); n != 0 {
+		t.Errorf("upstream got %d requests during maintenance, want none", n)
+	}
+
+	if status := maintenance(http.MethodDelete, ""); status != http.StatusOK {
+		t.Fatalf("got %d ending maintenance, want 200", status)
+	}
+	if resp, _ := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d after maintenance, want 200", resp.StatusCode)
+	}
+	if resp, _ := get(t, http.DefaultClient, proxy.URL+"/readyz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got readyz %d after maintenance, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MetricsRoutes are the endpoints of the monitoring systems
+func MetricsRoutes(s *Server) Routes {
+	return Routes{
+		"/readyz":  readyzHandler(s.health),
+		"/metrics": metricsHandler(s.stats, s.health),
+	}
+}
+
+// metricsHandler serves the counters of the proxy in the Prometheus text format
+func metricsHandler(stats *Stats, health *Health) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metric(w, "procrastiproxy_blocked_total", "counter", "Requests blocked.", stats.Blocked.Load())
+		metric(w, "procrastiproxy_bypassed_total", "counter", "Requests to bypassed hosts.", stats.Bypassed.Load())
+		metric(w, "procrastiproxy_truncated_total", "counter", "Upstream bodies shorter than their Content-Length.", stats.Truncated.Load())
+		metric(w, "procrastiproxy_shed_total", "counter", "Requests refused under memory pressure.", stats.Shed.Load())
+		metric(w, "procrastiproxy_streams", "gauge", "Responses being relayed.", stats.Streams.Len())
+		conns := stats.Upstream.Stats()
+		metric(w, "procrastiproxy_upstream_connections_active", "gauge", "Upstream connections in use.", conns.Active)
+		metric(w, "procrastiproxy_upstream_connections_idle", "gauge", "Idle pooled upstream connections.", conns.Idle)
+		ready := 0
+		if health.Ready() {
+			ready = 1
+		}
+		metric(w, "procrastiproxy_ready", "gauge", "Whether readyz reports ready.", ready)
+		if latency := stats.Latency.Report(); latency.Samples > 0 {
+			fmt.Fprintf(w, "# HELP procrastiproxy_upstream_latency_milliseconds Latency of the recent upstream responses.\n# TYPE procrastiproxy_upstream_latency_milliseconds gauge\n")
+			fmt.Fprintf(w, "procrastiproxy_upstream_latency_milliseconds{quantile=\"0.5\"} %g\n", latency.P50)
+			fmt.Fprintf(w, "procrastiproxy_upstream_latency_milliseconds{quantile=\"0.95\"} %g\n", latency.P95)
+		}
+	}
+}
+
+// metric writes a metric without labels along with its help and type
+func metric(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
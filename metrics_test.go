@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	get(t, proxy.Client, "http://news.test/")
+	get(t, proxy.Client, "http://news.test/")
+
+	resp, body := get(t, http.DefaultClient, proxy.URL+"/metrics")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("got %d %s, want the metrics", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"# TYPE procrastiproxy_blocked_total counter\nprocrastiproxy_blocked_total 2\n",
+		"\nprocrastiproxy_bypassed_total 0\n",
+		"# TYPE procrastiproxy_streams gauge\nprocrastiproxy_streams 0\n",
+		"\nprocrastiproxy_ready 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("got\n%s\nwant %q", body, want)
+		}
+	}
+}
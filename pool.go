@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// idleCloser is the part of http.Transport the pool relies on
+type idleCloser interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// UpstreamConns counts the connections to upstreams. Open connections are the
+// ones dialed and not closed yet, active ones are those carrying a request.
+type UpstreamConns struct {
+	open   atomic.Int64
+	active atomic.Int64
+}
+
+type UpstreamConnStats struct {
+	Open   int64 `json:"open"`
+	Active int64 `json:"active"`
+	Idle   int64 `json:"idle"`
+}
+
+func (c *UpstreamConns) Stats() UpstreamConnStats {
+	open, active := c.open.Load(), c.active.Load()
+	idle := open - active
+	if idle < 0 {
+		// both counters move independently between the two loads
+		idle = 0
+	}
+	return UpstreamConnStats{Open: open, Active: active, Idle: idle}
+}
+
+// countedConn is an upstream connection of the pool, which forgets it once closed
+type countedConn struct {
+	net.Conn
+	born     time.Time
+	requests atomic.Int32 // carried at the moment, several over HTTP/2
+	once     sync.Once
+	closed   func(*countedConn)
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.closed(c) })
+	return c.Conn.Close()
+}
+
+// pooledConn returns the connection of the pool under conn, if it is one
+func pooledConn(conn net.Conn) (*countedConn, bool) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, ok := conn.(*countedConn)
+	return c, ok
+}
+
+// UpstreamPool is the round tripper to upstreams, keeping count of its
+// connections and closing them for hosts where keep-alive is disabled
+type UpstreamPool struct {
+	transport   idleCloser
+	noKeepAlive *Blocklist
+	conns       *UpstreamConns
+	now         func() time.Time
+	dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu   sync.Mutex
+	live map[*countedConn]struct{} // the open connections, for Recycle
+}
+
+func NewUpstreamPool(cfg *Config, conns *UpstreamConns) *UpstreamPool {
+	transport := newTransport(cfg)
+	p := &UpstreamPool{
+		transport:   transport,
+		noKeepAlive: NewBlocklist("no-keepalive", SourceEnv, cfg.NoKeepAliveHosts),
+		conns:       conns,
+		now:         cfg.clock(),
+		live:        make(map[*countedConn]struct{}),
+	}
+	dial := transport.DialContext
+	p.dial = dial
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &countedConn{Conn: conn, born: p.now(), closed: p.forget}
+		p.mu.Lock()
+		p.live[c] = struct{}{}
+		p.mu.Unlock()
+		conns.open.Add(1)
+		return c, nil
+	}
+	return p
+}
+
+// DialTunnel connects to the target of a CONNECT tunnel. The tunnels are
+// neither pooled nor counted with the upstream connections, the streams keep
+// track of them.
+func (p *UpstreamPool) DialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	return p.dial(ctx, "tcp", addr)
+}
+
+// forget is called once c is closed
+func (p *UpstreamPool) forget(c *countedConn) {
+	p.mu.Lock()
+	delete(p.live, c)
+	p.mu.Unlock()
+	p.conns.open.Add(-1)
+}
+
+func (p *UpstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a connection is active from the moment it is handed out until the body is closed
+	var acquired atomic.Bool
+	// the connection carrying the request, which changes when the transport retries
+	var conn atomic.Pointer[countedConn]
+	release := func() {
+		if acquired.CompareAndSwap(true, false) {
+			p.conns.active.Add(-1)
+		}
+		if c := conn.Swap(nil); c != nil {
+			c.requests.Add(-1)
+		}
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if c, ok := pooledConn(info.Conn); ok {
+				c.requests.Add(1)
+				if previous := conn.Swap(c); previous != nil {
+					previous.requests.Add(-1)
+				}
+			}
+			if acquired.CompareAndSwap(false, true) {
+				p.conns.active.Add(1)
+			}
+		},
+	})
+	outReq := req.WithContext(ctx)
+	if p.noKeepAlive.Match(URLTarget(req.URL)) != nil {
+		outReq.Close = true
+	}
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// CloseIdleConnections drops the pooled connections not carrying a request
+func (p *UpstreamPool) CloseIdleConnections() {
+	p.transport.CloseIdleConnections()
+	proxyLog.WithField("connections", p.conns.Stats()).Debug("idle upstream connections closed")
+}
+
+// Recycle closes the connections dialed more than maxAge ago until ctx is
+// done. They are checked every half of maxAge, those carrying a request
+// being closed at the first check once it is over.
+func (p *UpstreamPool) Recycle(ctx context.Context, maxAge time.Duration) {
+	ticker := time.NewTicker(maxAge / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := p.closeExpired(maxAge); n > 0 {
+				proxyLog.WithFields(log.Fields{"closed": n, "max_age": maxAge.String()}).Debug("expired upstream connections closed")
+			}
+		}
+	}
+}
+
+// closeExpired closes the idle connections dialed more than maxAge ago,
+// returning how many
+func (p *UpstreamPool) closeExpired(maxAge time.Duration) int {
+	now := p.now()
+	var expired []*countedConn
+	p.mu.Lock()
+	for c := range p.live {
+		if c.requests.Load() == 0 && now.Sub(c.born) >= maxAge {
+			expired = append(expired, c)
+		}
+	}
+	p.mu.Unlock()
+	// the transport drops the closed connections from its pool
+	for _, c := range expired {
+		c.Close()
+	}
+	return len(expired)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestCloseExpiredConnections(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "body"})
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	cfg := testConfig(t, upstream)
+	cfg.now = clock.Now
+	conns := &UpstreamConns{}
+	p := NewUpstreamPool(cfg, conns)
+	fetch := func(url string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		resp, err := p.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	done := func(resp *http.Response) {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	done(fetch("http://old.test/"))
+	clock.Advance(10 * time.Minute)
+	busy := fetch("http://old.test/")
+	done(fetch("http://young.test/"))
+	if got := conns.Stats(); got.Open != 2 {
+		t.Fatalf("got %+v, want the connections of both hosts", got)
+	}
+	// the old connection carries a request, the other one is not old enough
+	if n := p.closeExpired(10 * time.Minute); n != 0 {
+		t.Errorf("closed %d connections, want none", n)
+	}
+	done(busy)
+	if n := p.closeExpired(10 * time.Minute); n != 1 {
+		t.Errorf("closed %d connections once the request is over, want 1", n)
+	}
+	eventually(t, func() bool { return conns.Stats() == UpstreamConnStats{Open: 1, Idle: 1} }, "left with the young connection")
+	// a new connection is dialed in place of the old one
+	done(fetch("http://old.test/"))
+	if got := conns.Stats(); got.Open != 2 {
+		t.Errorf("got %+v, want a new connection", got)
+	}
+}
+
+func TestRecycle(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "body"})
+	conns := &UpstreamConns{}
+	p := NewUpstreamPool(testConfig(t, upstream), conns)
+	req, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+	resp, err := p.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Recycle(ctx, 20*time.Millisecond)
+	}()
+	eventually(t, func() bool { return conns.Stats() == UpstreamConnStats{} }, "recycled")
+	cancel()
+	<-done
+}
+
+// eventually waits for cond, failing the test after a while
+func eventually(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("still not %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUpstreamConnStats(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "body"})
+	cfg := testConfig(t, upstream)
+	cfg.NoKeepAliveHosts = []string{"once.test"}
+	conns := &UpstreamConns{}
+	p := NewUpstreamPool(cfg, conns)
+	fetch := func(url string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		resp, err := p.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := fetch("http://news.test/")
+	if got := conns.Stats(); got != (UpstreamConnStats{Open: 1, Active: 1}) {
+		t.Errorf("got %+v while reading the body, want one active connection", got)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := conns.Stats(); got != (UpstreamConnStats{Open: 1, Idle: 1}) {
+		t.Errorf("got %+v once the body is closed, want one idle connection", got)
+	}
+	// the idle connection is reused
+	resp = fetch("http://news.test/")
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := conns.Stats(); got.Open != 1 {
+		t.Errorf("got %+v, want the connection reused", got)
+	}
+	p.CloseIdleConnections()
+	eventually(t, func() bool { return conns.Stats() == UpstreamConnStats{} }, "closed after CloseIdleConnections")
+
+	// connections to hosts without keep-alive are closed after each request
+	resp = fetch("http://once.test/")
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	eventually(t, func() bool { return conns.Stats() == UpstreamConnStats{} }, "closed without keep-alive")
+}
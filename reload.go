@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadable are the settings of the rules, applied by a reload. The
+// others only take effect on restart.
+var reloadable = map[string]bool{
+	"Blocklist":        true,
+	"BlocklistFile":    true,
+	"UpgradeHosts":     true,
+	"BypassHosts":      true,
+	"TarpitHosts":      true,
+	"ScheduleFile":     true,
+	"UserBlocklistDir": true,
+	"UserBlocklists":   true,
+	"DecisionOrder":    true,
+}
+
+// ReloadReport describes a successful reload
+type ReloadReport struct {
+	Rules     int `json:"rules"`
+	Schedules int `json:"schedules"`
+	Users     int `json:"users"`
+	// RestartRequired are the changed settings left unapplied until restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reload reads the configuration and every rule file again and swaps the
+// new rules in at once, keeping the current ones on any error. The idle
+// upstream connections are closed either way, e.g. after a network change.
+func (s *Server) Reload() (ReloadReport, error) {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	defer s.pool.CloseIdleConnections()
+	loaded, err := LoadConfig()
+	if err != nil {
+		return ReloadReport{}, fmt.Errorf("load config: %w", err)
+	}
+	cfg := reloadedConfig(s.cfg, loaded)
+	rules, err := NewRules(cfg)
+	if err != nil {
+		return ReloadReport{}, fmt.Errorf("load rules: %w", err)
+	}
+	s.rules.Swap(rules)
+
+	report := ReloadReport{
+		Rules:           len(rules.All()),
+		Schedules:       len(rules.Schedules),
+		Users:           len(rules.Users),
+		RestartRequired: changedSettings(s.cfg, loaded),
+	}
+	logger := rulesLog.WithFields(log.Fields{"rules": report.Rules, "schedules": report.Schedules, "users": report.Users})
+	if len(report.RestartRequired) > 0 {
+		logger = logger.WithField("restart_required", report.RestartRequired)
+	}
+	logger.Info("rules reloaded")
+	return report, nil
+}
+
+// reloadedConfig returns a copy of cfg with the reloadable settings of
+// loaded. The settings neither cfg nor loaded got from the environment or
+// the config file are kept, such as the blocklist of a program embedding
+// the proxy.
+func reloadedConfig(cfg, loaded *Config) *Config {
+	result := *cfg
+	a, b := reflect.ValueOf(&result).Elem(), reflect.ValueOf(loaded).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if reloadable[name] && (configured(cfg, name) || configured(loaded, name)) {
+			a.Field(i).Set(b.Field(i))
+		}
+	}
+	return &result
+}
+
+// configured reports whether the setting name of cfg comes from the
+// environment or the config file
+func configured(cfg *Config, name string) bool {
+	source := cfg.sources[name]
+	return source == SourceEnv || source == SourceFile
+}
+
+// changedSettings returns the names of the configured settings differing
+// between from and to, other than the reloadable ones
+func changedSettings(from, to *Config) []string {
+	changed := []string{}
+	a, b := reflect.ValueOf(from).Elem(), reflect.ValueOf(to).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() || reloadable[field.Name] || !(configured(from, field.Name) || configured(to, field.Name)) {
+			continue
+		}
+		if _, ok := field.Tag.Lookup("env"); ok && !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reloadHandler reloads the rules on POST, answering with the errors
+// preventing it
+func reloadHandler(reload func() (ReloadReport, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := reload()
+		if err != nil {
+			adminLog.WithField("event", "reload").Error(err)
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
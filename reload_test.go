@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+// reload posts to /admin/reload, returning the status and the decoded body
+func reload(t *testing.T, proxy *testutil.Proxy, v interface{}) int {
+	t.Helper()
+	resp, err := admin.Post(proxy.URL+"/admin/reload", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func TestReloadKeepsProgrammaticRules(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	// set in code rather than configured, as a program embedding the proxy does
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	status := func(target string) int {
+		resp, _ := get(t, proxy.Client, target)
+		return resp.StatusCode
+	}
+
+	var report ReloadReport
+	if code := reload(t, proxy, &report); code != http.StatusOK || report.Rules != 1 {
+		t.Fatalf("got %d %+v, want the rule kept", code, report)
+	}
+	if got := status("http://news.test/"); got != http.StatusForbidden {
+		t.Errorf("got %d after a reload, want the programmatic blocklist kept", got)
+	}
+
+	// a configured blocklist replaces it, other settings waiting for a restart
+	t.Setenv("BLOCKLIST", "video.test")
+	t.Setenv("UPSTREAM_TIMEOUT", "5s")
+	if code := reload(t, proxy, &report); code != http.StatusOK || !reflect.DeepEqual(report.RestartRequired, []string{"UpstreamTimeout"}) {
+		t.Errorf("got %d %+v, want UpstreamTimeout waiting for a restart", code, report)
+	}
+	if news, video := status("http://news.test/"), status("http://video.test/"); news != http.StatusOK || video != http.StatusForbidden {
+		t.Errorf("got %d for news.test and %d for video.test, want the configured blocklist", news, video)
+	}
+
+	// an invalid rule keeps the current ones
+	t.Setenv("BLOCKLIST", "~(")
+	var failed map[string]string
+	if code := reload(t, proxy, &failed); code != http.StatusUnprocessableEntity || failed["error"] == "" {
+		t.Errorf("got %d %v, want the error", code, failed)
+	}
+	if got := status("http://video.test/"); got != http.StatusForbidden {
+		t.Errorf("got %d after a failed reload, want the rules kept", got)
+	}
+}
+
+func TestReloadUnderLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("news.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.BlocklistFile = path
+	proxy, _ := startProxy(t, cfg)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				resp, err := proxy.Client.Get("http://news.test/")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusForbidden {
+					t.Errorf("got %d while reloading", resp.StatusCode)
+					return
+				}
+			}
+		}()
+	}
+	// the file changing reloads the rules as well
+	for i := 0; i < 20; i++ {
+		content := "news.test\n"
+		if i%2 == 0 {
+			content = "video.test\n"
+		}
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if code := reload(t, proxy, nil); code != http.StatusOK {
+			t.Errorf("got %d reloading, want 200", code)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if resp, _ := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d, want the blocklist of the last reload", resp.StatusCode)
+	}
+}
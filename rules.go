@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rules groups the host lists the proxy evaluates. They are not modified
+// once published in a RuleSet, reloads building new ones.
+type Rules struct {
+	Block     *Blocklist
+	Upgrade   *Blocklist
+	Bypass    *Blocklist
+	Tarpit    *Blocklist
+	Schedules []*Schedule
+	// Users are the blocklists replacing Block for some users, by name
+	Users map[string]*Blocklist
+	// Stages decide on requests with these rules, in order
+	Stages Stages
+}
+
+func NewRules(cfg *Config) (*Rules, error) {
+	for _, patterns := range [][]string{cfg.Blocklist, cfg.UpgradeHosts, cfg.BypassHosts, cfg.TarpitHosts} {
+		if err := checkPatterns(patterns); err != nil {
+			return nil, err
+		}
+	}
+	stages, err := NewStages(cfg.DecisionOrder)
+	if err != nil {
+		return nil, err
+	}
+	rules := &Rules{
+		Stages:  stages,
+		Block:   NewBlocklist(ActionBlock, SourceEnv, cfg.Blocklist),
+		Upgrade: NewBlocklist(ActionUpgrade, SourceEnv, cfg.UpgradeHosts),
+		Bypass:  NewBlocklist(ActionBypass, SourceEnv, cfg.BypassHosts),
+		Tarpit:  NewBlocklist(ActionTarpit, SourceEnv, cfg.TarpitHosts),
+	}
+	if cfg.BlocklistFile != "" {
+		if err := rules.LoadBlocklistFile(cfg.BlocklistFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ScheduleFile != "" {
+		schedules, err := LoadSchedules(cfg.ScheduleFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.Schedules = schedules
+	}
+	if cfg.UserBlocklistDir != "" {
+		users, err := LoadUserBlocklists(cfg.UserBlocklistDir)
+		if err != nil {
+			return nil, err
+		}
+		rules.Users = users
+	}
+	for user, domains := range cfg.UserBlocklists {
+		if _, ok := rules.Users[user]; ok {
+			return nil, fmt.Errorf("user %q has a blocklist in both USER_BLOCKLIST_DIR and the config file", user)
+		}
+		if rules.Users == nil {
+			rules.Users = make(map[string]*Blocklist, len(cfg.UserBlocklists))
+		}
+		rules.Users[user] = NewBlocklist(ActionBlock, SourceFile, domains)
+	}
+	return rules, nil
+}
+
+// LoadUserBlocklists reads the <user>.txt files of dir, each listing the
+// rules blocked for that user in the format of BLOCKLIST_FILE
+func LoadUserBlocklists(dir string) (map[string]*Blocklist, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*Blocklist, len(paths))
+	for _, path := range paths {
+		domains, err := readRulesFile(path)
+		if err != nil {
+			return nil, err
+		}
+		users[strings.TrimSuffix(filepath.Base(path), ".txt")] = NewBlocklist(ActionBlock, SourceFile, domains)
+	}
+	return users, nil
+}
+
+// For returns the rules applying to user, whose own blocklist replaces the
+// default one when there is one
+func (r *Rules) For(user string) *Rules {
+	block, ok := r.Users[user]
+	if !ok || user == "" {
+		return r
+	}
+	rules := *r
+	rules.Block = block
+	return &rules
+}
+
+// RuleSet holds the current rules, swapped as a whole on reload so that
+// every request is evaluated against a consistent snapshot
+type RuleSet struct {
+	current atomic.Pointer[Rules]
+	mu      sync.Mutex // serializes swaps
+}
+
+func NewRuleSet(rules *Rules) *RuleSet {
+	s := &RuleSet{}
+	s.current.Store(rules)
+	return s
+}
+
+// Load returns the current rules
+func (s *RuleSet) Load() *Rules {
+	return s.current.Load()
+}
+
+// Swap publishes rules, which keep the statistics of the unchanged rules of
+// the current ones. Requests already evaluating the current rules carry on
+// with them.
+func (s *RuleSet) Swap(rules *Rules) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.current.Load()
+	rules.Block.inherit(prev.Block)
+	rules.Upgrade.inherit(prev.Upgrade)
+	rules.Bypass.inherit(prev.Bypass)
+	rules.Tarpit.inherit(prev.Tarpit)
+	schedules := make(map[string]*Schedule, len(prev.Schedules))
+	for _, schedule := range prev.Schedules {
+		schedules[schedule.Name] = schedule
+	}
+	for _, schedule := range rules.Schedules {
+		if prev, ok := schedules[schedule.Name]; ok {
+			schedule.Domains.inherit(prev.Domains)
+		}
+	}
+	for user, block := range rules.Users {
+		block.inherit(prev.Users[user])
+	}
+	s.current.Store(rules)
+}
+
+// LoadBlocklistFile replaces the blocked domains coming from the file at path,
+// which lists one rule per line with # starting a comment
+func (r *Rules) LoadBlocklistFile(path string) error {
+	domains, err := readRulesFile(path)
+	if err != nil {
+		return err
+	}
+	r.Block.Replace(SourceFile, domains)
+	return nil
+}
+
+// readRulesFile returns the checked rules of the file at path
+func readRulesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			domains = append(domains, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkPatterns(domains); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return domains, nil
+}
+
+// MatchBlock returns the block or upgrade rule applying to t, or else the
+// exception which let t through. A scheme-specific rule wins over a
+// scheme-less one, then block wins over upgrade. Upgrade rules only apply
+// to plain http.
+func (r *Rules) MatchBlock(t Target) (rule, exception *Rule) {
+	block, exception := r.Block.Lookup(t)
+	var upgrade *Rule
+	if t.Scheme == "http" {
+		var upgradeException *Rule
+		upgrade, upgradeException = r.Upgrade.Lookup(t)
+		if exception == nil {
+			exception = upgradeException
+		}
+	}
+	if block == nil || (upgrade != nil && upgrade.Scheme != "" && block.Scheme == "") {
+		block = upgrade
+	}
+	if block != nil {
+		return block, nil
+	}
+	return nil, exception
+}
+
+// MatchSchedule returns the first schedule active at now that blocks t, with
+// the matching rule, or else the first exception of an active schedule which
+// let t through
+func (r *Rules) MatchSchedule(t Target, now time.Time) (schedule *Schedule, rule, exception *Rule) {
+	for _, s := range r.Schedules {
+		if !s.Active(now) {
+			continue
+		}
+		rule, allowed := s.Domains.Lookup(t)
+		if rule != nil {
+			return s, rule, nil
+		}
+		if exception == nil {
+			exception = allowed
+		}
+	}
+	return nil, nil, exception
+}
+
+// All returns every rule, in evaluation order
+func (r *Rules) All() []*Rule {
+	lists := []*Blocklist{r.Bypass, r.Block, r.Upgrade}
+	for _, s := range r.Schedules {
+		lists = append(lists, s.Domains)
+	}
+	lists = append(lists, r.Tarpit)
+
+	var all []*Rule
+	for _, list := range lists {
+		all = append(all, list.Rules()...)
+	}
+	return all
+}
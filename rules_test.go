@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestMatchBlockSchemePrecedence(t *testing.T) {
+	rules := &Rules{
+		Block:   NewBlocklist(ActionBlock, SourceEnv, []string{"http://plain.test", "news.test", "!https://news.test/docs"}),
+		Upgrade: NewBlocklist(ActionUpgrade, SourceEnv, []string{"plain.test", "http://news.test", "docs.test"}),
+	}
+	tests := []struct {
+		scheme, host, path string
+		pattern            string // of the matching rule, empty if none
+		exception          bool
+	}{
+		// a scheme-specific block wins over a scheme-less upgrade
+		{"http", "plain.test", "/", "http://plain.test", false},
+		// the block of an http-only rule leaves https through
+		{"https", "plain.test", "/", "", false},
+		// a scheme-specific upgrade wins over a scheme-less block
+		{"http", "news.test", "/", "http://news.test", false},
+		{"https", "news.test", "/", "news.test", false},
+		{"https", "news.test", "/docs/intro", "", true},
+		// upgrades only apply to plain http
+		{"http", "docs.test", "/", "docs.test", false},
+		{"https", "docs.test", "/", "", false},
+		{"http", "other.test", "/", "", false},
+	}
+	for _, tt := range tests {
+		rule, exception := rules.MatchBlock(Target{Scheme: tt.scheme, Host: tt.host, Path: tt.path})
+		pattern := ""
+		if rule != nil {
+			pattern = rule.Pattern
+		}
+		if pattern != tt.pattern || (exception != nil) != tt.exception {
+			t.Errorf("%s://%s%s: got %q, exception %v, want %q, exception %t", tt.scheme, tt.host, tt.path, pattern, exception, tt.pattern, tt.exception)
+		}
+	}
+}
+
+func TestUpgradeRedirectsToHTTPS(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.UpgradeHosts = []string{"docs.test"}
+	proxy, _ := startProxy(t, cfg)
+
+	resp, _ := get(t, proxy.Client, "http://docs.test/page?q=1")
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://docs.test/page?q=1" {
+		t.Errorf("got %d to %q, want 301 to https://docs.test/page?q=1", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if n := len(upstream.Requests()); n != 0 {
+		t.Errorf("upstream got %d requests, want none", n)
+	}
+}
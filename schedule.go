@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// Schedule blocks its domains on the given days during the given time ranges
+	Schedule struct {
+		Name    string
+		Days    map[time.Weekday]bool
+		Ranges  []timeRange
+		Domains *Blocklist
+	}
+
+	// timeRange is a span of the day in minutes since midnight, wrapping past
+	// midnight when end is not after start
+	timeRange struct {
+		start, end int
+	}
+
+	scheduleFile struct {
+		Schedules []scheduleEntry `json:"schedules" yaml:"schedules"`
+	}
+
+	scheduleEntry struct {
+		Name    string   `json:"name" yaml:"name"`
+		Domains []string `json:"domains" yaml:"domains"`
+		Days    []string `json:"days" yaml:"days"`
+		Hours   []string `json:"hours" yaml:"hours"`
+	}
+)
+
+// SourceSchedule is the source of rules loaded from the schedule file
+const SourceSchedule = "schedule"
+
+// parseWeekday accepts full or three-letter day names such as "Monday" or "mon"
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		name := strings.ToLower(wd.String())
+		if s == name || s == name[:3] {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+// LoadSchedules reads a YAML or JSON schedule file such as:
+//
+//	schedules:
+//	  - name: mornings
+//	    domains: [news.ycombinator.com]
+//	    days: [mon, tue, wed, thu, fri]
+//	    hours: ["08:00-12:00"]
+func LoadSchedules(path string) ([]*Schedule, error) {
+	var file scheduleFile
+	if err := decodeFile(path, &file); err != nil {
+		return nil, err
+	}
+
+	var schedules []*Schedule
+	names := make(map[string]bool)
+	for i, entry := range file.Schedules {
+		s, err := newSchedule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: schedule %d: %w", path, i+1, err)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("%s: schedule %d: duplicate name %q", path, i+1, s.Name)
+		}
+		names[s.Name] = true
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func newSchedule(entry scheduleEntry) (*Schedule, error) {
+	if entry.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if len(entry.Domains) == 0 {
+		return nil, fmt.Errorf("%q: no domains", entry.Name)
+	}
+	if err := checkPatterns(entry.Domains); err != nil {
+		return nil, fmt.Errorf("%q: %w", entry.Name, err)
+	}
+	s := &Schedule{
+		Name:    entry.Name,
+		Days:    make(map[time.Weekday]bool),
+		Domains: NewBlocklist(ActionBlock, SourceSchedule+":"+entry.Name, entry.Domains),
+	}
+	// no days means every day
+	if len(entry.Days) == 0 {
+		entry.Days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	}
+	for _, day := range entry.Days {
+		wd, ok := parseWeekday(day)
+		if !ok {
+			return nil, fmt.Errorf("%q: invalid day %q", entry.Name, day)
+		}
+		s.Days[wd] = true
+	}
+	if len(entry.Hours) == 0 {
+		return nil, fmt.Errorf("%q: no hours", entry.Name)
+	}
+	for _, hours := range entry.Hours {
+		tr, err := parseTimeRange(hours)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry.Name, err)
+		}
+		s.Ranges = append(s.Ranges, tr)
+	}
+	return s, nil
+}
+
+// parseTimeRange parses a range such as "09:00-17:30"
+func parseTimeRange(s string) (timeRange, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeRange{}, fmt.Errorf("invalid hours %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return timeRange{}, fmt.Errorf("invalid hours %q: %w", s, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return timeRange{}, fmt.Errorf("invalid hours %q: %w", s, err)
+	}
+	return timeRange{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+// Active reports whether the schedule applies at t. A range wrapping past
+// midnight belongs to the day it starts on.
+func (s *Schedule) Active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+	for _, tr := range s.Ranges {
+		if tr.start < tr.end {
+			if s.Days[t.Weekday()] && minute >= tr.start && minute < tr.end {
+				return true
+			}
+			continue
+		}
+		if (s.Days[t.Weekday()] && minute >= tr.start) || (s.Days[yesterday] && minute < tr.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Window returns the span of the range of the schedule containing t, if any
+func (s *Schedule) Window(t time.Time) (start, end time.Time, ok bool) {
+	for _, tr := range s.Ranges {
+		for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+			if !s.Days[day.Weekday()] {
+				continue
+			}
+			if start, end := tr.on(day); !t.Before(start) && t.Before(end) {
+				return start, end, true
+			}
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// Next returns the start of the first range of the schedule after t, within a week
+func (s *Schedule) Next(t time.Time) (time.Time, bool) {
+	for i := 0; i <= 7; i++ {
+		day := t.AddDate(0, 0, i)
+		if !s.Days[day.Weekday()] {
+			continue
+		}
+		var next time.Time
+		for _, tr := range s.Ranges {
+			if start, _ := tr.on(day); start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// on returns the span of the range on the day of t, ending the next day when it wraps
+func (tr timeRange) on(t time.Time) (time.Time, time.Time) {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, 0, tr.start, 0, 0, t.Location())
+	end := time.Date(y, m, d, 0, tr.end, 0, 0, t.Location())
+	if tr.end <= tr.start {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
+}
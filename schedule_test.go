@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+const testSchedules = `
+schedules:
+  - name: mornings
+    domains: [news.test, video.test]
+    days: [mon, tue, wed, thu, fri]
+    hours: ["08:00-12:00"]
+  - name: work
+    domains: [news.test, "!video.test", chat.test]
+    days: [Monday, Tuesday, Wednesday, Thursday, Friday]
+    hours: ["09:00-17:00"]
+  - name: nights
+    domains: [video.test]
+    days: [fri]
+    hours: ["22:00-02:00"]
+`
+
+func writeSchedules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schedules.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMatchOverlappingSchedules(t *testing.T) {
+	schedules, err := LoadSchedules(writeSchedules(t, testSchedules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &Rules{Schedules: schedules}
+	// Monday 4 March 2024
+	monday := func(hour, min int) time.Time { return time.Date(2024, 3, 4, hour, min, 0, 0, time.UTC) }
+	tests := []struct {
+		host     string
+		now      time.Time
+		schedule string // empty when nothing blocks
+		allowed  bool   // an exception let the host through
+	}{
+		{"news.test", monday(7, 59), "", false},
+		{"news.test", monday(8, 0), "mornings", false},
+		{"news.test", monday(10, 0), "mornings", false},
+		{"news.test", monday(13, 0), "work", false},
+		{"news.test", monday(17, 0), "", false},
+		{"video.test", monday(10, 0), "mornings", false},
+		{"video.test", monday(13, 0), "", true},
+		{"chat.test", monday(8, 30), "", false},
+		{"chat.test", monday(9, 0), "work", false},
+		{"docs.test", monday(10, 0), "", false},
+		{"news.test", time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC), "", false},
+		// the range of Friday night goes on into Saturday
+		{"video.test", time.Date(2024, 3, 8, 23, 0, 0, 0, time.UTC), "nights", false},
+		{"video.test", time.Date(2024, 3, 9, 1, 59, 0, 0, time.UTC), "nights", false},
+		{"video.test", time.Date(2024, 3, 10, 1, 0, 0, 0, time.UTC), "", false},
+	}
+	for _, tt := range tests {
+		s, rule, exception := rules.MatchSchedule(Target{Scheme: "http", Host: tt.host}, tt.now)
+		name := ""
+		if s != nil {
+			name = s.Name
+			if rule == nil || rule.Source != SourceSchedule+":"+name {
+				t.Errorf("%s at %s: got rule %+v from %s", tt.host, tt.now, rule, name)
+			}
+		}
+		if name != tt.schedule || (exception != nil) != tt.allowed {
+			t.Errorf("%s at %s: got schedule %q and exception %v, want %q and %t", tt.host, tt.now.Format(time.RFC1123), name, exception, tt.schedule, tt.allowed)
+		}
+	}
+}
+
+func TestScheduleWindowAndNext(t *testing.T) {
+	schedules, err := LoadSchedules(writeSchedules(t, testSchedules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nights := schedules[2]
+	saturday := time.Date(2024, 3, 9, 1, 0, 0, 0, time.UTC)
+	start, end, ok := nights.Window(saturday)
+	if !ok || !start.Equal(time.Date(2024, 3, 8, 22, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2024, 3, 9, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("got window %s-%s %t, want Friday 22:00 to Saturday 02:00", start, end, ok)
+	}
+	next, ok := nights.Next(saturday)
+	if !ok || !next.Equal(time.Date(2024, 3, 15, 22, 0, 0, 0, time.UTC)) {
+		t.Errorf("got next %s %t, want the next Friday at 22:00", next, ok)
+	}
+}
+
+func TestLoadSchedulesErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing name":   `schedules: [{domains: [a.test], hours: ["08:00-09:00"]}]`,
+		"no domains":     `schedules: [{name: a, hours: ["08:00-09:00"]}]`,
+		"invalid day":    `schedules: [{name: a, domains: [a.test], days: [someday], hours: ["08:00-09:00"]}]`,
+		"no hours":       `schedules: [{name: a, domains: [a.test]}]`,
+		"invalid hours":  `schedules: [{name: a, domains: [a.test], hours: ["8-9"]}]`,
+		"duplicate name": `schedules: [{name: a, domains: [a.test], hours: ["08:00-09:00"]}, {name: a, domains: [b.test], hours: ["10:00-11:00"]}]`,
+	}
+	for name, content := range tests {
+		if _, err := LoadSchedules(writeSchedules(t, content)); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+func TestRequestBlockedBySchedule(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 13, 0, 0, 0, time.Local))
+	cfg := testConfig(t, upstream)
+	cfg.now = clock.Now
+	cfg.ScheduleFile = writeSchedules(t, testSchedules)
+	proxy, _ := startProxy(t, cfg)
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	resp, _ := get(t, proxy.Client, "http://news.test/")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d during work hours, want 403", resp.StatusCode)
+	}
+	entries := logs.Find("request blocked by schedule")
+	if len(entries) != 1 || entries[0].Data["schedule"] != "work" {
+		t.Errorf("got %+v, want one entry naming the work schedule", entries)
+	}
+
+	clock.Advance(5 * time.Hour)
+	resp, _ = get(t, proxy.Client, "http://news.test/")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d after work hours, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// scoreBlockedHalf is the number of blocked attempts halving the blocked component of the score
+const scoreBlockedHalf = 10
+
+type (
+	// Score rates the browsing of the current day, or since the last reset,
+	// from 0 to 100 by combining three components weighted by ScoreWeights:
+	// few blocked attempts, a long focus streak since the last one, and a high
+	// ratio of allowed requests
+	Score struct {
+		weights ScoreWeights
+		now     func() time.Time
+
+		mu          sync.Mutex
+		start       time.Time
+		lastBlocked time.Time
+		blocked     int64
+		allowed     int64
+	}
+
+	ScoreWeights struct {
+		Blocked float64 `json:"blocked"`
+		Focus   float64 `json:"focus"`
+		Allowed float64 `json:"allowed"`
+	}
+
+	// ScoreReport is the score along with its inputs, as served by /score
+	ScoreReport struct {
+		Score        float64      `json:"score"`
+		Since        time.Time    `json:"since"`
+		Blocked      int64        `json:"blocked"`
+		Allowed      int64        `json:"allowed"`
+		AllowedRatio float64      `json:"allowed_ratio"`
+		Focus        string       `json:"focus"`
+		FocusRatio   float64      `json:"focus_ratio"`
+		Weights      ScoreWeights `json:"weights"`
+	}
+)
+
+func NewScore(weights ScoreWeights) *Score {
+	s := &Score{weights: weights, now: time.Now}
+	s.start = s.now()
+	return s
+}
+
+func (s *Score) RecordBlocked() {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover(now)
+	s.blocked++
+	s.lastBlocked = now
+}
+
+func (s *Score) RecordAllowed() {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover(now)
+	s.allowed++
+}
+
+// Reset starts a new period now
+func (s *Score) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start, s.lastBlocked = s.now(), time.Time{}
+	s.blocked, s.allowed = 0, 0
+}
+
+// rollover starts a new period at midnight, must be called with mu held
+func (s *Score) rollover(now time.Time) {
+	if y, m, d := now.Date(); s.start.Year() != y || s.start.Month() != m || s.start.Day() != d {
+		s.start, s.lastBlocked = time.Date(y, m, d, 0, 0, 0, 0, now.Location()), time.Time{}
+		s.blocked, s.allowed = 0, 0
+	}
+}
+
+// Report computes the score of the current period
+func (s *Score) Report() ScoreReport {
+	now := s.now()
+	s.mu.Lock()
+	s.rollover(now)
+	report := ScoreReport{Since: s.start, Blocked: s.blocked, Allowed: s.allowed, Weights: s.weights}
+	streakStart := s.start
+	if s.lastBlocked.After(streakStart) {
+		streakStart = s.lastBlocked
+	}
+	s.mu.Unlock()
+
+	report.AllowedRatio = 1
+	if total := report.Allowed + report.Blocked; total > 0 {
+		report.AllowedRatio = float64(report.Allowed) / float64(total)
+	}
+	focus := now.Sub(streakStart)
+	report.Focus = focus.Truncate(time.Second).String()
+	report.FocusRatio = 1
+	if elapsed := now.Sub(report.Since); elapsed > 0 {
+		report.FocusRatio = float64(focus) / float64(elapsed)
+	}
+	blocked := 1 / (1 + float64(report.Blocked)/scoreBlockedHalf)
+
+	w := s.weights
+	if total := w.Blocked + w.Focus + w.Allowed; total > 0 {
+		score := 100 * (w.Blocked*blocked + w.Focus*report.FocusRatio + w.Allowed*report.AllowedRatio) / total
+		report.Score = math.Round(score*10) / 10
+	}
+	report.AllowedRatio = math.Round(report.AllowedRatio*1000) / 1000
+	report.FocusRatio = math.Round(report.FocusRatio*1000) / 1000
+	return report
+}
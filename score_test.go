@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+// newTestScore returns a score whose period starts at the time of clock
+func newTestScore(clock *testutil.Clock, weights ScoreWeights) *Score {
+	s := NewScore(weights)
+	s.now = clock.Now
+	s.Reset()
+	return s
+}
+
+func TestScore(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 8, 0, 0, 0, time.Local))
+	s := newTestScore(clock, ScoreWeights{Blocked: 1, Focus: 1, Allowed: 1})
+	if got := s.Report(); got.Score != 100 || got.AllowedRatio != 1 || got.FocusRatio != 1 {
+		t.Errorf("got %+v, want 100 before any request", got)
+	}
+
+	for i := 0; i < 30; i++ {
+		s.RecordAllowed()
+	}
+	clock.Advance(time.Hour)
+	for i := 0; i < scoreBlockedHalf; i++ {
+		s.RecordBlocked()
+	}
+	clock.Advance(time.Hour)
+	// half of the blocked component with 10 attempts, an hour of focus out
+	// of two, and 30 allowed requests out of 40
+	got := s.Report()
+	if got.Score != 58.3 || got.AllowedRatio != 0.75 || got.FocusRatio != 0.5 || got.Focus != "1h0m0s" {
+		t.Errorf("got %+v, want a score of 58.3", got)
+	}
+
+	// the weights pick the components
+	for weights, want := range map[ScoreWeights]float64{
+		{Blocked: 1}:                       50,
+		{Focus: 1}:                         50,
+		{Allowed: 1}:                       75,
+		{Blocked: 2, Allowed: 2, Focus: 0}: 62.5,
+	} {
+		s.weights = weights
+		if got := s.Report().Score; got != want {
+			t.Errorf("%+v: got %.1f, want %.1f", weights, got, want)
+		}
+	}
+}
+
+func TestScoreRollsOverAtMidnight(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 22, 0, 0, 0, time.Local))
+	s := newTestScore(clock, ScoreWeights{Blocked: 1, Focus: 1, Allowed: 1})
+	s.RecordBlocked()
+	s.RecordAllowed()
+	clock.Advance(3 * time.Hour)
+	got := s.Report()
+	if want := time.Date(2024, 3, 5, 0, 0, 0, 0, time.Local); !got.Since.Equal(want) || got.Blocked != 0 || got.Allowed != 0 || got.Score != 100 {
+		t.Errorf("got %+v, want a new period since %s", got, want)
+	}
+}
+
+func TestScoreEndpoint(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 8, 0, 0, 0, time.Local))
+	cfg := testConfig(t, upstream)
+	cfg.now = clock.Now
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	score := func(method, path string) ScoreReport {
+		req, _ := http.NewRequest(method, proxy.URL+path, nil)
+		resp, err := admin.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var report ScoreReport
+		json.NewDecoder(resp.Body).Decode(&report)
+		return report
+	}
+
+	get(t, proxy.Client, "http://docs.test/")
+	get(t, proxy.Client, "http://news.test/")
+	if got := score(http.MethodGet, "/score"); got.Allowed != 1 || got.Blocked != 1 || got.AllowedRatio != 0.5 {
+		t.Errorf("got %+v, want a request allowed and one blocked", got)
+	}
+	if got := score(http.MethodPost, "/score/reset"); got.Allowed != 0 || got.Blocked != 0 || got.Score != 100 || !got.Since.Equal(clock.Now()) {
+		t.Errorf("got %+v once reset, want a new period", got)
+	}
+}
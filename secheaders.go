@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type (
+	// localResponseKey holds a *bool set when the proxy itself produced the response
+	localResponseKey struct{}
+
+	// securityHeadersWriter adds the security headers before the response
+	// is written, if it turns out to be produced by the proxy itself
+	securityHeadersWriter struct {
+		http.ResponseWriter
+		headers http.Header
+		local   *bool
+		written bool
+	}
+)
+
+// markLocalResponse tags the response of a proxied request as produced by
+// the proxy, such as a block page, rather than relayed from the upstream
+func markLocalResponse(r *http.Request) {
+	if local, ok := r.Context().Value(localResponseKey{}).(*bool); ok {
+		*local = true
+	}
+}
+
+// securityHeaders returns the headers set on the responses of the proxy itself
+func securityHeaders(cfg *Config) http.Header {
+	return http.Header{
+		"Content-Security-Policy": {cfg.ContentSecurityPolicy},
+		"X-Content-Type-Options":  {"nosniff"},
+		"Referrer-Policy":         {cfg.ReferrerPolicy},
+		"Cache-Control":           {"no-store"},
+	}
+}
+
+// WithSecurityHeaders sets headers on the responses of the local endpoints and
+// on the ones marked by markLocalResponse, leaving relayed upstream responses untouched.
+// Headers already set by the handler are kept.
+func WithSecurityHeaders(h http.Handler, headers http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := r.URL.Host == ""
+		r = r.WithContext(context.WithValue(r.Context(), localResponseKey{}, &local))
+		h.ServeHTTP(&securityHeadersWriter{ResponseWriter: w, headers: headers, local: &local}, r)
+	})
+}
+
+func (w *securityHeadersWriter) addHeaders() {
+	if w.written {
+		return
+	}
+	w.written = true
+	if !*w.local {
+		return
+	}
+	dst := w.ResponseWriter.Header()
+	for name, values := range w.headers {
+		if _, ok := dst[name]; !ok && len(values) > 0 && values[0] != "" {
+			dst[name] = values
+		}
+	}
+}
+
+func (w *securityHeadersWriter) WriteHeader(statusCode int) {
+	w.addHeaders()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *securityHeadersWriter) Write(b []byte) (int, error) {
+	w.addHeaders()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *securityHeadersWriter) Flush() {
+	w.addHeaders()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *securityHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer %T does not support hijacking", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	upstream.Handle("/cached", testutil.Route{Header: http.Header{"Cache-Control": {"max-age=60"}}})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test"}
+	cfg.ReferrerPolicy = ""
+	proxy, _ := startProxy(t, cfg)
+	want := map[string]string{
+		"Content-Security-Policy": cfg.ContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+		"Cache-Control":           "no-store",
+	}
+
+	// the block page through the proxy, and a local endpoint
+	for client, target := range map[*http.Client]string{proxy.Client: "http://news.test/", admin: proxy.URL + "/admin/stats"} {
+		resp, _ := get(t, client, target)
+		for name, value := range want {
+			if got := resp.Header.Get(name); got != value {
+				t.Errorf("%s: got %s %q, want %q", target, name, got, value)
+			}
+		}
+		// an empty policy is not sent
+		if _, ok := resp.Header["Referrer-Policy"]; ok {
+			t.Errorf("%s: got a Referrer-Policy", target)
+		}
+	}
+
+	resp, _ := get(t, proxy.Client, "http://docs.test/")
+	for name := range want {
+		if got := resp.Header.Get(name); got != "" {
+			t.Errorf("got %s %q on a relayed response", name, got)
+		}
+	}
+	if resp, _ := get(t, proxy.Client, "http://docs.test/cached"); resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("got Cache-Control %q, want the one of the upstream", resp.Header.Get("Cache-Control"))
+	}
+}
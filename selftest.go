@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const selftestHeader = "X-Selftest"
+
+// checkResult is a row of the selftest table
+type checkResult struct {
+	name, result, detail string
+}
+
+// runSelftest implements "procrastiproxy selftest", running the proxy with
+// the current configuration against an in-process upstream
+func runSelftest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "selftest:", err)
+		return 2
+	}
+	// the proxy logs go to stderr, keeping stdout for the results
+	logs.SetOutput(os.Stderr)
+	// the site budget would let blocked requests reach the network, the
+	// cooldown and injected faults would fail the passthrough check
+	cfg.DistinctSiteBudget = 0
+	cfg.CooldownThreshold = 0
+	cfg.EnableFaults = false
+	cfg.AccessLogFormat = AccessLogJSON
+	// a maintenance saved to the state file would fail the checks of a
+	// healthy configuration, which are not to be saved either
+	cfg.StateFile, cfg.UsageFile = "", ""
+	s, err := newServer(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "selftest:", err)
+		return 2
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, r.Header)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(s.Handler([]string{RoleProxy, RoleAdmin}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	// with PROXY_USERS, the checks authenticate as the first user
+	if len(cfg.ProxyUsers) > 0 {
+		name, password, _ := strings.Cut(cfg.ProxyUsers[0], ":")
+		proxyURL.User = url.UserPassword(name, password)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var results []checkResult
+	results = append(results, checkPassthrough(client, upstream.URL, cfg.StripRequestHeaders)...)
+	results = append(results, checkBlocked(client, s.rules.Load(), cfg.BlockStatusCode))
+	results = append(results, checkSchedules(s.rules.Load(), time.Now())...)
+	results = append(results, checkReady(proxy.URL))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	failed := false
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.name, r.result, r.detail)
+		failed = failed || r.result == "FAIL"
+	}
+	tw.Flush()
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func checkPass(name, detail string) checkResult {
+	return checkResult{name, "PASS", detail}
+}
+
+func checkFail(name string, format string, args ...interface{}) checkResult {
+	return checkResult{name, "FAIL", fmt.Sprintf(format, args...)}
+}
+
+func checkSkip(name, detail string) checkResult {
+	return checkResult{name, "SKIP", detail}
+}
+
+// checkPassthrough fetches the upstream through the proxy, which must relay
+// the response and forward the request headers except the stripped ones
+func checkPassthrough(client *http.Client, upstreamURL string, strip []string) []checkResult {
+	req, _ := http.NewRequest(http.MethodGet, upstreamURL+"/selftest", nil)
+	req.Header.Set(selftestHeader, "forwarded")
+	for _, name := range strip {
+		req.Header.Set(name, "stripped")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return []checkResult{checkFail("passthrough", "%v", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []checkResult{checkFail("passthrough", "status %d", resp.StatusCode)}
+	}
+	var seen http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&seen); err != nil {
+		return []checkResult{checkFail("passthrough", "unexpected body: %v", err)}
+	}
+	results := []checkResult{checkPass("passthrough", "GET "+upstreamURL+" relayed")}
+
+	if seen.Get(selftestHeader) != "forwarded" {
+		results = append(results, checkFail("header forwarding", "%s not received by the upstream", selftestHeader))
+	} else if len(strip) == 0 {
+		results = append(results, checkPass("header forwarding", selftestHeader+" received"))
+	} else {
+		var leaked []string
+		for _, name := range strip {
+			if seen.Get(name) != "" {
+				leaked = append(leaked, name)
+			}
+		}
+		if len(leaked) > 0 {
+			results = append(results, checkFail("header forwarding", "not stripped: %s", strings.Join(leaked, ", ")))
+		} else {
+			results = append(results, checkPass("header forwarding", selftestHeader+" received, "+strings.Join(strip, ", ")+" stripped"))
+		}
+	}
+	return results
+}
+
+// checkBlocked requests the first blocked domain reachable over plain http,
+// which the proxy must answer with the block page without dialing it
+func checkBlocked(client *http.Client, rules *Rules, status int) checkResult {
+	const name = "block page"
+	var rule *Rule
+	for _, r := range rules.Block.Rules() {
+		if r.Action == ActionBlock && r.Domain != "" && r.Scheme != "https" {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return checkSkip(name, "no blocked domain configured")
+	}
+	host := rule.Domain
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := &url.URL{Scheme: "http", Host: host, Path: rule.Path}
+	target := u.String()
+	if decision := rules.Evaluate(Request{Target: URLTarget(u), Now: time.Now()}); decision.Rule != rule {
+		return checkSkip(name, target+" is not blocked by "+rule.Pattern+" but by "+decision.Action)
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return checkFail(name, "%s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode != status:
+		return checkFail(name, "%s: status %d, expected %d", target, resp.StatusCode, status)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"):
+		return checkFail(name, "%s: content type %q", target, resp.Header.Get("Content-Type"))
+	case !strings.Contains(string(body), rule.Domain):
+		return checkFail(name, "%s: page does not name %s", target, rule.Domain)
+	}
+	return checkPass(name, fmt.Sprintf("%s: %d by rule %s", target, status, rule.Pattern))
+}
+
+// checkSchedules evaluates every schedule at a time it is active and at one
+// it is not, looking ahead a week from now
+func checkSchedules(rules *Rules, now time.Time) []checkResult {
+	var results []checkResult
+	for _, s := range rules.Schedules {
+		name := "schedule " + s.Name
+		var rule *Rule
+		for _, r := range s.Domains.Rules() {
+			if r.Domain != "" {
+				rule = r
+				break
+			}
+		}
+		if rule == nil {
+			results = append(results, checkSkip(name, "no plain domain"))
+			continue
+		}
+		var active, inactive time.Time
+		start := now.Truncate(15 * time.Minute)
+		for t := start; t.Before(start.AddDate(0, 0, 7)); t = t.Add(15 * time.Minute) {
+			if s.Active(t) && active.IsZero() {
+				active = t
+			} else if !s.Active(t) && inactive.IsZero() {
+				inactive = t
+			}
+		}
+		if active.IsZero() {
+			results = append(results, checkFail(name, "never active"))
+			continue
+		}
+		target := Target{Scheme: "http", Host: rule.Domain, Path: "/"}
+		if rule.Path != "" {
+			target.Path = rule.Path
+		}
+		if d := rules.Evaluate(Request{Target: target, Now: active}); d.Action != ActionBlock {
+			results = append(results, checkFail(name, "%s not blocked at %s: %s", target, active.Format(time.RFC3339), d.Action))
+			continue
+		}
+		detail := fmt.Sprintf("%s blocked at %s", target, active.Format("Mon 15:04"))
+		if !inactive.IsZero() {
+			if d := rules.Evaluate(Request{Target: target, Now: inactive}); d.Schedule == s {
+				results = append(results, checkFail(name, "%s blocked out of schedule at %s", target, inactive.Format(time.RFC3339)))
+				continue
+			}
+			detail += ", not at " + inactive.Format("Mon 15:04")
+		}
+		results = append(results, checkPass(name, detail))
+	}
+	return results
+}
+
+func checkReady(proxyURL string) checkResult {
+	resp, err := http.Get(proxyURL + "/readyz")
+	if err != nil {
+		return checkFail("readyz", "%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return checkFail("readyz", "status %d", resp.StatusCode)
+	}
+	return checkPass("readyz", "ready")
+}
+
+// runTestURL implements "procrastiproxy test-url <url> [--at <time>]",
+// printing what the rules do with a request without making it
+func runTestURL(args []string) int {
+	flags := flag.NewFlagSet("test-url", flag.ContinueOnError)
+	at := flags.String("at", "", `time of the request, such as "2024-05-06 09:30" (default now)`)
+	connect := flags.Bool("connect", false, "evaluate an https request tunneled through CONNECT, whose path is unknown")
+	// the url may come before the flags
+	var rawURL string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		rawURL, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if rawURL == "" && flags.NArg() > 0 {
+		rawURL = flags.Arg(0)
+	}
+	if rawURL == "" {
+		fmt.Fprintln(os.Stderr, "usage: procrastiproxy test-url <url> [--at <time>] [--connect]")
+		return 2
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "test-url:", err)
+		return 2
+	}
+	u, ok := withScheme(rawURL, cfg.DefaultScheme)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "test-url: invalid url %q\n", rawURL)
+		return 2
+	}
+	now := time.Now()
+	if *at != "" {
+		if now, err = parseTime(*at); err != nil {
+			fmt.Fprintln(os.Stderr, "test-url: invalid --at:", err)
+			return 2
+		}
+	}
+	rules, err := NewRules(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "test-url:", err)
+		return 2
+	}
+
+	target := URLTarget(u)
+	if *connect {
+		target = Target{Scheme: "https", Host: target.Host}
+	}
+	d := rules.Evaluate(Request{Target: target, Now: now})
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "target:\t%s://%s\n", target.Scheme, target)
+	fmt.Fprintf(tw, "at:\t%s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(tw, "action:\t%s\n", d.Action)
+	if d.Stage != "" {
+		fmt.Fprintf(tw, "stage:\t%s\n", d.Stage)
+	}
+	if d.Rule != nil {
+		fmt.Fprintf(tw, "rule:\t%s (id %s, source %s)\n", d.Rule.Pattern, d.Rule.ID, d.Rule.Source)
+	}
+	if d.Schedule != nil {
+		fmt.Fprintf(tw, "schedule:\t%s\n", d.Schedule.Name)
+	}
+	tw.Flush()
+	return 0
+}
+
+// parseTime accepts RFC 3339 times and local times such as "2024-05-06 09:30"
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selftest runs "procrastiproxy selftest", returning its exit code and output
+func selftest(t *testing.T) (int, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the logs of the selftest go to stderr
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, devnull
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		logs.SetOutput(io.Discard)
+	}()
+	code := runSelftest(nil)
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return code, string(out)
+}
+
+// result returns the result of the check name in the output of selftest
+func result(out, name string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, name+"  ") {
+			return strings.Fields(strings.TrimPrefix(line, name))[0]
+		}
+	}
+	return ""
+}
+
+func TestSelftest(t *testing.T) {
+	t.Setenv("BLOCKLIST", "https://secure.test,news.test")
+	t.Setenv("STRIP_REQUEST_HEADERS", "Cookie")
+	t.Setenv("SCHEDULE_FILE", writeSchedules(t, testSchedules))
+	code, out := selftest(t)
+	if code != 0 {
+		t.Errorf("exited with %d:\n%s", code, out)
+	}
+	for _, name := range []string{"passthrough", "header forwarding", "block page", "schedule mornings", "schedule work", "readyz"} {
+		if got := result(out, name); got != "PASS" {
+			t.Errorf("%s: got %q, want PASS:\n%s", name, got, out)
+		}
+	}
+	// the https rule cannot be checked over plain http
+	if !strings.Contains(out, "http://news.test: 403 by rule news.test") {
+		t.Errorf("got\n%s\nwant the block page checked on news.test", out)
+	}
+}
+
+func TestSelftestWithoutBlocklist(t *testing.T) {
+	t.Setenv("BLOCKLIST", "")
+	code, out := selftest(t)
+	if code != 0 || result(out, "block page") != "SKIP" {
+		t.Errorf("exited with %d:\n%s\nwant the block page skipped", code, out)
+	}
+}
+
+func TestSelftestIgnoresState(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, nil)
+	cfg.StateFile = filepath.Join(dir, "state.json")
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.health.StartMaintenance(&Maintenance{Message: "moving house", Since: time.Now(), Persist: true})
+	if err := s.state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STATE_FILE", cfg.StateFile)
+	t.Setenv("USAGE_FILE", filepath.Join(dir, "usage.json"))
+	t.Setenv("BLOCKLIST", "news.test")
+
+	if code, out := selftest(t); code != 0 {
+		t.Errorf("exited with %d despite the saved maintenance:\n%s", code, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "usage.json")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the usage left unsaved", err)
+	}
+}
+
+func TestCheckBlockedFails(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, s := startProxy(t, cfg)
+	if r := checkBlocked(proxy.Client, s.rules.Load(), 451); r.result != "FAIL" || !strings.Contains(r.detail, "status 403, expected 451") {
+		t.Errorf("got %+v, want the status mismatch reported", r)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := map[string]time.Time{
+		"2024-05-06T09:30:00Z": time.Date(2024, 5, 6, 9, 30, 0, 0, time.UTC),
+		"2024-05-06 09:30":     time.Date(2024, 5, 6, 9, 30, 0, 0, time.Local),
+		"2024-05-06T09:30":     time.Date(2024, 5, 6, 9, 30, 0, 0, time.Local),
+		"2024-05-06":           time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local),
+	}
+	for s, want := range tests {
+		if got, err := parseTime(s); err != nil || !got.Equal(want) {
+			t.Errorf("%s: got %s, %v, want %s", s, got, err, want)
+		}
+	}
+	if _, err := parseTime("monday"); err == nil {
+		t.Error("got no error for monday")
+	}
+}
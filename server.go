@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Server holds the handlers of every role along with the state they share
+type Server struct {
+	cfg        *Config
+	rules      *RuleSet
+	tarpit     *Ramp
+	errorPage  *ErrorPage
+	locales    *Locales
+	stats      *Stats
+	health     *Health
+	flags      *Flags
+	pool       *UpstreamPool
+	exemptions *Exemptions
+	creds      *Credentials // nil without UpstreamCredentialsFile
+	faults     *Faults      // nil unless fault injection is enabled
+	state      *StateFile
+	logOptions LogOptions
+	accessLog  io.Closer
+	connState  func(net.Conn, http.ConnState)
+	proxy      http.Handler
+	routes     map[string]Routes // of the local roles
+	roles      sync.Map          // the handlers of the roles of the listeners, by roles joined with +
+	handler    http.Handler      // the handlers of the roles of each listener, wrapped by middleware
+	done       chan struct{}     // closed once the background tasks started by NewServer are over
+	reloading  sync.Mutex
+}
+
+// NewServer returns a server for every role, ready to be served on any
+// listener. Its Handler is the *Server. Its background tasks, such as saving
+// the state, run until it is shut down.
+func NewServer(cfg *Config) (*http.Server, error) {
+	s, err := newServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.Run(ctx)
+	}()
+	srv := &http.Server{
+		Handler:   s,
+		ConnState: s.connState,
+	}
+	srv.RegisterOnShutdown(cancel)
+	return srv, nil
+}
+
+// newServer loads the rules and the saved state and wires the handlers
+func newServer(cfg *Config) (*Server, error) {
+	s := &Server{cfg: cfg, health: &Health{}, flags: NewFlags(cfg.Features)}
+	var err error
+	if s.locales, err = NewLocales(cfg.TranslationsDir, cfg.DefaultLanguage); err != nil {
+		return nil, fmt.Errorf("load translations: %w", err)
+	}
+	if s.errorPage, err = NewErrorPage(cfg.ErrorPageTemplate, s.locales); err != nil {
+		return nil, fmt.Errorf("load error page: %w", err)
+	}
+	rules, err := NewRules(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("load rules: %w", err)
+	}
+	s.rules = NewRuleSet(rules)
+	s.tarpit = NewRamp(cfg.TarpitMaxDelay, cfg.TarpitRampLength, cfg.TarpitIdleGap)
+	s.stats = &Stats{
+		Usage:    NewUsage(cfg.UsageMaxHosts),
+		Daily:    NewDailyStats(),
+		Budget:   NewSiteBudget(cfg.DistinctSiteBudget),
+		Upstream: &UpstreamConns{},
+		Cooldown: NewCooldown(cfg.CooldownThreshold, cfg.CooldownWindow, cfg.CooldownDuration),
+		Streams:  NewStreams(cfg.MaxStreams, cfg.StreamMaxLifetime),
+		Score:    NewScore(cfg.scoreWeights()),
+	}
+	// every time-dependent part reads the clock of cfg
+	now := cfg.clock()
+	s.tarpit.now, s.stats.Daily.now, s.stats.Budget.now, s.stats.Cooldown.now, s.stats.Score.now, s.stats.Streams.now = now, now, now, now, now, now
+	s.stats.Score.Reset()
+	// connection lifecycle logging is only useful when debugging
+	if logs.Enabled(SubsystemProxy, log.DebugLevel) {
+		s.stats.Conns = NewConnTracker()
+		s.connState = s.stats.Conns.ConnState
+	}
+	if cfg.UsageFile != "" {
+		if err := s.stats.Usage.Load(cfg.UsageFile); err != nil {
+			return nil, fmt.Errorf("load usage: %w", err)
+		}
+	}
+	if cfg.StateFile != "" {
+		s.state = NewStateFile(cfg.StateFile, s.stats, s.health, s.rules)
+		if err := s.state.Load(); err != nil {
+			return nil, fmt.Errorf("load state: %w", err)
+		}
+	}
+	s.pool = NewUpstreamPool(cfg, s.stats.Upstream)
+	if s.exemptions, err = NewExemptions(cfg); err != nil {
+		return nil, fmt.Errorf("load exemption key: %w", err)
+	}
+	if cfg.UpstreamCredentialsFile != "" {
+		if s.creds, err = LoadCredentials(cfg.UpstreamCredentialsFile); err != nil {
+			return nil, fmt.Errorf("load upstream credentials: %w", err)
+		}
+	}
+	if cfg.AllowUpstreamOverride {
+		log.Warn("clients may pick the upstream with " + UpstreamOverrideHeader)
+	}
+
+	s.proxy = ProxyHandler(s)
+	// fault injection stays out of the chain unless enabled
+	if cfg.EnableFaults {
+		seed := cfg.FaultsSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		s.faults = NewFaults(seed)
+		if cfg.FaultsFile != "" {
+			if err := s.faults.LoadFaults(cfg.FaultsFile); err != nil {
+				return nil, fmt.Errorf("load faults: %w", err)
+			}
+		}
+		log.WithField("seed", seed).Warn("fault injection enabled")
+		s.proxy = s.faults.Middleware(s.proxy)
+	}
+	s.routes = map[string]Routes{
+		RoleWeb:     WebRoutes(s),
+		RoleAdmin:   AdminRoutes(s),
+		RoleMetrics: MetricsRoutes(s),
+	}
+
+	s.logOptions = LogOptions{
+		SlowThreshold: cfg.SlowRequestThreshold,
+		Skip:          NewLogFilter(cfg.NoLogPaths),
+		Flags:         s.flags,
+	}
+	if cfg.AccessLogFormat == AccessLogCombined {
+		out := io.Writer(os.Stdout)
+		if cfg.AccessLogFile != "" {
+			f, err := os.OpenFile(cfg.AccessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return nil, fmt.Errorf("open access log: %w", err)
+			}
+			s.accessLog, out = f, f
+		}
+		s.logOptions.Combined = NewCombinedLog(out)
+	}
+	s.handler = s.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.roleHandler(servedRoles(r)).ServeHTTP(w, r)
+	}))
+	return s, nil
+}
+
+// ServeHTTP serves r with the roles of the listener which accepted it, every
+// role for the listeners not bound by Listen
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// middleware wraps the handler of every listener
+func (s *Server) middleware(h http.Handler) http.Handler {
+	return WithDefaultScheme(WithLogging(WithSecurityHeaders(h, securityHeaders(s.cfg)), s.logOptions), s.cfg.DefaultScheme)
+}
+
+// Handler returns the handler serving the given roles
+func (s *Server) Handler(roles []string) http.Handler {
+	return s.middleware(roleHandler(roles, s.proxy, s.routes))
+}
+
+// roleHandler returns the handler of roles, built once for each combination
+func (s *Server) roleHandler(roles []string) http.Handler {
+	key := strings.Join(roles, "+")
+	if h, ok := s.roles.Load(key); ok {
+		return h.(http.Handler)
+	}
+	h, _ := s.roles.LoadOrStore(key, roleHandler(roles, s.proxy, s.routes))
+	return h.(http.Handler)
+}
+
+// Run runs the background tasks until ctx is done, saving the state one last time
+func (s *Server) Run(ctx context.Context) {
+	cfg := s.cfg
+	var background sync.WaitGroup
+	if cfg.UsageFile != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			persist(ctx, time.Minute, "save usage", func() error {
+				return s.stats.Usage.Save(cfg.UsageFile)
+			})
+		}()
+	}
+	if s.state != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			persist(ctx, time.Minute, "save state", s.state.Save)
+		}()
+	}
+	if cfg.BlocklistFile != "" {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			// the change of the blocklist reloads every rule along with it
+			err := WatchFile(ctx, cfg.BlocklistFile, func() {
+				if _, err := s.Reload(); err != nil {
+					rulesLog.WithFields(log.Fields{"event": "reload blocklist", "path": cfg.BlocklistFile}).Error(err)
+				}
+			})
+			if err != nil {
+				rulesLog.WithFields(log.Fields{"event": "watch blocklist", "path": cfg.BlocklistFile}).Error(err)
+			}
+		}()
+	}
+	if cfg.MemoryShedThreshold > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			watchMemory(ctx, s.health, uint64(cfg.MemoryShedThreshold), cfg.MemoryCheckInterval)
+		}()
+	}
+	if cfg.UpstreamConnMaxAge > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.pool.Recycle(ctx, cfg.UpstreamConnMaxAge)
+		}()
+	}
+	// the access log is written to until the end, whatever runs in the background
+	<-ctx.Done()
+	background.Wait()
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+}
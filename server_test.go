@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+// serveEmbedded serves the server of cfg with httptest, as a program embedding it would,
+// returning a client using it as its proxy
+func serveEmbedded(t *testing.T, cfg *Config) (*httptest.Server, *http.Server, *http.Client) {
+	t.Helper()
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler)
+	proxyURL, _ := url.Parse(ts.URL)
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	t.Cleanup(transport.CloseIdleConnections)
+	return ts, srv, &http.Client{Transport: transport}
+}
+
+// shutdown shuts srv down, waiting for its background tasks
+func shutdown(t *testing.T, srv *http.Server) {
+	t.Helper()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.Handler.(*Server).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background tasks still running after shutdown")
+	}
+}
+
+func TestEmbeddedServer(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test"}
+	ts, srv, client := serveEmbedded(t, cfg)
+
+	if resp, body := get(t, client, "http://docs.test/"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("got %d %q, want the upstream response", resp.StatusCode, body)
+	}
+	if resp, _ := get(t, client, "http://news.test/"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d, want the block page", resp.StatusCode)
+	}
+	// the handler of the *Server serves every role
+	if resp, _ := get(t, http.DefaultClient, ts.URL+"/readyz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d from /readyz, want 200", resp.StatusCode)
+	}
+	client.CloseIdleConnections()
+	ts.Close()
+	shutdown(t, srv)
+}
+
+func TestAccessLogOpenUntilShutdown(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	cfg := testConfig(t, upstream)
+	cfg.AccessLogFormat = AccessLogCombined
+	cfg.AccessLogFile = filepath.Join(t.TempDir(), "access.log")
+	// nothing runs in the background which could keep the server running
+	ts, srv, client := serveEmbedded(t, cfg)
+	defer ts.Close()
+
+	get(t, client, "http://docs.test/")
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(string(data), "docs.test") && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		var err error
+		if data, err = os.ReadFile(cfg.AccessLogFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(string(data), `"GET http://docs.test/ HTTP/1.1" 200 2`) {
+		t.Fatalf("got %q, want the request logged", data)
+	}
+	select {
+	case <-srv.Handler.(*Server).done:
+		t.Fatal("the server stopped before shutdown")
+	default:
+	}
+	client.CloseIdleConnections()
+	shutdown(t, srv)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shedRecovery is the fraction of the threshold memory must fall under for
+// shedding to stop, so that it does not flap around the threshold
+const shedRecovery = 0.9
+
+// memoryInUse returns the memory obtained from the system and not released
+// to it, which approximates the resident size of the process
+func memoryInUse() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys - m.HeapReleased
+}
+
+// watchMemory sheds load while the memory in use exceeds threshold bytes,
+// checking it every interval until ctx is done
+func watchMemory(ctx context.Context, health *Health, threshold uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		inUse := memoryInUse()
+		logger := proxyLog.WithFields(log.Fields{"memory_bytes": inUse, "threshold_bytes": threshold})
+		switch shedding := health.Shedding(); {
+		case !shedding && inUse > threshold:
+			health.Shed(true)
+			logger.Warn("memory over threshold, shedding load")
+		case shedding && float64(inUse) < shedRecovery*float64(threshold):
+			health.Shed(false)
+			logger.Info("memory back under threshold, load shedding stopped")
+		}
+	}
+}
+
+// serveShed refuses a proxy request while shedding load
+func serveShed(w http.ResponseWriter, r *http.Request) {
+	annotateAccessLog(r, log.Fields{"shed": true})
+	markLocalResponse(r)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "the proxy is overloaded, retry later", http.StatusServiceUnavailable)
+}
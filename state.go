@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/report"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// StateFile saves the durable statistics and settings to disk
+	StateFile struct {
+		path   string
+		stats  *Stats
+		health *Health
+		rules  *RuleSet
+	}
+
+	// persistedState is the content of the state file
+	persistedState struct {
+		Daily       map[string]report.Day `json:"daily"`
+		Budget      *BudgetState          `json:"site_budget,omitempty"`
+		Maintenance *Maintenance          `json:"maintenance,omitempty"`
+		// Rules are the statistics of the rules hit so far, by rule ID
+		Rules map[string]RuleHits `json:"rules,omitempty"`
+	}
+
+	// RuleHits are the saved statistics of a rule
+	RuleHits struct {
+		Hits    int64     `json:"hits"`
+		LastHit time.Time `json:"last_hit"`
+	}
+)
+
+func NewStateFile(path string, stats *Stats, health *Health, rules *RuleSet) *StateFile {
+	return &StateFile{path: path, stats: stats, health: health, rules: rules}
+}
+
+// Load restores the saved statistics, a missing file is not an error
+func (s *StateFile) Load() error {
+	state, err := readState(s.path)
+	if err != nil {
+		return err
+	}
+	s.stats.Daily.Restore(state.Daily)
+	if state.Budget != nil {
+		s.stats.Budget.Restore(*state.Budget)
+	}
+	if state.Maintenance != nil {
+		s.health.StartMaintenance(state.Maintenance)
+	}
+	// rules sharing an ID, such as the same pattern given twice, share their statistics
+	for _, rule := range s.rules.Load().All() {
+		if hits, ok := state.Rules[rule.ID]; ok {
+			rule.restore(hits.Hits, hits.LastHit)
+		}
+	}
+	return nil
+}
+
+func (s *StateFile) Save() error {
+	state := persistedState{
+		Daily: s.stats.Daily.Days(),
+		Rules: make(map[string]RuleHits),
+	}
+	for _, rule := range s.rules.Load().All() {
+		if hits := rule.Hits(); hits > state.Rules[rule.ID].Hits {
+			state.Rules[rule.ID] = RuleHits{Hits: hits, LastHit: rule.LastHit()}
+		}
+	}
+	if s.stats.Budget.Enabled() {
+		budget := s.stats.Budget.State()
+		state.Budget = &budget
+	}
+	// maintenance only survives restarts when requested
+	if m := s.health.Maintenance(); m != nil && m.Persist {
+		state.Maintenance = m
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// readState reads the state file at path, returning an empty state when it does not exist
+func readState(path string) (*persistedState, error) {
+	state := &persistedState{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// writeFileAtomic replaces the file at path, so readers never see it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// persist calls save every interval and once more when ctx is done, logging failures as event
+func persist(ctx context.Context, interval time.Duration, event string, save func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		done := false
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			done = true
+		}
+		if err := save(); err != nil {
+			log.WithField("event", event).Error(err)
+		}
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFileKeepsRuleHits(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.Blocklist = []string{"news.test", "video.test"}
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range s.rules.Load().Block.rules {
+		if rule.Pattern == "news.test" {
+			rule.Hit(time.Now())
+			rule.Hit(time.Now())
+		}
+	}
+	if err := s.state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart with one more rule restores the hits of the ones it had
+	cfg.Blocklist = append(cfg.Blocklist, "new.test")
+	restarted, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range restarted.rules.Load().Block.rules {
+		wantHits, hit := int64(0), false
+		if rule.Pattern == "news.test" {
+			wantHits, hit = 2, true
+		}
+		if rule.Hits() != wantHits || rule.LastHit().IsZero() == hit {
+			t.Errorf("%s: restored %d hits last at %v, want %d", rule.Pattern, rule.Hits(), rule.LastHit(), wantHits)
+		}
+		if hit && time.Since(rule.LastHit()) > time.Minute {
+			t.Errorf("%s: restored last hit %v, want the saved one", rule.Pattern, rule.LastHit())
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "sync/atomic"
+
+// Stats collects the runtime statistics shared by the proxy and admin handlers
+type Stats struct {
+	// Blocked counts every blocked request, including the ones not logged
+	Blocked atomic.Int64
+	// Bypassed counts requests to bypassed hosts, which are otherwise never recorded
+	Bypassed atomic.Int64
+	// Truncated counts the upstream bodies shorter than their Content-Length
+	Truncated atomic.Int64
+	// Shed counts the requests refused under memory pressure
+	Shed atomic.Int64
+	// Usage accounts requests and bytes per proxied host
+	Usage *Usage
+	// Daily counts the blocked attempts per day, saved to the state file
+	Daily *DailyStats
+	// Budget lets a few distinct blocked domains through each day
+	Budget *SiteBudget
+	// Cooldown tracks the clients repeatedly hitting blocked sites
+	Cooldown *Cooldown
+	// Upstream counts the pooled connections to upstreams
+	Upstream *UpstreamConns
+	// Streams registers the responses being relayed
+	Streams *Streams
+	// Latency times the recent upstream responses
+	Latency Latency
+	// Score rates the browsing of the day
+	Score *Score
+	// Conns is nil unless connection tracking is enabled
+	Conns *ConnTracker
+}
+
+// Sampler selects one in every n events, all of them when n is one or less
+type Sampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+func NewSampler(n int) *Sampler {
+	if n < 1 {
+		n = 1
+	}
+	return &Sampler{n: uint64(n)}
+}
+
+// Sample counts an event and reports whether it is selected
+func (s *Sampler) Sample() bool {
+	return (s.count.Add(1)-1)%s.n == 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSampler(t *testing.T) {
+	for _, n := range []int{-1, 0, 1, 3, 10} {
+		s := NewSampler(n)
+		var got []int
+		for i := 0; i < 10; i++ {
+			if s.Sample() {
+				got = append(got, i)
+			}
+		}
+		every := n
+		if every < 1 {
+			every = 1
+		}
+		if len(got) != (10+every-1)/every || got[0] != 0 {
+			t.Errorf("n = %d: sampled %v, want the first of every %d", n, got, every)
+		}
+	}
+}
+
+func TestSamplerConcurrent(t *testing.T) {
+	s := NewSampler(4)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sampled := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.Sample() {
+				mu.Lock()
+				sampled++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if sampled != 25 {
+		t.Errorf("sampled %d of 100, want 25", sampled)
+	}
+}
+
+func TestBlockLogsSampled(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.Blocklist = []string{"news.test"}
+	cfg.BlockLogSampleRate = 3
+	proxy, s := startProxy(t, cfg)
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	for i := 0; i < 7; i++ {
+		if resp, _ := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got %d, want 403", resp.StatusCode)
+		}
+	}
+	if n := len(logs.Find("request blocked")); n != 3 {
+		t.Errorf("logged %d of 7 blocks, want 3", n)
+	}
+	// every block is counted whatever is logged
+	if n := s.stats.Blocked.Load(); n != 7 {
+		t.Errorf("counted %d blocks, want 7", n)
+	}
+	if n := len(logs.Wait(t, "request completed", 7)); n != 7 {
+		t.Errorf("got %d access log entries, want 7", n)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statusTopDomains is the number of blocked domains listed by /api/status
+const statusTopDomains = 5
+
+// modes reported by /api/status, from the most to the least restrictive
+const (
+	ModeMaintenance = "maintenance"
+	ModeCooldown    = "cooldown"
+	ModeFocus       = "focus"
+	ModeNormal      = "normal"
+)
+
+type (
+	// Status is what /api/status reports to a client such as a browser
+	// extension. Times are absolute so that it only changes, along with its
+	// ETag, when something happens.
+	Status struct {
+		// Enforcing is false during maintenance, when nothing is proxied
+		Enforcing bool   `json:"enforcing"`
+		Mode      string `json:"mode"`
+		// Schedules are the schedules active now, with the end of their window
+		Schedules []StatusWindow `json:"schedules"`
+		// FocusUntil is the end of the last active window, NextFocus the start
+		// of the next one when none is active
+		FocusUntil       *time.Time     `json:"focus_until,omitempty"`
+		NextFocus        *time.Time     `json:"next_focus,omitempty"`
+		CooldownUntil    *time.Time     `json:"cooldown_until,omitempty"`
+		MaintenanceUntil *time.Time     `json:"maintenance_until,omitempty"`
+		BlockedToday     int64          `json:"blocked_today"`
+		TopDomains       []StatusDomain `json:"top_domains"`
+		Budget           *StatusBudget  `json:"budget,omitempty"`
+	}
+
+	StatusWindow struct {
+		Name  string    `json:"name"`
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	}
+
+	// StatusDomain is a domain blocked today, Exempt when the site budget let it through
+	StatusDomain struct {
+		Domain  string `json:"domain"`
+		Blocked int64  `json:"blocked"`
+		Exempt  bool   `json:"exempt"`
+	}
+
+	StatusBudget struct {
+		Remaining int `json:"remaining"`
+		Used      int `json:"used"`
+	}
+)
+
+// status builds the Status of client at now from snapshots of the state
+func status(rules *Rules, stats *Stats, health *Health, flags *Flags, client string, now time.Time) Status {
+	s := Status{Enforcing: true, Mode: ModeNormal, Schedules: []StatusWindow{}, TopDomains: []StatusDomain{}}
+	for _, schedule := range rules.Schedules {
+		if start, end, ok := schedule.Window(now); ok {
+			s.Schedules = append(s.Schedules, StatusWindow{Name: schedule.Name, Start: start, End: end})
+			if s.FocusUntil == nil || end.After(*s.FocusUntil) {
+				s.FocusUntil = &end
+			}
+		} else if next, ok := schedule.Next(now); ok && (s.NextFocus == nil || next.Before(*s.NextFocus)) {
+			s.NextFocus = &next
+		}
+	}
+	if s.FocusUntil != nil {
+		s.Mode, s.NextFocus = ModeFocus, nil
+	}
+	if until := stats.Cooldown.Until(client); !until.IsZero() {
+		s.Mode, s.CooldownUntil = ModeCooldown, &until
+	}
+	if m := health.Maintenance(); m != nil {
+		s.Enforcing, s.Mode, s.MaintenanceUntil = false, ModeMaintenance, m.Until
+	}
+
+	var exempt map[string]bool
+	if flags.Enabled(FlagSiteBudget) && stats.Budget.Enabled() {
+		budget := stats.Budget.State()
+		s.Budget = &StatusBudget{Remaining: budget.Remaining, Used: len(budget.Exempt)}
+		exempt = make(map[string]bool, len(budget.Exempt))
+		for _, domain := range budget.Exempt {
+			exempt[domain] = true
+		}
+	}
+	for domain, n := range stats.Daily.Today() {
+		s.BlockedToday += n
+		s.TopDomains = append(s.TopDomains, StatusDomain{Domain: domain, Blocked: n, Exempt: exempt[domain]})
+	}
+	sort.Slice(s.TopDomains, func(i, j int) bool {
+		a, b := s.TopDomains[i], s.TopDomains[j]
+		return a.Blocked > b.Blocked || (a.Blocked == b.Blocked && a.Domain < b.Domain)
+	})
+	if len(s.TopDomains) > statusTopDomains {
+		s.TopDomains = s.TopDomains[:statusTopDomains]
+	}
+	return s
+}
+
+// statusHandler serves the status of the requesting client to the origins
+// of STATUS_API_ORIGINS, guarded by STATUS_API_TOKEN when it is set
+func statusHandler(cfg *Config, rules *RuleSet, stats *Stats, health *Health, flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Add("Vary", "Origin")
+			for _, allowed := range cfg.StatusAPIOrigins {
+				if allowed == "*" || strings.EqualFold(allowed, origin) {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, If-None-Match")
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
+					break
+				}
+			}
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodOptions:
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// the dashboard reads the status with the admin credentials
+		if cfg.StatusAPIToken != "" && !(servesRole(r, RoleAdmin) && isAdmin(cfg, r)) {
+			if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(cfg.StatusAPIToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+				return
+			}
+		}
+
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		body, err := json.Marshal(status(rules.Load(), stats, health, flags, client, cfg.clock()()))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(body, '\n'))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestStatusAPI(t *testing.T) {
+	// Monday 4 March 2024, during the mornings and work schedules
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 10, 0, 0, 0, time.Local))
+	cfg := testConfig(t, nil)
+	cfg.now = clock.Now
+	cfg.ScheduleFile = writeSchedules(t, testSchedules)
+	cfg.Blocklist = []string{"video.test"}
+	cfg.StatusAPIToken = "t0ken"
+	cfg.StatusAPIOrigins = []string{"chrome-extension://abc"}
+	proxy, _ := startProxy(t, cfg)
+	fetch := func(header http.Header) (*http.Response, Status) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/api/status", nil)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s Status
+		if resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&s)
+		}
+		return resp, s
+	}
+	authorized := http.Header{"Authorization": {"Bearer t0ken"}}
+
+	for _, header := range []http.Header{{}, {"Authorization": {"Bearer wrong"}}, {"Authorization": {"t0ke"}}} {
+		if resp, _ := fetch(header); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%v: got %d, want 401", header, resp.StatusCode)
+		}
+	}
+
+	resp, s := fetch(authorized)
+	if s.Mode != ModeFocus || len(s.Schedules) != 2 || s.FocusUntil == nil || !s.FocusUntil.Equal(time.Date(2024, 3, 4, 17, 0, 0, 0, time.Local)) || !s.Enforcing {
+		t.Errorf("got %+v, want the focus until 17:00", s)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("got ETag %q and Cache-Control %q", etag, resp.Header.Get("Cache-Control"))
+	}
+
+	// the status does not change with the time alone
+	clock.Advance(time.Minute)
+	if resp, _ := fetch(http.Header{"Authorization": {"Bearer t0ken"}, "If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("got %d for an unchanged status, want 304", resp.StatusCode)
+	}
+	get(t, proxy.Client, "http://video.test/")
+	get(t, proxy.Client, "http://news.test/")
+	get(t, proxy.Client, "http://news.test/")
+	resp, s = fetch(http.Header{"Authorization": {"Bearer t0ken"}, "If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("got %d with ETag %s after a block, want a new status", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	want := []StatusDomain{{Domain: "news.test", Blocked: 2}, {Domain: "video.test", Blocked: 1}}
+	if s.BlockedToday != 3 || len(s.TopDomains) != 2 || s.TopDomains[0] != want[0] || s.TopDomains[1] != want[1] {
+		t.Errorf("got %d blocked, %+v, want %+v", s.BlockedToday, s.TopDomains, want)
+	}
+
+	// out of the schedules, the next one is announced
+	clock.Set(time.Date(2024, 3, 4, 18, 0, 0, 0, time.Local))
+	if _, s := fetch(authorized); s.Mode != ModeNormal || s.NextFocus == nil || !s.NextFocus.Equal(time.Date(2024, 3, 5, 8, 0, 0, 0, time.Local)) {
+		t.Errorf("got %+v, want the next focus on Tuesday at 08:00", s)
+	}
+}
+
+func TestStatusAPICORS(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.StatusAPIOrigins = []string{"chrome-extension://abc"}
+	proxy, _ := startProxy(t, cfg)
+	request := func(method, origin string) *http.Response {
+		req, _ := http.NewRequest(method, proxy.URL+"/api/status", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request(http.MethodGet, "CHROME-EXTENSION://abc")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "CHROME-EXTENSION://abc" || resp.Header.Get("Access-Control-Expose-Headers") != "ETag" || resp.Header.Get("Vary") != "Origin" {
+		t.Errorf("got headers %v, want the origin allowed", resp.Header)
+	}
+	if resp := request(http.MethodGet, "https://evil.test"); resp.Header.Get("Access-Control-Allow-Origin") != "" || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d allowing %q, want another origin not allowed", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if resp := request(http.MethodOptions, "chrome-extension://abc"); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Methods") != "GET" {
+		t.Errorf("got %d %v for the preflight, want 204 allowing GET", resp.StatusCode, resp.Header)
+	}
+	if resp := request(http.MethodPost, "chrome-extension://abc"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got %d for a POST, want 405", resp.StatusCode)
+	}
+}
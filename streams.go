@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errTooManyStreams = errors.New("too many concurrent streams")
+
+type (
+	// Streams registers the upstream responses and CONNECT tunnels being
+	// relayed, so that none outlives its lifetime or the shutdown, and that
+	// they can be listed and closed from the admin endpoint
+	Streams struct {
+		max         int
+		maxLifetime time.Duration
+		now         func() time.Time
+
+		mu     sync.Mutex
+		nextID uint64
+		active map[uint64]*stream
+	}
+
+	stream struct {
+		id      uint64
+		client  string
+		target  string
+		started time.Time
+		bytes   atomic.Int64
+		cancel  context.CancelFunc
+		streams *Streams
+	}
+
+	// StreamState describes an active stream, as reported by /admin/connections
+	StreamState struct {
+		ID      uint64    `json:"id"`
+		Client  string    `json:"client"`
+		Target  string    `json:"target"`
+		Started time.Time `json:"started"`
+		Age     string    `json:"age"`
+		Bytes   int64     `json:"bytes"`
+	}
+
+	// countingReader adds the bytes read to a stream
+	countingReader struct {
+		io.Reader
+		bytes *atomic.Int64
+	}
+)
+
+// NewStreams returns a registry allowing max concurrent streams, any number
+// when zero, each lasting at most maxLifetime unless it is zero
+func NewStreams(max int, maxLifetime time.Duration) *Streams {
+	return &Streams{max: max, maxLifetime: maxLifetime, now: time.Now, active: make(map[uint64]*stream)}
+}
+
+// Open registers the stream of r to target, returning the context bounding
+// its lifetime. The stream must be closed once relayed.
+func (s *Streams) Open(r *http.Request, target string) (*stream, context.Context, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.maxLifetime > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), s.maxLifetime)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && len(s.active) >= s.max {
+		cancel()
+		return nil, nil, errTooManyStreams
+	}
+	s.nextID++
+	st := &stream{
+		id:      s.nextID,
+		client:  r.RemoteAddr,
+		target:  target,
+		started: s.now(),
+		cancel:  cancel,
+		streams: s,
+	}
+	s.active[st.id] = st
+	return st, ctx, nil
+}
+
+// Body counts the bytes read from body
+func (st *stream) Body(body io.Reader) io.Reader {
+	return countingReader{body, &st.bytes}
+}
+
+// Bytes returns the number of bytes read so far
+func (st *stream) Bytes() int64 {
+	return st.bytes.Load()
+}
+
+// Close unregisters the stream and releases its context
+func (st *stream) Close() {
+	st.cancel()
+	st.streams.mu.Lock()
+	delete(st.streams.active, st.id)
+	st.streams.mu.Unlock()
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+// Kill cancels the stream with the given id, reporting whether it was active
+func (s *Streams) Kill(id uint64) bool {
+	s.mu.Lock()
+	st, ok := s.active[id]
+	s.mu.Unlock()
+	if ok {
+		st.cancel()
+	}
+	return ok
+}
+
+// CloseAll cancels every active stream, returning how many there were
+func (s *Streams) CloseAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.active {
+		st.cancel()
+	}
+	return len(s.active)
+}
+
+func (s *Streams) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
+
+// Stats returns the active streams, oldest first
+func (s *Streams) Stats() []StreamState {
+	now := s.now()
+	s.mu.Lock()
+	states := make([]StreamState, 0, len(s.active))
+	for _, st := range s.active {
+		states = append(states, StreamState{
+			ID:      st.id,
+			Client:  st.client,
+			Target:  st.target,
+			Started: st.started,
+			Age:     now.Sub(st.started).Truncate(time.Second).String(),
+			Bytes:   st.bytes.Load(),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+// connectionsHandler lists the active streams, DELETE ?id= closing one
+func connectionsHandler(streams *Streams) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, streams.Stats())
+		case http.MethodDelete:
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id " + strconv.Quote(r.URL.Query().Get("id"))})
+				return
+			}
+			if !streams.Kill(id) {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such stream"})
+				return
+			}
+			adminLog.WithField("id", id).Info("stream closed by admin")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+// endless streams a chunk every few milliseconds until the request is canceled
+func endless(w http.ResponseWriter, r *http.Request) {
+	for {
+		io.WriteString(w, "tick\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestStreamsLimit(t *testing.T) {
+	s := NewStreams(1, 0)
+	r, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+	first, _, err := s.Open(r, "http://news.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open(r, "http://news.test/"); err != errTooManyStreams {
+		t.Errorf("got %v, want %v", err, errTooManyStreams)
+	}
+	first.Close()
+	if s.Len() != 0 {
+		t.Errorf("got %d streams once closed, want 0", s.Len())
+	}
+	if st, _, err := s.Open(r, "http://news.test/"); err != nil {
+		t.Errorf("got %v once the first stream closed", err)
+	} else {
+		st.Close()
+	}
+}
+
+func TestStreamsAge(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	s := NewStreams(0, 0)
+	s.now = clock.Now
+	r, _ := http.NewRequest(http.MethodGet, "http://news.test/", nil)
+	st, _, err := s.Open(r, "http://news.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	clock.Advance(90 * time.Second)
+	if got := s.Stats(); len(got) != 1 || !got[0].Started.Equal(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)) || got[0].Age != "1m30s" {
+		t.Errorf("got %+v, want the stream started 1m30s ago", got)
+	}
+}
+
+func TestStreamsReleased(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	upstream.Handle("/drop", testutil.Route{Body: "0123456789", Drop: true, DropAfter: 4})
+	upstream.Handle("/endless", testutil.Route{Handler: endless})
+	cfg := testConfig(t, upstream)
+	cfg.StreamMaxLifetime = 200 * time.Millisecond
+	proxy, s := startProxy(t, cfg)
+	released := func(what string) {
+		t.Helper()
+		eventually(t, func() bool { return s.stats.Streams.Len() == 0 }, "released after "+what)
+	}
+
+	get(t, proxy.Client, "http://news.test/")
+	released("a complete response")
+	if resp, err := proxy.Client.Get("http://news.test/drop"); err == nil {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	released("a dropped upstream connection")
+
+	// the client going away
+	resp, err := proxy.Client.Get("http://news.test/endless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 5))
+	resp.Body.Close()
+	released("the client went away")
+
+	// the lifetime running out
+	start := time.Now()
+	resp, err = proxy.Client.Get("http://news.test/endless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the stream lasted %s, want it cut after 200ms", elapsed)
+	}
+	released("the lifetime ran out")
+}
+
+func TestCloseStreamFromAdmin(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/endless", testutil.Route{Handler: endless})
+	proxy, s := startProxy(t, testConfig(t, upstream))
+
+	resp, err := proxy.Client.Get("http://news.test/endless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	resp.Body.Read(make([]byte, 5))
+	list, err := admin.Get(proxy.URL + "/admin/connections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streams []StreamState
+	json.NewDecoder(list.Body).Decode(&streams)
+	list.Body.Close()
+	if len(streams) != 1 || streams[0].Target != "http://news.test/endless" {
+		t.Fatalf("got %+v, want the stream listed", streams)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/admin/connections?id="+strconv.FormatUint(streams[0].ID, 10), nil)
+	kill, err := admin.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kill.Body.Close()
+	if kill.StatusCode != http.StatusNoContent {
+		t.Errorf("got %d closing the stream, want 204", kill.StatusCode)
+	}
+	io.ReadAll(resp.Body)
+	eventually(t, func() bool { return s.stats.Streams.Len() == 0 }, "released once closed")
+	if again, err := admin.Do(req); err == nil {
+		again.Body.Close()
+		if again.StatusCode != http.StatusNotFound {
+			t.Errorf("got %d closing it again, want 404", again.StatusCode)
+		}
+	}
+}
+
+// connect opens a CONNECT tunnel to target through the proxy at proxyURL,
+// returning the connection with the reader of what comes out of it
+func connect(t *testing.T, proxyURL, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestConnectTunnel(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, s := startProxy(t, cfg)
+
+	conn, br, resp := connect(t, proxy.URL, "docs.test:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want the tunnel established", resp.StatusCode)
+	}
+	// the upstream of the tests speaks plain http, whatever the port
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: docs.test\r\n\r\n")
+	through, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(through.Body)
+	if string(body) != "ok" {
+		t.Errorf("got %q through the tunnel, want ok", body)
+	}
+	if got := s.stats.Streams.Stats(); len(got) != 1 || got[0].Target != "docs.test:443" || got[0].Bytes == 0 {
+		t.Errorf("got %+v, want the tunnel listed with its bytes", got)
+	}
+	conn.Close()
+	eventually(t, func() bool { return s.stats.Streams.Len() == 0 }, "released once the client closed the tunnel")
+
+	if _, _, resp := connect(t, proxy.URL, "news.test:443"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d for a blocked host, want 403", resp.StatusCode)
+	}
+	if n := s.stats.Blocked.Load(); n != 1 {
+		t.Errorf("got %d blocked requests, want 1", n)
+	}
+}
+
+func TestConnectTunnelBounded(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	cfg := testConfig(t, upstream)
+	cfg.MaxStreams = 1
+	cfg.StreamMaxLifetime = 200 * time.Millisecond
+	proxy, s := startProxy(t, cfg)
+
+	conn, br, resp := connect(t, proxy.URL, "docs.test:443")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want the tunnel established", resp.StatusCode)
+	}
+	if _, _, resp := connect(t, proxy.URL, "docs.test:443"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d for a tunnel over the limit, want 503", resp.StatusCode)
+	}
+	// the idle tunnel is closed once its lifetime runs out
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want the tunnel closed by the proxy", err)
+	}
+	eventually(t, func() bool { return s.stats.Streams.Len() == 0 }, "released after the lifetime ran out")
+}
+
+func TestCloseTunnel(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	proxy, s := startProxy(t, testConfig(t, upstream))
+	closed := func(br *bufio.Reader, conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := br.ReadByte()
+		return err == io.EOF
+	}
+
+	conn, br, _ := connect(t, proxy.URL, "docs.test:443")
+	eventually(t, func() bool { return s.stats.Streams.Len() == 1 }, "registered")
+	id := s.stats.Streams.Stats()[0].ID
+	req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/admin/connections?id="+strconv.FormatUint(id, 10), nil)
+	kill, err := admin.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kill.Body.Close()
+	if kill.StatusCode != http.StatusNoContent || !closed(br, conn) {
+		t.Errorf("got %d, want the tunnel closed by the admin", kill.StatusCode)
+	}
+
+	// the shutdown closes the tunnels, which the listeners do not wait for
+	conn, br, _ = connect(t, proxy.URL, "docs.test:443")
+	eventually(t, func() bool { return s.stats.Streams.Len() == 1 }, "registered")
+	if n := s.stats.Streams.CloseAll(); n != 1 || !closed(br, conn) {
+		t.Errorf("closed %d streams, want the tunnel closed", n)
+	}
+	eventually(t, func() bool { return s.stats.Streams.Len() == 0 }, "released once closed")
+}
+
+func TestConnectTunnelLeaks(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	proxy, s := startProxy(t, testConfig(t, upstream))
+	baseline := runtime.NumGoroutine()
+
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		conn, br, resp := connect(t, proxy.URL, "docs.test:443")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d, want the tunnel established", resp.StatusCode)
+		}
+		// half of the tunnels are in the middle of a response
+		if i%2 == 0 {
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: docs.test\r\n\r\n")
+			br.ReadByte()
+		}
+		conns = append(conns, conn)
+	}
+	eventually(t, func() bool { return s.stats.Streams.Len() == 10 }, "registered")
+	// the clients vanish, resetting their connections
+	for _, conn := range conns {
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+	eventually(t, func() bool { return s.stats.Streams.Len() == 0 }, "released once the clients vanished")
+	eventually(t, func() bool { return runtime.NumGoroutine() <= baseline }, "back to the goroutines before the tunnels")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Ramp computes a delay that grows the longer a client keeps visiting a host
+	Ramp struct {
+		max     time.Duration // delay reached at the end of the ramp
+		length  time.Duration // session length over which the delay ramps up
+		idleGap time.Duration // inactivity after which a session starts over
+		now     func() time.Time
+
+		mu        sync.Mutex
+		sessions  map[rampKey]*rampSession
+		lastPrune time.Time
+	}
+
+	rampKey struct {
+		client string
+		host   string
+	}
+
+	rampSession struct {
+		start    time.Time
+		lastSeen time.Time
+		delay    time.Duration
+	}
+
+	// RampState describes an active session, as reported by /admin/stats
+	RampState struct {
+		Client       string    `json:"client"`
+		SessionStart time.Time `json:"session_start"`
+		LastSeen     time.Time `json:"last_seen"`
+		DelayMs      int64     `json:"delay_ms"`
+	}
+)
+
+func NewRamp(max, length, idleGap time.Duration) *Ramp {
+	return &Ramp{
+		max:      max,
+		length:   length,
+		idleGap:  idleGap,
+		now:      time.Now,
+		sessions: make(map[rampKey]*rampSession),
+	}
+}
+
+// Delay records a request from client to host and returns the delay to inject
+func (r *Ramp) Delay(client, host string) time.Duration {
+	now := r.now()
+	key := rampKey{client: client, host: host}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the sessions of clients gone for good are dropped once per idle gap
+	if now.Sub(r.lastPrune) > r.idleGap {
+		r.prune(now)
+	}
+	s, ok := r.sessions[key]
+	if !ok || now.Sub(s.lastSeen) > r.idleGap {
+		s = &rampSession{start: now}
+		r.sessions[key] = s
+	}
+	s.lastSeen = now
+	s.delay = r.delayAfter(now.Sub(s.start))
+	return s.delay
+}
+
+// prune drops the sessions expired at now
+func (r *Ramp) prune(now time.Time) {
+	for key, s := range r.sessions {
+		if now.Sub(s.lastSeen) > r.idleGap {
+			delete(r.sessions, key)
+		}
+	}
+	r.lastPrune = now
+}
+
+// delayAfter ramps linearly from zero to max over the session length
+func (r *Ramp) delayAfter(elapsed time.Duration) time.Duration {
+	if r.length <= 0 || elapsed >= r.length {
+		return r.max
+	}
+	return time.Duration(float64(r.max) * float64(elapsed) / float64(r.length))
+}
+
+// Stats returns the active sessions grouped by host, dropping the expired ones
+func (r *Ramp) Stats() map[string][]RampState {
+	now := r.now()
+	stats := make(map[string][]RampState)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(now)
+	for key, s := range r.sessions {
+		stats[key.host] = append(stats[key.host], RampState{
+			Client:       key.client,
+			SessionStart: s.start,
+			LastSeen:     s.lastSeen,
+			DelayMs:      s.delay.Milliseconds(),
+		})
+	}
+	for _, states := range stats {
+		sort.Slice(states, func(i, j int) bool { return states[i].Client < states[j].Client })
+	}
+	return stats
+}
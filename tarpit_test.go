@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func newTestRamp(clock *testutil.Clock) *Ramp {
+	r := NewRamp(15*time.Second, 20*time.Minute, 5*time.Minute)
+	r.now = clock.Now
+	return r
+}
+
+func TestRampDelay(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	r := newTestRamp(clock)
+	steps := []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		{0, 0},
+		{4 * time.Minute, 3 * time.Second},
+		{4 * time.Minute, 6 * time.Second},
+		{2 * time.Minute, 7500 * time.Millisecond},
+		{5 * time.Minute, 11250 * time.Millisecond},
+		{5 * time.Minute, 15 * time.Second},
+		// the delay stays at its maximum past the ramp
+		{time.Minute, 15 * time.Second},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if got := r.Delay("10.0.0.1", "news.test"); got != step.want {
+			t.Errorf("step %d: got %s, want %s", i, got, step.want)
+		}
+	}
+}
+
+func TestRampIdleGapStartsOver(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	r := newTestRamp(clock)
+	r.Delay("10.0.0.1", "news.test")
+	clock.Advance(5 * time.Minute)
+	// an idle gap of exactly the limit keeps the session going
+	if got := r.Delay("10.0.0.1", "news.test"); got != 3750*time.Millisecond {
+		t.Errorf("got %s, want 3.75s", got)
+	}
+	clock.Advance(5*time.Minute + time.Second)
+	if got := r.Delay("10.0.0.1", "news.test"); got != 0 {
+		t.Errorf("got %s after the idle gap, want 0", got)
+	}
+}
+
+func TestRampSessionsPerClientAndHost(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	r := newTestRamp(clock)
+	r.Delay("10.0.0.1", "news.test")
+	clock.Advance(4 * time.Minute)
+	r.Delay("10.0.0.1", "news.test")
+	if got := r.Delay("10.0.0.2", "news.test"); got != 0 {
+		t.Errorf("another client got %s, want 0", got)
+	}
+	if got := r.Delay("10.0.0.1", "video.test"); got != 0 {
+		t.Errorf("another host got %s, want 0", got)
+	}
+
+	stats := r.Stats()
+	if len(stats["news.test"]) != 2 || len(stats["video.test"]) != 1 {
+		t.Fatalf("got %+v, want two sessions for news.test and one for video.test", stats)
+	}
+	first := stats["news.test"][0]
+	if first.Client != "10.0.0.1" || first.DelayMs != 3000 || !first.SessionStart.Equal(clock.Now().Add(-4*time.Minute)) {
+		t.Errorf("got %+v, want the session of 10.0.0.1 started 4m ago with 3000ms", first)
+	}
+}
+
+func TestRampPrunesExpiredSessions(t *testing.T) {
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	r := newTestRamp(clock)
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		r.Delay(client, "news.test")
+	}
+	clock.Advance(6 * time.Minute)
+	r.Delay("10.0.0.4", "news.test")
+
+	r.mu.Lock()
+	n := len(r.sessions)
+	r.mu.Unlock()
+	if n != 1 {
+		t.Errorf("got %d sessions, want only the active one", n)
+	}
+}
+
+func TestRampWithoutLength(t *testing.T) {
+	r := NewRamp(time.Second, 0, time.Minute)
+	if got := r.Delay("10.0.0.1", "news.test"); got != time.Second {
+		t.Errorf("got %s, want the maximum at once", got)
+	}
+}
+
+func TestTarpitStatsPerHost(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	clock := testutil.NewClock(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC))
+	cfg := testConfig(t, upstream)
+	cfg.now = clock.Now
+	cfg.TarpitHosts = []string{"news.test"}
+	cfg.TarpitMaxDelay, cfg.TarpitRampLength = 100*time.Millisecond, time.Minute
+	proxy, _ := startProxy(t, cfg)
+
+	get(t, proxy.Client, "http://news.test/")
+	clock.Advance(30 * time.Second)
+	start := time.Now()
+	get(t, proxy.Client, "http://news.test/")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("second request took %s, want a delay of 50ms", elapsed)
+	}
+
+	_, body := get(t, admin, proxy.URL+"/admin/stats")
+	var stats struct {
+		Tarpit map[string][]RampState `json:"tarpit"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	sessions := stats.Tarpit["news.test"]
+	if len(sessions) != 1 || sessions[0].DelayMs != 50 || sessions[0].Client != "127.0.0.1" {
+		t.Errorf("got %+v, want the session of 127.0.0.1 at 50ms", stats.Tarpit)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errResponseTooLarge = errors.New("upstream response too large")
+	errBodyTruncated    = errors.New("upstream body shorter than its Content-Length")
+)
+
+// ResponseHook inspects an upstream response before it is relayed, an error
+// vetoing it in favor of a 502. A hook transforming the body replaces
+// resp.Body and sets resp.ContentLength to the new length, or to -1 when it
+// is unknown.
+type ResponseHook func(*http.Response) error
+
+// vetoError is the error of a ResponseHook
+type vetoError struct {
+	err error
+}
+
+func (e *vetoError) Error() string {
+	return "upstream response vetoed: " + e.err.Error()
+}
+
+func (e *vetoError) Unwrap() error {
+	return e.err
+}
+
+// fixContentLength keeps the Content-Length of resp in line with its body
+// once the response hooks ran, reporting whether they replaced the upstream
+// body. The upstream length is never kept for another body, which is sent
+// chunked unless a hook gave its new length.
+func fixContentLength(resp *http.Response, upstreamBody io.ReadCloser, upstreamLength int64) bool {
+	if resp.Body == upstreamBody {
+		return false
+	}
+	resp.Header.Del("Content-Length")
+	if resp.ContentLength == upstreamLength {
+		resp.ContentLength = -1
+	}
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	return true
+}
+
+// declaresLength reports whether resp must have a body of resp.ContentLength bytes
+func declaresLength(r *http.Request, resp *http.Response) bool {
+	return resp.ContentLength > 0 && r.Method != http.MethodHead &&
+		resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+// streamed reports whether resp is flushed to the client after every write
+// rather than when the buffer of the server fills up, like a ReverseProxy
+// with a negative FlushInterval does. These are the responses of unknown
+// length and the event streams.
+func streamed(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// flushWriter flushes every write to the client
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if n > 0 {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// headerLimitError names the response header which exceeded a limit
+type headerLimitError struct {
+	Header string
+	Reason string
+}
+
+func (e *headerLimitError) Error() string {
+	return fmt.Sprintf("response header %s: %s", e.Header, e.Reason)
+}
+
+func (e *headerLimitError) Unwrap() error {
+	return errResponseTooLarge
+}
+
+// hop-by-hop headers are meant for the proxy itself and must not be forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// newUpstreamRequest copies the client request for the upstream, dropping
+// hop-by-hop headers and the configured strip list
+func newUpstreamRequest(r *http.Request, strip []string) (*http.Request, error) {
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, r.RequestURI, r.Body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.Header = r.Header.Clone()
+	removeHopByHop(outReq.Header)
+	for _, h := range strip {
+		outReq.Header.Del(h)
+	}
+	outReq.ContentLength = r.ContentLength
+	return outReq, nil
+}
+
+// removeHopByHop deletes the hop-by-hop headers, including the ones listed in Connection
+func removeHopByHop(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// copyResponseHeaders copies the end-to-end headers of an upstream response
+func copyResponseHeaders(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = append([]string(nil), values...)
+	}
+	removeHopByHop(dst)
+}
+
+// parseRetryAfter returns the delay of a Retry-After value, given either in
+// seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := date.Sub(now); d > 0 {
+		return d.Truncate(time.Second), true
+	}
+	return 0, true
+}
+
+// withScheme parses a target lacking a scheme, such as example.com:8080/path,
+// as a URL of scheme. Targets with a scheme are parsed as is. The host must
+// be an IP address or a valid host name.
+func withScheme(target, scheme string) (*url.URL, bool) {
+	if !strings.Contains(target, "://") {
+		target = scheme + "://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil || !validHost(u.Hostname()) {
+		return nil, false
+	}
+	return u, true
+}
+
+// validHost reports whether host is an IP address or made of valid DNS labels
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// schemeLessTargetKey holds the original target of a request given without a scheme
+type schemeLessTargetKey struct{}
+
+// WithDefaultScheme proxies the requests for a target without a scheme, like
+// example.com:8080/path, as if their target was scheme://example.com:8080/path.
+// The server otherwise reads such targets as an unknown scheme and serves
+// them locally. Bare targets like example.com/path are refused by net/http
+// before reaching any handler. The original target is logged by the proxy
+// once it knows the host is not bypassed.
+func WithDefaultScheme(h http.Handler, scheme string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "" && r.Method != http.MethodConnect && !strings.HasPrefix(r.RequestURI, "/") && r.RequestURI != "*" {
+			if u, ok := withScheme(r.RequestURI, scheme); ok {
+				r = r.WithContext(context.WithValue(r.Context(), schemeLessTargetKey{}, r.RequestURI))
+				r.URL, r.Host, r.RequestURI = u, u.Host, u.String()
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// schemeLessTarget returns the original target of r when it had no scheme
+func schemeLessTarget(r *http.Request) (string, bool) {
+	target, ok := r.Context().Value(schemeLessTargetKey{}).(string)
+	return target, ok
+}
+
+// UpstreamOverrideHeader names the origin to fetch instead of the requested
+// one, honored only when AllowUpstreamOverride is set
+const UpstreamOverrideHeader = "X-Upstream-Override"
+
+// overrideUpstream points outReq at the origin of the override header, keeping
+// the path and query. The header is never forwarded.
+func overrideUpstream(outReq *http.Request) (string, error) {
+	value := outReq.Header.Get(UpstreamOverrideHeader)
+	outReq.Header.Del(UpstreamOverrideHeader)
+	if value == "" {
+		return "", nil
+	}
+	origin, err := url.Parse(value)
+	if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == "" {
+		return "", fmt.Errorf("%s must be an http or https origin, got %q", UpstreamOverrideHeader, value)
+	}
+	if (origin.Path != "" && origin.Path != "/") || origin.RawQuery != "" || origin.User != nil {
+		return "", fmt.Errorf("%s must not have a path, query or user, got %q", UpstreamOverrideHeader, value)
+	}
+	outReq.URL.Scheme, outReq.URL.Host, outReq.Host = origin.Scheme, origin.Host, ""
+	return origin.Scheme + "://" + origin.Host, nil
+}
+
+// newTransport returns the transport used to reach upstreams
+func newTransport(cfg *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newUpstreamDialer(cfg.IPPreference, cfg.DialFallbackDelay).DialContext
+	transport.MaxResponseHeaderBytes = cfg.MaxResponseHeaderBytes
+	if transport.MaxResponseHeaderBytes == 0 {
+		// zero would make the transport use its own default
+		transport.MaxResponseHeaderBytes = math.MaxInt64
+	}
+	if cfg.transport != nil {
+		cfg.transport(transport)
+	}
+	return transport
+}
+
+// checkResponseHeaders ensures the upstream response headers stay within the
+// configured count and per-value size, zero meaning unlimited
+func checkResponseHeaders(h http.Header, maxCount, maxValueBytes int) error {
+	count := 0
+	for name, values := range h {
+		count += len(values)
+		if maxCount > 0 && count > maxCount {
+			return &headerLimitError{Header: name, Reason: fmt.Sprintf("more than %d headers", maxCount)}
+		}
+		for _, v := range values {
+			if maxValueBytes > 0 && len(v) > maxValueBytes {
+				return &headerLimitError{Header: name, Reason: fmt.Sprintf("value larger than %d bytes", maxValueBytes)}
+			}
+		}
+	}
+	return nil
+}
+
+// wrapTransportError recognizes the transport refusing oversized headers,
+// which it only reports as a plain error message
+func wrapTransportError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "server response headers exceeded") {
+		return fmt.Errorf("%w: %s", errResponseTooLarge, err)
+	}
+	return err
+}
+
+// requestScheme is the scheme used to match rules, CONNECT tunnels counting as https
+func requestScheme(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return "https"
+	}
+	return r.URL.Scheme
+}
+
+// httpsURL returns u over https, dropping the default http port
+func httpsURL(u *url.URL) *url.URL {
+	upgraded := *u
+	upgraded.Scheme = "https"
+	upgraded.Host = strings.TrimSuffix(upgraded.Host, ":80")
+	return &upgraded
+}
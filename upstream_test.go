@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestResponseHeaderLimits(t *testing.T) {
+	many := make(http.Header)
+	for i := 0; i < 10; i++ {
+		many.Set("X-Header-"+strconv.Itoa(i), "v")
+	}
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/many", testutil.Route{Header: many})
+	upstream.Handle("/long", testutil.Route{Header: http.Header{"X-Long": {strings.Repeat("a", 200)}}})
+	upstream.Handle("/huge", testutil.Route{Header: http.Header{"X-Huge": {strings.Repeat("a", 2000)}}})
+	upstream.Handle("/fine", testutil.Route{Header: http.Header{"X-Fine": {"yes"}}})
+	cfg := testConfig(t, upstream)
+	cfg.MaxResponseHeaders = 8
+	cfg.MaxResponseHeaderValueBytes = 100
+	cfg.MaxResponseHeaderBytes = 1000
+	proxy, _ := startProxy(t, cfg)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/many", http.StatusBadGateway},
+		{"/long", http.StatusBadGateway},
+		{"/huge", http.StatusBadGateway},
+		{"/fine", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "http://news.test"+tt.path, nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := proxy.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got upstreamError
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusOK && got.Category != categoryResponseTooLarge {
+			t.Errorf("%s: got category %q, want %q", tt.path, got.Category, categoryResponseTooLarge)
+		}
+	}
+}
+
+func TestCheckResponseHeaders(t *testing.T) {
+	h := http.Header{"A": {"1", "2"}, "B": {"333"}}
+	tests := []struct {
+		maxCount, maxValueBytes int
+		ok                      bool
+	}{
+		{0, 0, true},
+		{3, 3, true},
+		{2, 0, false},
+		{0, 2, false},
+	}
+	for _, tt := range tests {
+		err := checkResponseHeaders(h, tt.maxCount, tt.maxValueBytes)
+		if (err == nil) != tt.ok {
+			t.Errorf("limits %d, %d: got %v, want ok %t", tt.maxCount, tt.maxValueBytes, err, tt.ok)
+		}
+	}
+}
+
+func TestTrailersRelayed(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "body", Trailer: http.Header{"X-Checksum": {"abc"}}})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+
+	resp, body := get(t, proxy.Client, "http://news.test/")
+	if body != "body" || resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("got %q with trailers %v, want \"body\" with X-Checksum abc", body, resp.Trailer)
+	}
+}
+
+func TestStreamedResponsesFlushed(t *testing.T) {
+	const interval = 300 * time.Millisecond
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/chunks", testutil.Route{Body: "first;", Chunks: []string{"second;", "third"}, Interval: interval})
+	upstream.Handle("/events", testutil.Route{
+		Header:   http.Header{"Content-Type": {"text/event-stream"}},
+		Body:     "data: first\n\n",
+		Chunks:   []string{"data: second\n\n"},
+		Interval: interval,
+	})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+
+	for _, path := range []string{"/chunks", "/events"} {
+		start := time.Now()
+		resp, err := proxy.Client.Get("http://news.test" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		n, err := resp.Body.Read(buf)
+		if err != nil || !strings.Contains(string(buf[:n]), "first") {
+			t.Errorf("%s: read %q, %v, want the first chunk", path, buf[:n], err)
+		}
+		if elapsed := time.Since(start); elapsed >= interval {
+			t.Errorf("%s: first chunk after %s, before the next one %s later", path, elapsed, interval)
+		}
+		rest, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(rest), "second") {
+			t.Errorf("%s: got %q after the first chunk, want the others", path, rest)
+		}
+	}
+}
+
+func TestHTTPSOnlyUpstreams(t *testing.T) {
+	plain := testutil.NewUpstream(t)
+	plain.Handle("/", testutil.Route{Body: "plain"})
+	secure := testutil.NewTLSUpstream(t)
+	secure.Handle("/", testutil.Route{Body: "secure"})
+	tests := []struct {
+		name       string
+		upstream   *testutil.Upstream
+		tryUpgrade bool
+		status     int
+		body       string
+	}{
+		{"refused", plain, false, http.StatusBadRequest, "this proxy only fetches https:// upstreams\n"},
+		{"upgraded", secure, true, http.StatusOK, "secure"},
+		{"upgrade failing", plain, true, http.StatusBadRequest, "this proxy only fetches https:// upstreams and news.test could not be reached over https\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.upstream)
+			cfg.HTTPSOnlyUpstreams = true
+			cfg.HTTPSOnlyTryUpgrade = tt.tryUpgrade
+			proxy, _ := startProxy(t, cfg)
+
+			resp, body := get(t, proxy.Client, "http://news.test/")
+			if resp.StatusCode != tt.status || body != tt.body {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/page", testutil.Route{Handler: func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.RequestURI()+" "+r.Header.Get(UpstreamOverrideHeader))
+	}})
+	fetch := func(t *testing.T, client *http.Client, override string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://news.test/page?q=1", nil)
+		req.Header.Set(UpstreamOverrideHeader, override)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		cfg := testConfig(t, upstream)
+		cfg.AllowUpstreamOverride = true
+		proxy, _ := startProxy(t, cfg)
+		// the path and query are kept, the header is not forwarded
+		if status, body := fetch(t, proxy.Client, "http://staging.test"); status != http.StatusOK || body != "staging.test /page?q=1" {
+			t.Errorf("got %d %q, want the request sent to staging.test", status, body)
+		}
+		if status, body := fetch(t, proxy.Client, ""); status != http.StatusOK || body != "news.test /page?q=1" {
+			t.Errorf("got %d %q without the header, want the request sent to news.test", status, body)
+		}
+		for _, override := range []string{"ftp://staging.test", "staging.test", "http://staging.test/other", "http://staging.test/?a=b", "http://u:p@staging.test"} {
+			if status, body := fetch(t, proxy.Client, override); status != http.StatusBadRequest || !strings.Contains(body, UpstreamOverrideHeader) {
+				t.Errorf("%s: got %d %q, want 400", override, status, body)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		proxy, _ := startProxy(t, testConfig(t, upstream))
+		if status, body := fetch(t, proxy.Client, "http://staging.test"); status != http.StatusOK || !strings.HasPrefix(body, "news.test /page?q=1") {
+			t.Errorf("got %d %q, want the override ignored", status, body)
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"Mon, 04 Mar 2024 09:01:30 GMT", 90 * time.Second, true},
+		// a date in the past means now
+		{"Mon, 04 Mar 2024 08:00:00 GMT", 0, true},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseRetryAfter(tt.value, now); got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %s, %t, want %s, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterRelayed(t *testing.T) {
+	date := "Mon, 04 Mar 2024 09:01:30 GMT"
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/busy", testutil.Route{Status: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"120"}}})
+	upstream.Handle("/later", testutil.Route{Status: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {date}}})
+	upstream.Handle("/invalid", testutil.Route{Status: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"soon"}}})
+	proxy, _ := startProxy(t, testConfig(t, upstream))
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+
+	for path, want := range map[string]string{"/busy": "120", "/later": date, "/invalid": "soon"} {
+		if resp, _ := get(t, proxy.Client, "http://news.test"+path); resp.Header.Get("Retry-After") != want {
+			t.Errorf("%s: got Retry-After %q, want %q", path, resp.Header.Get("Retry-After"), want)
+		}
+	}
+	entries := logs.Wait(t, "upstream asked to retry later", 2)
+	for _, e := range entries {
+		if e.Data["url"] == "http://news.test/busy" && e.Data["retry_after"] != "2m0s" {
+			t.Errorf("got retry_after %v, want 2m0s", e.Data["retry_after"])
+		}
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d entries, want the invalid value left out", len(entries))
+	}
+	for _, e := range logs.Wait(t, "request completed", 3) {
+		if e.Data["uri"] == "http://news.test/busy" && e.Data["retry_after"] != "2m0s" {
+			t.Errorf("got retry_after %v in the access log, want 2m0s", e.Data["retry_after"])
+		}
+	}
+}
+
+// getError fetches url asking for a JSON error, returning the status and the error
+func getError(t *testing.T, client *http.Client, url string) (int, upstreamError) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got upstreamError
+	json.NewDecoder(resp.Body).Decode(&got)
+	return resp.StatusCode, got
+}
+
+func TestUpstreamClosedEarly(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/short", testutil.Route{Body: "0123456789", Drop: true, DropAfter: 4})
+	cfg := testConfig(t, upstream)
+	cfg.RelayBufferBytes = 6
+	proxy, s := startProxy(t, cfg)
+
+	// cut within the buffer, the client gets an error page instead
+	if status, got := getError(t, proxy.Client, "http://news.test/short"); status != http.StatusBadGateway || got.Category != categoryTruncated {
+		t.Errorf("got %d %+v, want a 502 for a truncated body", status, got)
+	}
+	if n := s.stats.Truncated.Load(); n != 1 {
+		t.Errorf("counted %d truncated bodies, want 1", n)
+	}
+
+	// cut after the buffer, the headers are sent already
+	upstream.Handle("/short", testutil.Route{Body: "0123456789", Drop: true, DropAfter: 8})
+	resp, err := proxy.Client.Get("http://news.test/short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 10 || err != io.ErrUnexpectedEOF || string(body) != "01234567" {
+		t.Errorf("got %d %q, %v, want the body cut short of its length", resp.StatusCode, body, err)
+	}
+	eventually(t, func() bool { return s.stats.Truncated.Load() == 2 }, "counted twice")
+}
+
+func TestRelayBufferCapped(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/page", testutil.Route{Body: strings.Repeat("a", 1000)})
+	// a length no buffer could hold, of a body which never comes
+	upstream.Handle("/huge", testutil.Route{Handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(1<<40))
+		io.WriteString(w, "abc")
+	}})
+	cfg := testConfig(t, upstream)
+	cfg.RelayBufferBytes = 16
+	proxy, _ := startProxy(t, cfg)
+
+	if resp, body := get(t, proxy.Client, "http://news.test/page"); resp.StatusCode != http.StatusOK || len(body) != 1000 {
+		t.Errorf("got %d with %d bytes, want the whole body past the buffer", resp.StatusCode, len(body))
+	}
+	if status, got := getError(t, proxy.Client, "http://news.test/huge"); status != http.StatusBadGateway || got.Category != categoryTruncated {
+		t.Errorf("got %d %+v, want a 502 for a truncated body", status, got)
+	}
+}
+
+func TestResponseHookVeto(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "ok"})
+	upstream.Handle("/tracker", testutil.Route{Header: http.Header{"X-Tracker": {"yes"}}, Body: "tracked"})
+	cfg := testConfig(t, upstream)
+	var hooked []string
+	cfg.ResponseHooks = []ResponseHook{
+		func(resp *http.Response) error {
+			hooked = append(hooked, resp.Request.URL.Path)
+			if resp.Header.Get("X-Tracker") != "" {
+				return errors.New("tracker response")
+			}
+			return nil
+		},
+		func(resp *http.Response) error {
+			hooked = append(hooked, "second "+resp.Request.URL.Path)
+			return nil
+		},
+	}
+	proxy, _ := startProxy(t, cfg)
+
+	if resp, body := get(t, proxy.Client, "http://news.test/"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("got %d %q, want the response let through", resp.StatusCode, body)
+	}
+	if status, got := getError(t, proxy.Client, "http://news.test/tracker"); status != http.StatusBadGateway || got.Category != categoryRejected {
+		t.Errorf("got %d %+v, want a 502 for a vetoed response", status, got)
+	}
+	// the hooks after a veto are not called
+	if want := []string{"/", "second /", "/tracker"}; !reflect.DeepEqual(hooked, want) {
+		t.Errorf("hooks called for %q, want %q", hooked, want)
+	}
+}
+
+func TestResponseHookTransformsBody(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	for _, path := range []string{"/known", "/unknown", "/stale"} {
+		upstream.Handle(path, testutil.Route{Body: "short"})
+	}
+	upstream.Handle("/untouched", testutil.Route{Body: "short"})
+	cfg := testConfig(t, upstream)
+	const longer = "a body much longer than the upstream one"
+	cfg.ResponseHooks = []ResponseHook{
+		func(resp *http.Response) error {
+			if resp.Request.URL.Path == "/untouched" {
+				return nil
+			}
+			resp.Body = io.NopCloser(strings.NewReader(longer))
+			switch resp.Request.URL.Path {
+			case "/known":
+				resp.ContentLength = int64(len(longer))
+			case "/unknown":
+				resp.ContentLength = -1
+			}
+			// for /stale the hook leaves the upstream length
+			return nil
+		},
+	}
+	proxy, _ := startProxy(t, cfg)
+
+	tests := []struct {
+		path    string
+		length  int64
+		body    string
+		chunked bool
+	}{
+		{"/known", int64(len(longer)), longer, false},
+		{"/unknown", -1, longer, true},
+		{"/stale", -1, longer, true},
+		{"/untouched", 5, "short", false},
+	}
+	for _, tt := range tests {
+		resp, body := get(t, proxy.Client, "http://news.test"+tt.path)
+		chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+		if resp.StatusCode != http.StatusOK || body != tt.body || resp.ContentLength != tt.length || chunked != tt.chunked {
+			t.Errorf("%s: got %d %q of length %d, chunked %t, want %q of length %d", tt.path, resp.StatusCode, body, resp.ContentLength, chunked, tt.body, tt.length)
+		}
+	}
+}
+
+func TestWithScheme(t *testing.T) {
+	tests := map[string]string{
+		"news.test":               "http://news.test",
+		"news.test:8080/path?q=1": "http://news.test:8080/path?q=1",
+		"https://news.test/":      "https://news.test/",
+		"127.0.0.1:8080/":         "http://127.0.0.1:8080/",
+		"[::1]:8080/":             "http://[::1]:8080/",
+		"bad_host-.test/":         "",
+		"news..test/":             "",
+		"http://a b.test/":        "",
+		"news.test:80:80/":        "",
+	}
+	for target, want := range tests {
+		got := ""
+		if u, ok := withScheme(target, "http"); ok {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", target, got, want)
+		}
+	}
+	if u, ok := withScheme("news.test/", "https"); !ok || u.String() != "https://news.test/" {
+		t.Errorf("got %v, want the https scheme", u)
+	}
+}
+
+func TestWithDefaultScheme(t *testing.T) {
+	var got *http.Request
+	h := WithDefaultScheme(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }), "https")
+	tests := []struct {
+		method, target string
+		want           string
+		schemeLess     bool
+	}{
+		{http.MethodGet, "news.test:8443/path?q=1", "https://news.test:8443/path?q=1", true},
+		{http.MethodGet, "http://news.test/", "http://news.test/", false},
+		{http.MethodGet, "/readyz", "/readyz", false},
+		{http.MethodConnect, "news.test:443", "//news.test:443", false},
+	}
+	for _, tt := range tests {
+		h.ServeHTTP(httptest.NewRecorder(), proxyRequest(t, tt.method, tt.target))
+		target, schemeLess := schemeLessTarget(got)
+		if got.URL.String() != tt.want || schemeLess != tt.schemeLess {
+			t.Errorf("%s %s: got %s, %t, want %s, %t", tt.method, tt.target, got.URL, schemeLess, tt.want, tt.schemeLess)
+		}
+		if schemeLess && (target != tt.target || got.Host != "news.test:8443" || got.RequestURI != tt.want) {
+			t.Errorf("%s: got the original target %q, host %q and request URI %q", tt.target, target, got.Host, got.RequestURI)
+		}
+	}
+}
+
+func TestSchemeLessTargetProxied(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/page", testutil.Route{Body: "page"})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	send := func(target string) (*http.Response, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	if resp, body := send("docs.test:8080/page"); resp.StatusCode != http.StatusOK || body != "page" {
+		t.Errorf("got %d %q, want the page fetched over http", resp.StatusCode, body)
+	}
+	if requests := upstream.Requests(); len(requests) != 1 || requests[0].Host != "docs.test:8080" {
+		t.Errorf("got %+v, want the request sent to docs.test:8080", requests)
+	}
+	// the rules apply to the rewritten target
+	if resp, _ := send("news.test:8080/page"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d, want the block page", resp.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+)
+
+type (
+	// Usage counts requests and bytes per host, keeping at most maxHosts hosts
+	// by evicting the one with the fewest bytes
+	Usage struct {
+		maxHosts int
+
+		mu    sync.Mutex
+		hosts map[string]*HostUsage
+	}
+
+	HostUsage struct {
+		Host     string `json:"host"`
+		Requests int64  `json:"requests"`
+		Bytes    int64  `json:"bytes"`
+	}
+)
+
+func NewUsage(maxHosts int) *Usage {
+	return &Usage{
+		maxHosts: maxHosts,
+		hosts:    make(map[string]*HostUsage),
+	}
+}
+
+// Record accounts one request of size bytes to host
+func (u *Usage) Record(host string, size int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	h, ok := u.hosts[host]
+	if !ok {
+		if len(u.hosts) >= u.maxHosts {
+			u.evict()
+		}
+		h = &HostUsage{Host: host}
+		u.hosts[host] = h
+	}
+	h.Requests++
+	h.Bytes += int64(size)
+}
+
+// evict drops the host with the fewest bytes, must be called with mu held
+func (u *Usage) evict() {
+	var smallest *HostUsage
+	for _, h := range u.hosts {
+		if smallest == nil || h.Bytes < smallest.Bytes {
+			smallest = h
+		}
+	}
+	if smallest != nil {
+		delete(u.hosts, smallest.Host)
+	}
+}
+
+// Report returns the usage of every host, sorted by bytes
+func (u *Usage) Report() []HostUsage {
+	u.mu.Lock()
+	report := make([]HostUsage, 0, len(u.hosts))
+	for _, h := range u.hosts {
+		report = append(report, *h)
+	}
+	u.mu.Unlock()
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Host < report[j].Host
+	})
+	return report
+}
+
+// Load restores the usage saved at path, a missing file is not an error
+func (u *Usage) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var report []HostUsage
+	if err := json.Unmarshal(data, &report); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := range report {
+		if len(u.hosts) >= u.maxHosts {
+			break
+		}
+		h := report[i]
+		u.hosts[h.Host] = &h
+	}
+	return nil
+}
+
+// Save writes the usage to path, replacing the file atomically
+func (u *Usage) Save(path string) error {
+	data, err := json.Marshal(u.Report())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestUsageEvictsSmallestHost(t *testing.T) {
+	u := NewUsage(2)
+	u.Record("big.test", 1000)
+	u.Record("small.test", 10)
+	u.Record("small.test", 10)
+	u.Record("new.test", 100)
+
+	want := []HostUsage{{Host: "big.test", Requests: 1, Bytes: 1000}, {Host: "new.test", Requests: 1, Bytes: 100}}
+	if got := u.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUsageSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	if err := NewUsage(10).Load(path); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+	u := NewUsage(10)
+	u.Record("a.test", 5)
+	u.Record("b.test", 50)
+	if err := u.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a smaller limit keeps the hosts with the most bytes, saved first
+	loaded := NewUsage(1)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	want := []HostUsage{{Host: "b.test", Requests: 1, Bytes: 50}}
+	if got := loaded.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUsageCountsProxiedResponses(t *testing.T) {
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{Body: "0123456789"})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"blocked.test"}
+	proxy, _ := startProxy(t, cfg)
+
+	get(t, proxy.Client, "http://news.test/")
+	get(t, proxy.Client, "http://news.test/")
+	get(t, proxy.Client, "http://docs.test:8080/")
+	get(t, proxy.Client, "http://blocked.test/")
+
+	resp, err := admin.Get(proxy.URL + "/usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []HostUsage
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []HostUsage{{Host: "news.test", Requests: 2, Bytes: 20}, {Host: "docs.test", Requests: 1, Bytes: 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
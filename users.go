@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyRealm is the realm of the credentials asked for by the proxy
+const proxyRealm = "procrastiproxy"
+
+// Users are the credentials of the clients allowed to use the proxy, keyed
+// by name, along with the digest of their password
+type Users map[string][sha256.Size]byte
+
+// ParseUsers parses PROXY_USERS, a list of name:password
+func ParseUsers(entries []string) (Users, error) {
+	users := make(Users, len(entries))
+	for _, entry := range entries {
+		name, password, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || password == "" {
+			return nil, fmt.Errorf("invalid PROXY_USERS entry %q, expected name:password", strings.SplitN(entry, ":", 2)[0])
+		}
+		users[name] = sha256.Sum256([]byte(password))
+	}
+	return users, nil
+}
+
+// Authenticate returns the user whose credentials r carries in its
+// Proxy-Authorization header
+func (u Users) Authenticate(r *http.Request) (string, bool) {
+	name, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return "", false
+	}
+	digest, known := u[name]
+	given := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(digest[:], given[:]) != 1 || !known {
+		return "", false
+	}
+	return name, true
+}
+
+// parseProxyAuthorization decodes basic credentials, the way
+// http.Request.BasicAuth does for the Authorization header
+func parseProxyAuthorization(value string) (name, password string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {value}}}
+	return r.BasicAuth()
+}
+
+// requireProxyAuth asks the client for credentials
+func requireProxyAuth(w http.ResponseWriter, r *http.Request) {
+	annotateAccessLog(r, log.Fields{"auth": "required"})
+	markLocalResponse(r)
+	w.Header().Set("Proxy-Authenticate", `Basic realm="`+proxyRealm+`", charset="UTF-8"`)
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+}
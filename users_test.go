@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+)
+
+func TestParseUsers(t *testing.T) {
+	users, err := ParseUsers([]string{"alice:secret", "bob:with:colon"})
+	if err != nil || len(users) != 2 {
+		t.Fatalf("got %v, %v, want two users", users, err)
+	}
+	for _, entry := range []string{"alice", ":secret", "alice:"} {
+		_, err := ParseUsers([]string{entry})
+		if err == nil {
+			t.Errorf("%q: got no error", entry)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%q: the password is in %q", entry, err)
+		}
+	}
+}
+
+func TestPerUserBlocklists(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "alice.txt"), []byte("video.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PROXY_USERS", "alice:secret,bob:hunter2")
+	t.Setenv("USER_BLOCKLIST_DIR", dir)
+	upstream := testutil.NewUpstream(t)
+	upstream.Handle("/", testutil.Route{})
+	cfg := testConfig(t, upstream)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	alice := proxy.ClientAs(url.UserPassword("alice", "secret"))
+	bob := proxy.ClientAs(url.UserPassword("bob", "hunter2"))
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		target string
+		want   int
+	}{
+		// the blocklist of alice replaces the default one
+		{"alice", alice, "http://news.test/", http.StatusOK},
+		{"alice", alice, "http://video.test/", http.StatusForbidden},
+		{"bob", bob, "http://news.test/", http.StatusForbidden},
+		{"bob", bob, "http://video.test/", http.StatusOK},
+		{"anonymous", proxy.Client, "http://docs.test/", http.StatusProxyAuthRequired},
+		{"wrong password", proxy.ClientAs(url.UserPassword("alice", "hunter2")), "http://docs.test/", http.StatusProxyAuthRequired},
+		{"unknown user", proxy.ClientAs(url.UserPassword("eve", "secret")), "http://docs.test/", http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		resp, _ := get(t, tt.client, tt.target)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.name, tt.target, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusProxyAuthRequired && !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), `Basic realm="procrastiproxy"`) {
+			t.Errorf("%s: got Proxy-Authenticate %q", tt.name, resp.Header.Get("Proxy-Authenticate"))
+		}
+	}
+}
+
+func TestUserBlocklistDirRequiresUsers(t *testing.T) {
+	t.Setenv("USER_BLOCKLIST_DIR", t.TempDir())
+	if _, err := LoadConfig(); err == nil {
+		t.Error("got no error without PROXY_USERS")
+	}
+}
+
+func TestSelftestAuthenticates(t *testing.T) {
+	t.Setenv("PROXY_USERS", "alice:secret")
+	t.Setenv("BLOCKLIST", "news.test")
+	// without credentials, every request would get a 407
+	if code, out := selftest(t); code != 0 || result(out, "passthrough") != "PASS" || result(out, "block page") != "PASS" {
+		t.Errorf("exited with %d:\n%s", code, out)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// backoff bounds for re-establishing a lost watch
+const (
+	rewatchMinDelay = 100 * time.Millisecond
+	rewatchMaxDelay = 30 * time.Second
+)
+
+// WatchFile calls onChange whenever the file at path is written or replaced, until ctx is done.
+// Editors often save by renaming a new file over the old one, which drops the
+// watch along with the old inode, so the watch is re-added on the new file.
+func WatchFile(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(path); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			switch {
+			case event.Has(fsnotify.Write), event.Has(fsnotify.Create):
+				onChange()
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				if !rewatch(ctx, watcher, path) {
+					return nil
+				}
+				onChange()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			rulesLog.WithFields(log.Fields{"event": "watch file", "path": path}).Warn(err)
+		}
+	}
+}
+
+// rewatch adds the watch on path again with exponential backoff, returning false if ctx is done first
+func rewatch(ctx context.Context, watcher *fsnotify.Watcher, path string) bool {
+	// a renamed file keeps its watch, which would report events of the old inode
+	_ = watcher.Remove(path)
+
+	delay := rewatchMinDelay
+	for attempt := 1; ; attempt++ {
+		err := watcher.Add(path)
+		if err == nil {
+			rulesLog.WithFields(log.Fields{"path": path, "attempt": attempt}).Info("file watch re-established")
+			return true
+		}
+		rulesLog.WithFields(log.Fields{"path": path, "attempt": attempt, "retry_in": delay.String()}).Warn("failed to re-watch file:", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > rewatchMaxDelay {
+			delay = rewatchMaxDelay
+		}
+	}
+}
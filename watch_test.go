@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasstkn/procrastiproxy/internal/testutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// watch watches path until the end of the test, returning the channel of its changes
+func watch(t *testing.T, path string) <-chan struct{} {
+	t.Helper()
+	changes := make(chan struct{}, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchFile(ctx, path, func() { changes <- struct{}{} })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	// the watch is only known to be added once a write is seen
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for established := false; !established; {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-changes:
+			established = true
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	drain(changes)
+	return changes
+}
+
+// waitChange waits for a change, then drops the ones following it closely,
+// a single save often making several events
+func waitChange(t *testing.T, changes <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change after %s", what)
+	}
+	drain(changes)
+}
+
+// drain drops the changes until none comes for a while
+func drain(changes <-chan struct{}) {
+	for {
+		select {
+		case <-changes:
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestWatchFileFollowsAtomicReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("news.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes := watch(t, path)
+
+	if err := os.WriteFile(path, []byte("video.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, changes, "a write")
+
+	// the way editors save, and the state files are written
+	if err := writeFileAtomic(path, []byte("chat.test\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, changes, "an atomic replace")
+
+	// the watch is now on the new file
+	if err := os.WriteFile(path, []byte("docs.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, changes, "a write to the new file")
+}
+
+func TestWatchFileRetriesUntilRecreated(t *testing.T) {
+	logs := testutil.CaptureLogs(t, log.StandardLogger())
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("news.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes := watch(t, path)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * rewatchMinDelay / 2)
+	if err := os.WriteFile(path, []byte("video.test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, changes, "the file was recreated")
+
+	failed := 0
+	for _, e := range logs.Entries() {
+		if strings.HasPrefix(e.Message, "failed to re-watch file:") {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Error("no failed attempt logged while the file was missing")
+	}
+	entries := logs.Find("file watch re-established")
+	if len(entries) != 1 || entries[0].Data["attempt"].(int) < 2 {
+		t.Errorf("got %+v, want one entry after several attempts", entries)
+	}
+}
+
+func TestWatchFileMissing(t *testing.T) {
+	if err := WatchFile(context.Background(), filepath.Join(t.TempDir(), "missing"), func() {}); err == nil {
+		t.Error("got no error for a missing file")
+	}
+}
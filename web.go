@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// pacTemplate sends the bypassed hosts direct and every other one through the proxy
+const pacTemplate = `function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	var direct = [%s];
+	for (var i = 0; i < direct.length; i++) {
+		if (host == direct[i] || dnsDomainIs(host, "." + direct[i])) {
+			return "DIRECT";
+		}
+	}
+	return "PROXY %s";
+}
+`
+
+// WebRoutes are the pages served to browsers: the PAC file, the block page
+// and the status of the client, for the browser extensions
+func WebRoutes(s *Server) Routes {
+	return Routes{
+		"/readyz":     readyzHandler(s.health),
+		"/api/status": statusHandler(s.cfg, s.rules, s.stats, s.health, s.flags),
+		"/proxy.pac":  pacHandler(s.cfg, s.rules),
+		"/blocked":    blockedHandler(s),
+	}
+}
+
+// pacHandler serves the PAC file, which leaves the bypassed hosts out of the
+// proxy so that their requests never reach it
+func pacHandler(cfg *Config, rules *RuleSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var direct []string
+		for _, domain := range pacDirect(rules.Load().Bypass) {
+			direct = append(direct, fmt.Sprintf("%q", domain))
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, pacTemplate, strings.Join(direct, ", "), pacProxy(cfg, r))
+	}
+}
+
+// pacDirect returns the domains of the bypass rules a PAC file can express:
+// the ones matching any scheme and path, without an exception below them
+func pacDirect(bypass *Blocklist) []string {
+	var rules, exceptions []*Rule
+	for _, rule := range bypass.Rules() {
+		switch {
+		case rule.Action == ActionAllow:
+			exceptions = append(exceptions, rule)
+		case rule.Domain != "" && rule.Scheme == "" && rule.Path == "":
+			rules = append(rules, rule)
+		}
+	}
+	var domains []string
+rules:
+	for _, rule := range rules {
+		for _, exception := range exceptions {
+			if exception.Domain == "" || exception.Domain == rule.Domain || strings.HasSuffix(exception.Domain, "."+rule.Domain) {
+				continue rules
+			}
+		}
+		domains = append(domains, rule.Domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// pacProxy returns PAC_PROXY, or else the address the PAC file was fetched
+// from when it serves the proxy as well, or else that host with the port of
+// the first listener serving the proxy
+func pacProxy(cfg *Config, r *http.Request) string {
+	if cfg.PACProxy != "" {
+		return cfg.PACProxy
+	}
+	if servesRole(r, RoleProxy) {
+		return r.Host
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	for _, lc := range cfg.Listeners {
+		for _, role := range lc.Roles {
+			if _, port, err := net.SplitHostPort(lc.Addr); role == RoleProxy && err == nil {
+				return net.JoinHostPort(host, port)
+			}
+		}
+	}
+	return r.Host
+}
+
+// blockedHandler serves the block page of the url parameter, for the
+// browser extensions sending their blocked pages there
+func blockedHandler(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := withScheme(r.URL.Query().Get("url"), s.cfg.DefaultScheme)
+		if !ok {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		d := s.rules.Load().Evaluate(Request{Target: URLTarget(u), Now: s.cfg.clock()()})
+		if d.Verdict != VerdictBlock || d.Action != ActionBlock {
+			http.Error(w, u.Hostname()+" is not blocked", http.StatusNotFound)
+			return
+		}
+		serveBlocked(w, r, s.cfg.BlockStatusCode, blockedPage{
+			Locale:        s.locales.For(r),
+			Host:          u.Hostname(),
+			Rule:          d.Rule.Pattern,
+			BudgetEnabled: s.flags.Enabled(FlagSiteBudget) && s.stats.Budget.Enabled(),
+			TokensLeft:    s.stats.Budget.Remaining(),
+		})
+	}
+}
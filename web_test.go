@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPACFile(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.BypassHosts = []string{"bank.test", "Health.test", "http://plain.test", "docs.test/private", "~secret", "shop.test", "!pay.shop.test"}
+	proxy, _ := startProxy(t, cfg)
+
+	resp, body := get(t, http.DefaultClient, proxy.URL+"/proxy.pac")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("got %d %s, want the PAC file", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	// only the rules of whole hosts can be left out of the proxy
+	if want := `var direct = ["bank.test", "health.test"];`; !strings.Contains(body, want) {
+		t.Errorf("got %s, want %s", body, want)
+	}
+	// without PAC_PROXY, the proxy is the listener the PAC file comes from
+	if want := `return "PROXY ` + strings.TrimPrefix(proxy.URL, "http://") + `";`; !strings.Contains(body, want) {
+		t.Errorf("got %s, want %s", body, want)
+	}
+}
+
+func TestPACProxy(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.PACProxy = "proxy.lan:3128"
+	proxy, _ := startProxy(t, cfg)
+	if _, body := get(t, http.DefaultClient, proxy.URL+"/proxy.pac"); !strings.Contains(body, `return "PROXY proxy.lan:3128";`) {
+		t.Errorf("got %s, want PAC_PROXY", body)
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "http://web.lan:8080/proxy.pac", nil)
+	r = r.WithContext(context.WithValue(r.Context(), listenerRolesKey{}, []string{RoleWeb}))
+	cfg.PACProxy = ""
+	cfg.Listeners = []ListenerConfig{{Addr: ":8080", Roles: []string{RoleWeb}}, {Addr: ":3128", Roles: []string{RoleProxy}}}
+	if got := pacProxy(cfg, r); got != "web.lan:3128" {
+		t.Errorf("got %s, want the port of the proxy listener", got)
+	}
+}
+
+func TestPACDirect(t *testing.T) {
+	bypass := NewBlocklist(ActionBypass, SourceEnv, []string{"b.test", "a.test", "c.test", "!x.c.test", "d.test/path"})
+	if got, want := pacDirect(bypass), []string{"a.test", "b.test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBlockedPage(t *testing.T) {
+	cfg := testConfig(t, nil)
+	cfg.Blocklist = []string{"news.test"}
+	proxy, _ := startProxy(t, cfg)
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"news.test", http.StatusForbidden, "news.test"},
+		{"https://www.news.test/article", http.StatusForbidden, "www.news.test"},
+		{"docs.test", http.StatusNotFound, "docs.test is not blocked"},
+		{"", http.StatusBadRequest, "invalid url"},
+	}
+	for _, tt := range tests {
+		resp, body := get(t, http.DefaultClient, proxy.URL+"/blocked?url="+tt.url)
+		if resp.StatusCode != tt.status || !strings.Contains(body, tt.body) {
+			t.Errorf("%q: got %d %q, want %d with %q", tt.url, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+}